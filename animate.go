@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/nfnt/resize"
+
+	"github.com/stakwork/sphinx-meme/auth"
+	"github.com/stakwork/sphinx-meme/lsat"
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// animated memes are made from a list of images, or from a GIF, with
+// captions over some or all of the frames. The GIF is made small: all
+// frames share one palette, and after the first each frame only has
+// the pixels that changed, the rest transparent
+
+// limits on what can be animated
+const (
+	maxGifFrames = 100
+	maxGifSide   = 480 // frames are shrunk to fit
+)
+
+// in hundredths of a second. Browsers slow down anything faster
+// than minGifDelay, so it is not allowed
+const (
+	defaultGifDelay = 10
+	minGifDelay     = 2
+)
+
+// gifCaption is a caption over the frames from to to, counted from 0.
+// to of 0 is the last frame
+type gifCaption struct {
+	captionLayer
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// gifRequest is the body of an animation, made from the images in
+// frames or from the GIF gif. Delays are per frame, delay for the
+// frames without one. loop is how many times the GIF repeats after
+// the first, 0 for ever and -1 for none
+type gifRequest struct {
+	Frames      []string     `json:"frames"`
+	Gif         string       `json:"gif"`
+	Delays      []int        `json:"delays"`
+	Delay       int          `json:"delay"`
+	Loop        int          `json:"loop"`
+	Captions    []gifCaption `json:"captions"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Price       int64        `json:"price"`
+	TTL         int64        `json:"ttl"`
+	Tags        []string     `json:"tags"`
+	Expiry      int64        `json:"expiry"`
+}
+
+// errAnimation is an animation that can not be made as asked
+type errAnimation struct {
+	message string
+}
+
+func (e errAnimation) Error() string {
+	return e.message
+}
+
+// errFrameMissing is a frame whose media row has no blob left to read
+var errFrameMissing = errors.New("Frame not found")
+
+// eachGifFrame draws each frame of g as it is shown, over the ones
+// before it as their disposal leaves them, and passes it to fn. The
+// frame is drawn over for the next one, fn copies what it keeps
+func eachGifFrame(g *gif.GIF, fn func(i int, frame *image.RGBA)) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = copyRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		fn(i, canvas)
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+}
+
+func copyRGBA(img *image.RGBA) *image.RGBA {
+	c := image.NewRGBA(img.Bounds())
+	copy(c.Pix, img.Pix)
+	return c
+}
+
+// frameEnergy is how much detail there is in img, its edges added up
+func frameEnergy(img image.Image) int64 {
+	small := resize.Thumbnail(64, 64, img, resize.Bilinear)
+	b := small.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(gray, gray.Bounds(), small, b.Min, draw.Over)
+	energy := int64(0)
+	for y := 1; y < gray.Bounds().Dy(); y++ {
+		for x := 1; x < gray.Bounds().Dx(); x++ {
+			i := gray.PixOffset(x, y)
+			p := int64(gray.Pix[i])
+			energy += abs64(p-int64(gray.Pix[i-1])) + abs64(p-int64(gray.Pix[i-gray.Stride]))
+		}
+	}
+	return energy
+}
+
+// representativeFrame is the frame of g with the most detail, as the
+// first one is often blank or fading in. Only some of the frames of
+// long GIFs are looked at
+func representativeFrame(g *gif.GIF) *image.RGBA {
+	const candidates = 20
+	step := 1
+	if len(g.Image) > candidates {
+		step = len(g.Image) / candidates
+	}
+	var best *image.RGBA
+	bestEnergy := int64(-1)
+	eachGifFrame(g, func(i int, frame *image.RGBA) {
+		if i%step != 0 {
+			return
+		}
+		if energy := frameEnergy(frame); energy > bestEnergy {
+			best, bestEnergy = copyRGBA(frame), energy
+		}
+	})
+	return best
+}
+
+// medianCut is a palette of at most n colors for the pixels, made by
+// splitting the box of colors with the widest range in two at its
+// median until there are n boxes, each giving its average color
+func medianCut(pixels [][3]uint8, n int) color.Palette {
+	if len(pixels) == 0 {
+		return color.Palette{color.Black}
+	}
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < n {
+		widest, widestAt, channel := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				lo, hi := uint8(255), uint8(0)
+				for _, p := range box {
+					if p[c] < lo {
+						lo = p[c]
+					}
+					if p[c] > hi {
+						hi = p[c]
+					}
+				}
+				if int(hi)-int(lo) > widest {
+					widest, widestAt, channel = int(hi)-int(lo), i, c
+				}
+			}
+		}
+		if widest <= 0 {
+			break
+		}
+		box := boxes[widestAt]
+		sort.Slice(box, func(i, j int) bool { return box[i][channel] < box[j][channel] })
+		half := len(box) / 2
+		boxes[widestAt] = box[:half]
+		boxes = append(boxes, box[half:])
+	}
+	palette := color.Palette{}
+	for _, box := range boxes {
+		var r, g, b int
+		for _, p := range box {
+			r += int(p[0])
+			g += int(p[1])
+			b += int(p[2])
+		}
+		palette = append(palette, color.RGBA{uint8(r / len(box)), uint8(g / len(box)), uint8(b / len(box)), 255})
+	}
+	return palette
+}
+
+// quantizer maps colors to a palette. Colors are looked up with 5
+// bits a channel, so each of those is worked out only once
+type quantizer struct {
+	palette color.Palette
+	lookup  []int16
+}
+
+func newQuantizer(palette color.Palette) *quantizer {
+	q := &quantizer{palette: palette, lookup: make([]int16, 1<<15)}
+	for i := range q.lookup {
+		q.lookup[i] = -1
+	}
+	return q
+}
+
+func (q *quantizer) index(r, g, b uint8) uint8 {
+	key := int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+	if q.lookup[key] < 0 {
+		q.lookup[key] = int16(q.palette.Index(color.RGBA{r, g, b, 255}))
+	}
+	return uint8(q.lookup[key])
+}
+
+// encodeGif makes a GIF of opaque frames, all the same size. A frame
+// that is no different from the one before only adds to its delay
+func encodeGif(frames []*image.RGBA, delays []int, loop int) ([]byte, error) {
+	// a sample of the pixels of every frame makes up the palette,
+	// with one more color for the pixels that did not change
+	const samples = 1 << 16
+	bounds := frames[0].Bounds()
+	pixels := make([][3]uint8, 0, samples)
+	step := len(frames) * bounds.Dx() * bounds.Dy() / samples
+	if step < 1 {
+		step = 1
+	}
+	n := 0
+	for _, f := range frames {
+		for i := 0; i < len(f.Pix); i += 4 {
+			if n%step == 0 {
+				pixels = append(pixels, [3]uint8{f.Pix[i], f.Pix[i+1], f.Pix[i+2]})
+			}
+			n++
+		}
+	}
+	palette := medianCut(pixels, 255)
+	transparent := uint8(len(palette))
+	palette = append(palette, color.RGBA{})
+	q := newQuantizer(palette[:transparent])
+
+	g := &gif.GIF{
+		LoopCount: loop,
+		Config:    image.Config{ColorModel: palette, Width: bounds.Dx(), Height: bounds.Dy()},
+	}
+	var shown *image.Paletted
+	for i, f := range frames {
+		full := image.NewPaletted(bounds, palette)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				p := f.Pix[f.PixOffset(x, y):]
+				full.Pix[full.PixOffset(x, y)] = q.index(p[0], p[1], p[2])
+			}
+		}
+		if shown == nil {
+			g.Image = append(g.Image, full)
+			g.Delay = append(g.Delay, delays[i])
+			g.Disposal = append(g.Disposal, gif.DisposalNone)
+			shown = full
+			continue
+		}
+
+		// only the pixels that changed, within the
+		// rectangle around them, the rest shows through
+		changed := image.Rectangle{}
+		diff := image.NewPaletted(bounds, palette)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				o := full.PixOffset(x, y)
+				if full.Pix[o] == shown.Pix[o] {
+					diff.Pix[o] = transparent
+					continue
+				}
+				diff.Pix[o] = full.Pix[o]
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+		if changed.Empty() {
+			g.Delay[len(g.Delay)-1] += delays[i]
+			continue
+		}
+		g.Image = append(g.Image, diff.SubImage(changed).(*image.Paletted))
+		g.Delay = append(g.Delay, delays[i])
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+		shown = full
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// animate draws the captions on the frames, all made the size of
+// the first and opaque, and encodes them
+func animate(frames []image.Image, delays []int, captions []gifCaption, loop int) ([]byte, error) {
+	if len(frames) == 0 {
+		return nil, errAnimation{"No frames"}
+	}
+	if len(frames) > maxGifFrames {
+		return nil, errAnimation{fmt.Sprintf("more than %d frames", maxGifFrames)}
+	}
+	if len(captions) > maxCaptionLayers {
+		return nil, errAnimation{fmt.Sprintf("more than %d captions", maxCaptionLayers)}
+	}
+	for _, d := range delays {
+		if d < minGifDelay {
+			return nil, errAnimation{fmt.Sprintf("delays are at least %d", minGifDelay)}
+		}
+	}
+	if loop < -1 || loop > 65535 {
+		return nil, errAnimation{"loop is from -1 to 65535"}
+	}
+
+	w, h := frames[0].Bounds().Dx(), frames[0].Bounds().Dy()
+	if w > maxGifSide && w >= h {
+		w, h = maxGifSide, maxInt(1, h*maxGifSide/w)
+	} else if h > maxGifSide {
+		w, h = maxInt(1, w*maxGifSide/h), maxGifSide
+	}
+	size := image.Rect(0, 0, w, h)
+	canvases := make([]*image.RGBA, len(frames))
+	for i, f := range frames {
+		if f.Bounds().Dx() != size.Dx() || f.Bounds().Dy() != size.Dy() {
+			f = resizeImage(f, resizeSpec{w: size.Dx(), h: size.Dy(), fit: fitCover, crop: cropCenter})
+		}
+		canvas := image.NewRGBA(image.Rect(0, 0, size.Dx(), size.Dy()))
+		// gifs have no partial transparency
+		draw.Draw(canvas, canvas.Bounds(), image.White, image.ZP, draw.Src)
+		draw.Draw(canvas, canvas.Bounds(), f, f.Bounds().Min, draw.Over)
+		for _, c := range captions {
+			to := c.To
+			if to == 0 {
+				to = len(frames) - 1
+			}
+			if i < c.From || i > to {
+				continue
+			}
+			if err := drawCaption(canvas, c.captionLayer); err != nil {
+				return nil, err
+			}
+		}
+		canvases[i] = canvas
+	}
+	return encodeGif(canvases, delays, loop)
+}
+
+// readFrames reads what an animation is made of: the caller's own
+// images or templates, and the delays they are shown for
+func readFrames(pubKey string, req gifRequest) ([]image.Image, []int, error) {
+	muids := req.Frames
+	if req.Gif != "" {
+		if len(muids) > 0 {
+			return nil, nil, errAnimation{"frames or a gif, not both"}
+		}
+		muids = []string{req.Gif}
+	}
+	if len(muids) == 0 {
+		return nil, nil, errAnimation{"No frames"}
+	}
+	if len(muids) > maxGifFrames {
+		return nil, nil, errAnimation{fmt.Sprintf("more than %d frames", maxGifFrames)}
+	}
+
+	frames := []image.Image{}
+	sourceDelays := []int{}
+	for _, muid := range muids {
+		m := DB.getMyMediaByMUID(pubKey, muid)
+		if m.ID == "" {
+			m = DB.getTemplateByMuid(muid)
+		}
+		if m.ID == "" || isExpired(m) || !isPreviewable(m.Mime) {
+			return nil, nil, errAnimation{fmt.Sprintf("%s is not an image of yours", muid)}
+		}
+		blob := DB.getBlob(muid)
+		if blob.ID == "" {
+			return nil, nil, errFrameMissing
+		}
+		reader, err := storage.Backend(blob.Encrypted, blob.KeyID).GetReader(muid, blob.NonceBytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if req.Gif != "" {
+			if err := checkImage(data); err != nil {
+				return nil, nil, err
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				return nil, nil, errAnimation{fmt.Sprintf("%s is not a gif", muid)}
+			}
+			if len(g.Image) > maxGifFrames {
+				return nil, nil, errAnimation{fmt.Sprintf("more than %d frames", maxGifFrames)}
+			}
+			// kept no bigger than they end up. Thumbnail hands back
+			// frames that are small enough as they are, so those are copied
+			eachGifFrame(g, func(i int, frame *image.RGBA) {
+				small := resize.Thumbnail(maxGifSide, maxGifSide, frame, resize.Bilinear)
+				if small == image.Image(frame) {
+					small = copyRGBA(frame)
+				}
+				frames = append(frames, small)
+				d := defaultGifDelay
+				if i < len(g.Delay) && g.Delay[i] >= minGifDelay {
+					d = g.Delay[i]
+				}
+				sourceDelays = append(sourceDelays, d)
+			})
+			continue
+		}
+		img, _, err := decodeImage(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, errAnimation{fmt.Sprintf("%s is not an image", muid)}
+		}
+		frames = append(frames, resize.Thumbnail(maxGifSide, maxGifSide, img, resize.Bilinear))
+		sourceDelays = append(sourceDelays, 0)
+	}
+
+	// delays asked for, then the gif's own, then delay
+	delays := make([]int, len(frames))
+	for i := range delays {
+		switch {
+		case i < len(req.Delays):
+			delays[i] = req.Delays[i]
+		case sourceDelays[i] > 0 && req.Delay == 0:
+			delays[i] = sourceDelays[i]
+		case req.Delay != 0:
+			delays[i] = req.Delay
+		default:
+			delays[i] = defaultGifDelay
+		}
+	}
+	return frames, delays, nil
+}
+
+// makeGif makes an animated GIF and stores it as a new
+// media of the caller's, like a public upload
+func makeGif(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pubKey := ctx.Value(auth.ContextKey).(string)
+
+	req := gifRequest{}
+	body := http.MaxBytesReader(w, r.Body, maxFormValueSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Could not read the frames")
+		return
+	}
+
+	var animated []byte
+	err := runImageWork(func() error {
+		frames, delays, err := readFrames(pubKey, req)
+		if err != nil {
+			return err
+		}
+		animated, err = animate(frames, delays, req.Captions, req.Loop)
+		return err
+	})
+	if err != nil {
+		fmt.Println(err)
+		if status, ok := imageErrorStatus(err); ok {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		if err == errFrameMissing {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		switch err.(type) {
+		case errAnimation, errCaption:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err.Error())
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode("Could not make the gif")
+		}
+		return
+	}
+	// the gif counts towards the quota like an upload
+	if max, ok := ctx.Value(lsat.MaxUploadSizeContextKey).(int64); ok && int64(len(animated)) > max {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode("File too big")
+		return
+	}
+
+	media, err := mediaFromParams(pubKey, uploadParams{
+		Price:       req.Price,
+		TTL:         req.TTL,
+		Name:        req.Name,
+		Description: req.Description,
+		Tags:        req.Tags,
+		Expiry:      req.Expiry,
+	}, "meme.gif", "image/gif")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+
+	nonce, _ := storage.Store.GenNonce()
+	stored, err := storeUpload(bytes.NewReader(animated), "image/gif", nonce, true)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode("Error Storing the File")
+		return
+	}
+	stored.applyTo(&media)
+	media.Metadata = metadataStripped
+	media.Public = true
+	fmt.Printf("MEDIA: %+v\n", media)
+
+	created, _, err := saveUpload(stored, nonce, media, derivativeJobs(media.Mime, true, true))
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(created)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"testing"
+)
+
+func filled(r image.Rectangle, c color.Color) *image.Paletted {
+	p := image.NewPaletted(r, color.Palette{color.Transparent, color.White, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}})
+	draw.Draw(p, r, image.NewUniform(c), image.ZP, draw.Src)
+	return p
+}
+
+func TestGifFrames(t *testing.T) {
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			filled(image.Rect(0, 0, 4, 4), red),
+			filled(image.Rect(0, 0, 2, 2), blue),
+			filled(image.Rect(2, 2, 4, 4), blue),
+		},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious},
+		Config:   image.Config{Width: 4, Height: 4},
+	}
+	frames := []*image.RGBA{}
+	eachGifFrame(g, func(i int, frame *image.RGBA) {
+		frames = append(frames, copyRGBA(frame))
+	})
+	if len(frames) != 3 {
+		t.Fatalf("%d frames", len(frames))
+	}
+	for i, want := range []map[image.Point]color.RGBA{
+		{{0, 0}: red, {3, 3}: red},
+		{{0, 0}: blue, {3, 3}: red},
+		// the first corner was cleared
+		{{0, 0}: {}, {3, 3}: blue},
+	} {
+		for p, c := range want {
+			if got := frames[i].RGBAAt(p.X, p.Y); got != c {
+				t.Errorf("frame %d at %v: %v", i, p, got)
+			}
+		}
+	}
+}
+
+func TestRepresentativeFrame(t *testing.T) {
+	blank := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(blank, blank.Bounds(), image.White, image.ZP, draw.Src)
+	busy := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(busy, busy.Bounds(), scene(32, 32, 1), image.ZP, draw.Src)
+	if frameEnergy(busy) <= frameEnergy(blank) {
+		t.Errorf("energy %d <= %d", frameEnergy(busy), frameEnergy(blank))
+	}
+
+	// the thumbnails of a gif that fades in
+	buf := &bytes.Buffer{}
+	gif.EncodeAll(buf, &gif.GIF{
+		Image: []*image.Paletted{filled(image.Rect(0, 0, 8, 8), color.White), filled(image.Rect(0, 0, 8, 4), color.RGBA{255, 0, 0, 255})},
+		Delay: []int{10, 10},
+	})
+	img, transparent, err := decodeImage(buf)
+	if err != nil || transparent {
+		t.Fatalf("decode: %v %v", transparent, err)
+	}
+	if c := color.RGBAModel.Convert(img.At(0, 0)).(color.RGBA); c.G != 0 {
+		t.Errorf("first frame: %v", c)
+	}
+}
+
+func TestAnimate(t *testing.T) {
+	first := scene(600, 300, 1)
+	second := image.NewNRGBA(first.Bounds())
+	draw.Draw(second, second.Bounds(), first, image.ZP, draw.Src)
+	// a change in one corner
+	draw.Draw(second, image.Rect(0, 0, 60, 60), image.Black, image.ZP, draw.Src)
+
+	animated, err := animate([]image.Image{first, first, second, scene(100, 100, 2)}, []int{10, 20, 30, 40}, []gifCaption{
+		{captionLayer: captionLayer{Text: "all"}},
+		{captionLayer: captionLayer{Text: "last", Y: 0.5}, From: 3},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(animated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shrunk to fit, the same frame twice is shown once for longer
+	if g.Config.Width != maxGifSide || g.Config.Height != maxGifSide/2 || len(g.Image) != 3 {
+		t.Fatalf("%dx%d, %d frames", g.Config.Width, g.Config.Height, len(g.Image))
+	}
+	if g.Delay[0] != 30 || g.Delay[1] != 30 || g.Delay[2] != 40 {
+		t.Errorf("delays %v", g.Delay)
+	}
+	// only what changed
+	if b := g.Image[1].Bounds(); b.Dx() > 60 || b.Dy() > 60 {
+		t.Errorf("second frame is %v", b)
+	}
+
+	for _, bad := range [][]int{{1}, {10, 0}} {
+		frames := make([]image.Image, len(bad))
+		for i := range frames {
+			frames[i] = first
+		}
+		if _, err := animate(frames, bad, nil, 0); err == nil {
+			t.Errorf("delays %v", bad)
+		}
+	}
+}
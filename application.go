@@ -21,8 +21,19 @@ func main() {
 	}
 
 	initDB()
-	auth.Init()
 	storage.Init()
+	DB.resolveLegacyEncryption(storage.LegacyEncrypted)
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	auth.Init()
+	startReaper()
+	startJobs()
+	startRekeying()
+	startScrubber()
 	r := initRouter()
 
 	port := os.Getenv("PORT")
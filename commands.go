@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// runCommand runs a maintenance subcommand instead of the server,
+// e.g. `sphinx-meme encrypt-at-rest` or `sphinx-meme migrate-storage s3`
+func runCommand(args []string) {
+	switch args[0] {
+	case "encrypt-at-rest":
+		migrateEncryption()
+	case "migrate-storage":
+		if len(args) < 2 {
+			fmt.Println("usage: migrate-storage local|s3|s3store [-cutover]")
+			os.Exit(1)
+		}
+		if len(args) > 2 && args[2] == "-cutover" {
+			cutoverStorage(args[1])
+			return
+		}
+		migrateStorage(args[1])
+	case "warm-variants":
+		specs, err := parseResizeSpecs(args[1:])
+		if err != nil {
+			fmt.Println("usage: warm-variants [WxH[:fit[:crop]]...]", err)
+			os.Exit(1)
+		}
+		MigrateThumbnails(specs)
+	case "backfill-previews":
+		backfillPreviews()
+	case "scrub":
+		clean := len(args) > 1 && args[1] == "-clean"
+		if _, err := scrub(clean); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("unknown command:", args[0])
+		os.Exit(1)
+	}
+}
+
+// migrateEncryption rewrites the plaintext blobs from before
+// encryption at rest, then flips their marker. Blobs that are already
+// encrypted are skipped, so it can be interrupted and run again
+func migrateEncryption() {
+	bs := DB.getUnencryptedBlobs()
+	total := len(bs)
+	fmt.Printf("=> %d plaintext blobs\n", total)
+
+	failed := 0
+	for i, b := range bs {
+		fmt.Printf("=> %v:%v %s\n", total, i, b.ID)
+		if err := encryptBlob(b); err != nil {
+			fmt.Println("failed", b.ID, err)
+			failed++
+		}
+	}
+	fmt.Printf("=> done, %d failed\n", failed)
+}
+
+func encryptBlob(b Blob) error {
+	if _, err := hex.DecodeString(b.Nonce); err != nil {
+		return err
+	}
+	nonce := b.NonceBytes()
+
+	if err := storage.Encrypted.EncryptInPlace(b.ID, nonce, ""); err != nil {
+		return err
+	}
+	// variants are optional, a missing one is not a failure
+	for _, suffix := range blobVariants(b.ID) {
+		if err := storage.Encrypted.EncryptInPlace(b.ID+suffix, nonce, ""); err != nil {
+			fmt.Println("skipping", b.ID+suffix, err)
+		}
+	}
+
+	// make sure the original decrypts back to its content hash
+	reader, err := storage.Uncached(true, storage.Encrypted.KeyID()).GetReader(b.ID, nonce)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	muid, err := muidOf(reader)
+	if err != nil {
+		return err
+	}
+	if muid != b.ID {
+		return fmt.Errorf("hash mismatch after encrypting: %s", muid)
+	}
+	return DB.markEncrypted(b.ID, storage.Encrypted.KeyID())
+}
+
+// the store a migration copies into is configured like the
+// active one, with this prefix: TARGET_LOCAL_DIR, TARGET_S3_BUCKET...
+const targetEnvPrefix = "TARGET_"
+
+// the parts of a store the commands need
+type blobStore interface {
+	GetReader(string, [32]byte) (io.ReadCloser, error)
+	PostReader(string, io.Reader, int64, string, [32]byte) error
+	Move(string, string) error
+	Delete(string) error
+}
+
+// migrationTarget names the store a migration copies into, the
+// backend and where in it, so that progress into one is not taken
+// for progress into another
+func migrationTarget(mode string) string {
+	return strings.ToLower(mode) + ":" + os.Getenv(targetEnvPrefix+"LOCAL_DIR") +
+		os.Getenv(targetEnvPrefix+"S3_BUCKET") + "/" + os.Getenv(targetEnvPrefix+"S3_PREFIX")
+}
+
+// migrateStorage copies every blob and its variants from the active
+// store into another backend, encrypting plaintext blobs on the way.
+// Files already in the target with the right hash are skipped, so an
+// interrupted run can simply be started again. The blob rows keep
+// describing the active store until cutoverStorage
+func migrateStorage(mode string) {
+	target, err := storage.Open(mode, targetEnvPrefix)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	bs := DB.getAllBlobs()
+	total := len(bs)
+	fmt.Printf("=> %d blobs to %s\n", total, mode)
+
+	copied, failed := 0, 0
+	for i, b := range bs {
+		n, err := migrateBlob(target, migrationTarget(mode), b)
+		if err != nil {
+			fmt.Printf("=> %v/%v %s failed: %v\n", i+1, total, b.ID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("=> %v/%v %s %d files copied\n", i+1, total, b.ID, n)
+		copied += n
+	}
+	fmt.Printf("=> done, %d files copied, %d blobs failed\n", copied, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// cutoverStorage marks the blobs as the target has them, encrypted
+// under the key they were copied with. Run it with the server stopped,
+// after a migration that left no blob out, then switch STORAGE_MODE
+// over to the target
+func cutoverStorage(mode string) {
+	missing, err := DB.cutoverMigration(migrationTarget(mode))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if missing > 0 {
+		fmt.Printf("=> %d blobs are not in %s yet, run migrate-storage %s again\n", missing, mode, mode)
+		os.Exit(1)
+	}
+	fmt.Printf("=> blobs are now in %s, switch STORAGE_MODE over\n", mode)
+}
+
+// migrateBlob copies an original, checked against its muid, and
+// whichever of its variants exist. Everything is written under the
+// current key, plaintext blobs get encrypted on the way, and that is
+// recorded against targetName for the cutover
+func migrateBlob(target blobStore, targetName string, b Blob) (int, error) {
+	src := storage.Uncached(b.Encrypted, b.KeyID)
+	nonce := b.NonceBytes()
+
+	copied := 0
+	done, err := migrateFile(src, target, b.ID, nonce, b.ID)
+	if err != nil {
+		return copied, err
+	}
+	if done {
+		copied++
+	}
+	for _, suffix := range blobVariants(b.ID) {
+		// variants are optional, only a missing one can be skipped
+		want, err := hashOf(src, b.ID+suffix, nonce)
+		if err != nil {
+			continue
+		}
+		done, err := migrateFile(src, target, b.ID+suffix, nonce, want)
+		if err != nil {
+			return copied, err
+		}
+		if done {
+			copied++
+		}
+	}
+
+	// the target has everything under the current key, while
+	// the source is left as it was until the cutover
+	return copied, DB.markMigrated(b.ID, targetName, storage.Encrypted.KeyID())
+}
+
+// migrateFile copies one file unless the target already has it with
+// hash want. It is written to a staging key and only moved in place
+// once it reads back right. The bool is true if it was copied
+func migrateFile(src, target blobStore, path string, nonce [32]byte, want string) (bool, error) {
+	if got, err := hashOf(target, path, nonce); err == nil && got == want {
+		return false, nil
+	}
+
+	reader, err := src.GetReader(path, nonce)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	hasher, _ := blake2b.New256(nil)
+
+	staging := path + "_migrating"
+	if err := target.PostReader(staging, io.TeeReader(reader, hasher), -1, "", nonce); err != nil {
+		target.Delete(staging)
+		return false, err
+	}
+	if got := base64.URLEncoding.EncodeToString(hasher.Sum(nil)); got != want {
+		target.Delete(staging)
+		return false, fmt.Errorf("source of %s hashes to %s", path, got)
+	}
+	if got, err := hashOf(target, staging, nonce); err != nil || got != want {
+		target.Delete(staging)
+		return false, fmt.Errorf("copy of %s does not verify: %v", path, err)
+	}
+	return true, target.Move(staging, path)
+}
+
+func hashOf(s blobStore, path string, nonce [32]byte) (string, error) {
+	reader, err := s.GetReader(path, nonce)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return muidOf(reader)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// blobs are copied into another memory store, a second run picks up
+// where the first left off, and after the cutover the server reads
+// everything from the new store alone
+func TestMigrateStorage(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+
+	contents := []byte("a meme to move\n")
+	file := upload(t, server, "/file", owner.token, contents, nil)
+	public := upload(t, server, "/public", owner.token, pngOf(t, 4, 3), nil)
+	for _, kind := range []string{jobThumb, jobMedium} {
+		if err := runJob(Job{Kind: kind, Muid: public.ID}); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+	}
+
+	target, err := storage.Open("memory", targetEnvPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := migrationTarget("memory")
+	bs := db.getAllBlobs()
+	if len(bs) != 2 {
+		t.Fatalf("blobs: %+v", bs)
+	}
+
+	// interrupted after the first blob
+	if n, err := migrateBlob(target, name, bs[0]); err != nil || n == 0 {
+		t.Fatalf("first blob: %d %v", n, err)
+	}
+	if missing, err := db.cutoverMigration(name); err != nil || missing != 1 {
+		t.Fatalf("cutover with a blob left: %d %v", missing, err)
+	}
+
+	// run again, the first blob is already there
+	for i, b := range bs {
+		n, err := migrateBlob(target, name, b)
+		if err != nil {
+			t.Fatalf("%s: %v", b.ID, err)
+		}
+		if (i == 0) != (n == 0) {
+			t.Errorf("%s: %d files copied", b.ID, n)
+		}
+	}
+	for _, b := range bs {
+		for _, path := range append([]string{b.ID}, blobVariants(b.ID)...) {
+			if _, err := storage.Memory.GetReader(path, [32]byte{}); err != nil {
+				continue
+			}
+			if _, err := target.GetReader(path, b.NonceBytes()); err != nil {
+				t.Errorf("%s not copied: %v", path, err)
+			}
+		}
+	}
+	if missing, err := db.cutoverMigration(name); err != nil || missing != 0 {
+		t.Fatalf("cutover: %d %v", missing, err)
+	}
+	if len(db.migrations) != 0 {
+		t.Errorf("progress left after the cutover: %v", db.migrations)
+	}
+
+	// switched over, with nothing left in the old store
+	storage.Store = target
+	storage.Memory.Init()
+	token := mediaToken(t, owner.key, file.ID, "", time.Now().Add(time.Hour))
+	res, got := request(t, "GET", server.URL+"/file/"+token, owner.token, nil, nil)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(got, contents) {
+		t.Errorf("file after the cutover: %d %q", res.StatusCode, got)
+	}
+	for _, query := range []string{"", "?thumb=true", "?medium=true"} {
+		res, _ := request(t, "GET", server.URL+"/public/"+public.ID+query, "", nil, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("public%s after the cutover: %d", query, res.StatusCode)
+		}
+	}
+}
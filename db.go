@@ -1,15 +1,79 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-type database struct {
+// database is everything the handlers and background tasks need
+// from postgres, so that tests can put an in-memory one in DB
+type database interface {
+	// media rows
+	getMyMedia(pubKey string) []Media
+	getMediaWithDimensions() []Media
+	getAllMedia() []Media
+	getTemplates() []Media
+	getExpiredMedia(limit int) []Media
+	getMediaWithDimensionsByMuid(muid string) Media
+	getTemplateByMuid(muid string) Media
+	getMyMediaByMUID(pubKey, muid string) Media
+	getMediaByMUID(muid string) Media
+	getMediaOwners(muid string) []Media
+	getOwner(muid string) string
+	searchMedia(s string) []Media
+	mediaPurchase(pubKey, muid string) Media
+	updateMedia(muid string, u map[string]interface{}) bool
+	setPreview(muid, blurhash string, palette []string) error
+	setPhash(muid string, phash int64, bands []int64) error
+	similarMedia(phash int64, bands []int64, distance int) []Similar
+	createMedia(m Media, b Blob, jobs []string, moveIn, moveOut func() error) (Media, Blob, bool, error)
+	releaseMedia(muid, pubKey string, tombstone bool, removeFiles func() error) error
+
+	// blobs, and keeping them encrypted and intact
+	getBlob(muid string) Blob
+	getAllBlobs() []Blob
+	resolveLegacyEncryption(encrypted bool)
+	getUnencryptedBlobs() []Blob
+	markEncrypted(muid, keyID string) error
+	markMigrated(muid, target, keyID string) error
+	cutoverMigration(target string) (int, error)
+	getBlobsToRekey(keyID string, limit int) []Blob
+	rekeyBlob(muid, keyID string, rekey func() error) error
+	getMediaWithoutBlob() []Media
+	deleteMediaWithoutBlob(muid string) error
+	markScrubbed(muid string, corrupt bool) error
+	removeOrphanFiles(muid string, removeFiles func() error) (bool, error)
+	dropMissingBlob(muid string, stillMissing func() (bool, error)) (bool, error)
+	setVariant(v Variant) error
+	getVariant(muid, suffix string) Variant
+	getVariants(muid string) []Variant
+	deleteVariant(muid, suffix string) error
+
+	// the job queue
+	runNextJob(run func(Job) error) bool
+	queueJobs(muid string, kinds []string) error
+	getJobError(muid string) string
+
+	// quotas and uploads in progress
+	getUsage(pubKey string) Usage
+	getQuota(pubKey string) Quota
+	createUpload(u Upload) error
+	getUpload(id, pubKey string) Upload
+	getPresignedUpload(id string) Upload
+	updateUploadReceived(id string, received int64, expires time.Time) error
+	finishUpload(id, muid string) error
+	claimUpload(id, muid string) error
+	deleteUpload(id string) error
+	getExpiredUploads() []Upload
+}
+
+type postgres struct {
 	db *gorm.DB
 }
 
@@ -35,59 +99,89 @@ func initDB() {
 	if err != nil {
 		panic(err)
 	}
-	DB.db = db
+	DB = postgres{db: db}
 	fmt.Println("db connected")
 }
 
-func (db database) getMyMedia(pubKey string) []Media {
+func (db postgres) getMyMedia(pubKey string) []Media {
 	ms := []Media{}
 	db.db.Where("owner_pub_key = ?", pubKey).Find(&ms)
 	return ms
 }
 
-func (db database) getMediaWithDimensions() []Media {
+func (db postgres) getMediaWithDimensions() []Media {
 	ms := []Media{}
 	db.db.Where("width > 0 and height > 0").Find(&ms)
 	return ms
 }
 
-func (db database) getAllMedia() []Media {
+func (db postgres) getAllMedia() []Media {
 	ms := []Media{}
 	db.db.Find(&ms)
 	return ms
 }
 
-func (db database) getTemplates() []Media {
+func (db postgres) getTemplates() []Media {
 	ms := []Media{}
-	db.db.Where("template = ?", true).Find(&ms)
+	db.db.Where("template = ? and (expiry is null or expiry > now())", true).Find(&ms)
 	return ms
 }
 
-func (db database) getMediaWithDimensionsByMuid(muid string) Media {
+// expired rows whose files are still in the store
+func (db postgres) getExpiredMedia(limit int) []Media {
+	ms := []Media{}
+	db.db.Where("expiry is not null and expiry <= now() and not purged").Limit(limit).Find(&ms)
+	return ms
+}
+
+func (db postgres) getMediaWithDimensionsByMuid(muid string) Media {
 	m := Media{}
-	db.db.Where("width > 0 and height > 0 and id = ?", muid).First(&m)
+	db.db.Where("width > 0 and height > 0 and id = ?", muid).Order(liveFirst).First(&m)
 	return m
 }
 
-func (db database) getTemplateByMuid(muid string) Media {
+func (db postgres) getTemplateByMuid(muid string) Media {
 	m := Media{}
-	db.db.Where("template = ? and id = ?", true, muid).First(&m)
+	db.db.Where("template = ? and id = ?", true, muid).Order(liveFirst).First(&m)
 	return m
 }
 
-func (db database) getMyMediaByMUID(pubKey, muid string) Media {
+func (db postgres) getMyMediaByMUID(pubKey, muid string) Media {
 	m := Media{}
 	db.db.Where("owner_pub_key = ? and id = ?", pubKey, muid).First(&m)
 	return m
 }
 
-func (db database) getMediaByMUID(muid string) Media {
+// with several owners of the same muid, live rows
+// come before expired ones, then the oldest first
+const liveFirst = "(expiry is not null and expiry <= now()), created"
+
+func (db postgres) getMediaByMUID(muid string) Media {
 	m := Media{}
-	db.db.Where("id = ?", muid).First(&m)
+	db.db.Where("id = ?", muid).Order(liveFirst).First(&m)
 	return m
 }
 
-func (db database) mediaPurchase(pubKey, muid string) Media {
+// every owner's row for a muid
+func (db postgres) getMediaOwners(muid string) []Media {
+	ms := []Media{}
+	db.db.Where("id = ?", muid).Order(liveFirst).Find(&ms)
+	return ms
+}
+
+func (db postgres) getBlob(muid string) Blob {
+	b := Blob{}
+	db.db.Where("id = ?", muid).First(&b)
+	return b
+}
+
+func (db postgres) getAllBlobs() []Blob {
+	bs := []Blob{}
+	db.db.Find(&bs)
+	return bs
+}
+
+func (db postgres) mediaPurchase(pubKey, muid string) Media {
 	if muid == "" {
 		return Media{}
 	}
@@ -101,7 +195,7 @@ func (db database) mediaPurchase(pubKey, muid string) Media {
 	return m // if unsuccessful will return empty Media
 }
 
-func (db database) updateMedia(muid string, u map[string]interface{}) bool {
+func (db postgres) updateMedia(muid string, u map[string]interface{}) bool {
 	if muid == "" {
 		return false
 	}
@@ -109,22 +203,193 @@ func (db database) updateMedia(muid string, u map[string]interface{}) bool {
 	return true
 }
 
-func (db database) getOwner(muid string) string {
+// releaseMedia drops one owner's reference to a blob. The row is deleted,
+// or kept as a tombstone when purging expired media. When it was the last
+// reference, removeFiles runs while the blob row is locked (so that no
+// upload can attach to it meanwhile) and the blob row goes as well
+func (db postgres) releaseMedia(muid, pubKey string, tombstone bool, removeFiles func() error) error {
+	if muid == "" || pubKey == "" {
+		return errors.New("no muid or pub key")
+	}
+	tx := db.db.Begin()
+	var locked string
+	tx.Raw("SELECT id FROM blobs WHERE id = ? FOR UPDATE", muid).Row().Scan(&locked)
+
+	var err error
+	if tombstone {
+		err = tx.Model(&Media{}).Where("id = ? and owner_pub_key = ?", muid, pubKey).Update("purged", true).Error
+	} else {
+		err = tx.Where("id = ? and owner_pub_key = ?", muid, pubKey).Delete(&Media{}).Error
+	}
+	if err == nil {
+		err = tx.Exec(recount, muid).Error
+	}
+	if err == nil && locked != "" {
+		var refcount int64
+		tx.Raw("SELECT refcount FROM blobs WHERE id = ?", muid).Row().Scan(&refcount)
+		if refcount == 0 {
+			err = removeFiles()
+			if err == nil {
+				err = tx.Where("id = ?", muid).Delete(&Blob{}).Error
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// setPhash sets the perceptual hash of all the rows with the muid
+func (db postgres) setPhash(muid string, phash int64, bands []int64) error {
+	return db.db.Exec("UPDATE media SET phash = ?, phash_bands = ? WHERE id = ?", phash, pq.Int64Array(bands), muid).Error
+}
+
+// similarMedia finds candidates by the bands of the phash among the
+// public media without a price, and keeps those at most distance bits
+// away, closest first
+func (db postgres) similarMedia(phash int64, bands []int64, distance int) []Similar {
+	ms := []Similar{}
+	db.db.Raw(`SELECT * FROM (
+		SELECT id, owner_pub_key, name, description, price, ttl, filename, mime, size, width, height, blurhash, palette,
+			length(replace(((phash # ?)::bit(64))::text, '0', '')) AS distance
+		FROM media
+		WHERE phash_bands && ?::int[] AND public AND price = 0 AND NOT purged AND (expiry IS NULL OR expiry > now())
+	) similar
+	WHERE distance <= ?
+	ORDER BY distance, id LIMIT 12;`, phash, pq.Int64Array(bands), distance).Find(&ms)
+	return ms
+}
+
+// setPreview sets the preview of all the rows with the muid
+func (db postgres) setPreview(muid, blurhash string, palette []string) error {
+	return db.db.Exec("UPDATE media SET blurhash = ?, palette = ? WHERE id = ?", blurhash, pq.StringArray(palette), muid).Error
+}
+
+// refcount is recomputed from the live rows rather than
+// incremented, so it can not drift
+const recount = `UPDATE blobs SET refcount =
+	(SELECT count(*) FROM media WHERE media.id = blobs.id AND NOT media.purged)
+	WHERE id = ?`
+
+// blobs from before the encryption layer get the marker of whatever
+// the backend did back then
+func (db postgres) resolveLegacyEncryption(encrypted bool) {
+	db.db.Exec("UPDATE blobs SET encrypted = ? WHERE encrypted IS NULL", encrypted)
+}
+
+func (db postgres) getUnencryptedBlobs() []Blob {
+	bs := []Blob{}
+	db.db.Where("not encrypted").Find(&bs)
+	return bs
+}
+
+// markEncrypted records that a blob's files are now
+// encrypted under the master key keyID
+func (db postgres) markEncrypted(muid, keyID string) error {
+	err := db.db.Model(&Blob{}).Where("id = ?", muid).Updates(map[string]interface{}{
+		"encrypted": true,
+		"key_id":    keyID,
+	}).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// markMigrated records that a blob's files are in target, encrypted
+// under keyID. The blob row itself still describes the active store
+func (db postgres) markMigrated(muid, target, keyID string) error {
+	err := db.db.Exec(`INSERT INTO blob_migrations (muid, target, key_id, migrated)
+	VALUES (?, ?, ?, now())
+	ON CONFLICT (muid, target) DO UPDATE SET key_id = EXCLUDED.key_id, migrated = now()`,
+		muid, target, keyID).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// cutoverMigration makes the blob rows describe target, once every
+// blob has been migrated there. It is the number of blobs not
+// migrated yet, with nothing changed, if there are any
+func (db postgres) cutoverMigration(target string) (int, error) {
+	tx := db.db.Begin()
+	missing := 0
+	err := tx.Raw(`SELECT count(*) FROM blobs WHERE NOT EXISTS
+	(SELECT 1 FROM blob_migrations m WHERE m.muid = blobs.id AND m.target = ?)`, target).Row().Scan(&missing)
+	if err != nil || missing > 0 {
+		tx.Rollback()
+		return missing, err
+	}
+	err = tx.Exec(`UPDATE blobs SET encrypted = true, key_id = m.key_id
+	FROM blob_migrations m WHERE m.muid = blobs.id AND m.target = ?`, target).Error
+	if err == nil {
+		err = tx.Exec("DELETE FROM blob_migrations WHERE target = ?", target).Error
+	}
+	if err != nil {
+		fmt.Println(err)
+		tx.Rollback()
+		return 0, err
+	}
+	return 0, tx.Commit().Error
+}
+
+// encrypted blobs under any other master key than keyID
+func (db postgres) getBlobsToRekey(keyID string, limit int) []Blob {
+	bs := []Blob{}
+	db.db.Where("encrypted and key_id <> ?", keyID).Order("created").Limit(limit).Find(&bs)
+	return bs
+}
+
+// rekeyBlob runs rekey with the blob row locked, so that its files can
+// not be deleted meanwhile, and then records the new key. Blobs that
+// are gone by the time the lock is taken are skipped
+func (db postgres) rekeyBlob(muid, keyID string, rekey func() error) error {
+	tx := db.db.Begin()
+	var locked string
+	tx.Raw("SELECT id FROM blobs WHERE id = ? FOR UPDATE", muid).Row().Scan(&locked)
+	if locked == "" {
+		tx.Rollback()
+		return nil
+	}
+	err := rekey()
+	if err == nil {
+		err = tx.Model(&Blob{}).Where("id = ?", muid).Update("key_id", keyID).Error
+	}
+	if err != nil {
+		fmt.Println(err)
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (db postgres) getOwner(muid string) string {
 	m := Media{}
 	db.db.Select("owner_pub_key").Where("id = ?", muid).First(&m)
 	return m.OwnerPubKey
 }
 
 var updatables = []string{
-	"name", "description", "price", "ttl", "tags", "nonce",
+	"name", "description", "price", "ttl", "tags", "expiry", "purged", "status", "metadata", "blurhash", "palette", "public",
 }
 
-// check that update owner_pub_key does in fact throw error
-func (db database) createMedia(m Media) (Media, error) {
+// createMedia attaches an owner's media row to the blob with its muid.
+// A new blob row is created with b's nonce, in which case moveIn is
+// called to put the staged file in place, under the row lock, and
+// moveOut to take it away again if the rest does not commit. Otherwise
+// the existing blob wins: its file and nonce stay as they are and the
+// caller drops the staged copy. The returned bool is true for a new blob.
+// An owner uploading the same bytes again updates their own row only.
+// jobs are queued in the same transaction, so they can not get lost
+func (db postgres) createMedia(m Media, b Blob, jobs []string, moveIn, moveOut func() error) (Media, Blob, bool, error) {
 	if m.OwnerPubKey == "" {
-		return Media{}, errors.New("no pub key")
+		return Media{}, Blob{}, false, errors.New("no pub key")
 	}
-	onConflict := "ON CONFLICT (id) DO UPDATE SET"
+	onConflict := "ON CONFLICT (id, owner_pub_key) DO UPDATE SET"
 	for i, u := range updatables {
 		onConflict = onConflict + fmt.Sprintf(" %s=EXCLUDED.%s", u, u)
 		if i < len(updatables)-1 {
@@ -140,29 +405,353 @@ func (db database) createMedia(m Media) (Media, error) {
 	if m.Tags == nil {
 		m.Tags = []string{}
 	}
-	if err := db.db.Set("gorm:insert_option", onConflict).Create(&m).Error; err != nil {
+	if m.Palette == nil {
+		m.Palette = []string{}
+	}
+	if m.PhashBands == nil {
+		m.PhashBands = []int64{}
+	}
+
+	tx := db.db.Begin()
+	// the no-op update locks an existing row and makes RETURNING
+	// give back its nonce, xmax is 0 only for a fresh insert
+	created, moved := false, false
+	err := tx.Raw(`INSERT INTO blobs (id, nonce, size, encrypted, key_id, refcount, created)
+	VALUES (?, ?, ?, ?, ?, 0, ?)
+	ON CONFLICT (id) DO UPDATE SET id = EXCLUDED.id
+	RETURNING nonce, encrypted, key_id, refcount, (xmax = 0)`,
+		b.ID, b.Nonce, b.Size, b.Encrypted, b.KeyID, b.Created,
+	).Row().Scan(&b.Nonce, &b.Encrypted, &b.KeyID, &b.Refcount, &created)
+	if err == nil && created {
+		err = moveIn()
+		moved = err == nil
+	}
+	if err == nil {
+		err = tx.Set("gorm:insert_option", onConflict).Create(&m).Error
+	}
+	if err == nil {
+		err = tx.Exec(recount, m.ID).Error
+	}
+	if err == nil {
+		err = enqueueJobs(tx, m.ID, jobs)
+	}
+	if err != nil {
 		fmt.Println(err)
-		return Media{}, err
+		// still under the row lock, so that the file can not be
+		// taken from under another upload of the same bytes
+		if moved {
+			moveOut()
+		}
+		tx.Rollback()
+		return Media{}, Blob{}, false, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		fmt.Println(err)
+		if moved {
+			moveOut()
+		}
+		return Media{}, Blob{}, false, err
+	}
+	if len(jobs) > 0 {
+		wakeJobs()
 	}
 	// not working?
 	db.db.Exec(`UPDATE media SET tsv =
   	setweight(to_tsvector(name), 'A') ||
 	setweight(to_tsvector(description), 'B') ||
 	setweight(array_to_tsvector(tags), 'C')
-	WHERE id = '` + m.ID + "'")
-	return m, nil
+	WHERE id = ? AND owner_pub_key = ?`, m.ID, m.OwnerPubKey)
+	return m, b, created, nil
+}
+
+// runNextJob claims the next due job by pushing its run_at past the
+// lease, and runs it with no transaction open. Then it deletes it or
+// schedules a retry, unless the lease ran out and another worker has
+// claimed it since. A job that found the image workers busy is put back
+// without using up an attempt. It is false when there was nothing to do
+func (db postgres) runNextJob(run func(Job) error) bool {
+	j := Job{}
+	var claimed time.Time
+	err := db.db.Raw(`UPDATE jobs SET run_at = now() + ? * interval '1 second'
+	WHERE id = (SELECT id FROM jobs
+		WHERE state = ? AND run_at <= now()
+		ORDER BY run_at LIMIT 1
+		FOR UPDATE SKIP LOCKED)
+	RETURNING id, kind, muid, attempts, run_at`, jobLease.Seconds(), jobQueued,
+	).Row().Scan(&j.ID, &j.Kind, &j.Muid, &j.Attempts, &claimed)
+	if err != nil {
+		return false
+	}
+
+	if runErr := run(j); runErr == nil {
+		err = db.db.Exec("DELETE FROM jobs WHERE id = ? AND run_at = ?", j.ID, claimed).Error
+	} else if isBusy(runErr) {
+		err = db.db.Exec(`UPDATE jobs SET run_at = now() + ? * interval '1 second' WHERE id = ? AND run_at = ?`,
+			jobBackoff.Seconds(), j.ID, claimed,
+		).Error
+	} else {
+		j.Attempts++
+		fmt.Println("job", j.ID, j.Kind, j.Muid, "attempt", j.Attempts, "failed:", runErr)
+		err = db.db.Exec(`UPDATE jobs SET state = ?, attempts = ?, last_error = ?,
+		run_at = now() + ? * interval '1 second' WHERE id = ? AND run_at = ?`,
+			failedState(j.Attempts, runErr), j.Attempts, runErr.Error(), jobDelay(j.Attempts).Seconds(), j.ID, claimed,
+		).Error
+	}
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	// settled after the job row, so that of two workers finishing
+	// jobs for the same muid the later one sees both
+	db.db.Exec(`UPDATE media SET status = CASE
+		WHEN EXISTS (SELECT 1 FROM jobs WHERE muid = ? AND state = ?) THEN ?
+		WHEN EXISTS (SELECT 1 FROM jobs WHERE muid = ? AND state = ?) THEN ?
+		ELSE ? END
+	WHERE id = ? AND status <> ?
+	AND NOT EXISTS (SELECT 1 FROM jobs WHERE muid = ? AND state = ?)`,
+		j.Muid, jobRejected, mediaRejected, j.Muid, jobFailed, mediaFailed, mediaReady,
+		j.Muid, mediaReady, j.Muid, jobQueued)
+	return true
+}
+
+// getJobError is why the jobs of a muid were given up on, if they were
+func (db postgres) getJobError(muid string) string {
+	reason := ""
+	db.db.Raw(`SELECT last_error FROM jobs WHERE muid = ? AND state IN (?, ?)
+	ORDER BY state DESC LIMIT 1`, muid, jobRejected, jobFailed).Row().Scan(&reason)
+	return reason
+}
+
+// live media rows that have no blob row at all
+func (db postgres) getMediaWithoutBlob() []Media {
+	ms := []Media{}
+	db.db.Where("not purged and not exists (select 1 from blobs where blobs.id = media.id)").Find(&ms)
+	return ms
+}
+
+func (db postgres) deleteMediaWithoutBlob(muid string) error {
+	err := db.db.Exec(`DELETE FROM media WHERE id = ? AND NOT purged
+	AND NOT EXISTS (SELECT 1 FROM blobs WHERE blobs.id = media.id)`, muid).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (db postgres) markScrubbed(muid string, corrupt bool) error {
+	err := db.db.Model(&Blob{}).Where("id = ?", muid).Updates(map[string]interface{}{
+		"corrupt":  corrupt,
+		"scrubbed": time.Now(),
+	}).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// removeOrphanFiles runs removeFiles if there is no blob row for muid.
+// It holds a placeholder row meanwhile, which an upload of the same
+// content waits on, so files that are just being moved in are never
+// taken for orphans. The bool is false if the blob turned out to exist
+func (db postgres) removeOrphanFiles(muid string, removeFiles func() error) (bool, error) {
+	tx := db.db.Begin()
+	// the placeholder is rolled back in any case
+	defer tx.Rollback()
+	var placeholder string
+	err := tx.Raw(`INSERT INTO blobs (id, refcount) VALUES (?, 0)
+	ON CONFLICT (id) DO NOTHING RETURNING id`, muid).Row().Scan(&placeholder)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, removeFiles()
+}
+
+// dropMissingBlob deletes a blob row and its media rows once
+// stillMissing confirms, with the row locked, that the file is gone
+func (db postgres) dropMissingBlob(muid string, stillMissing func() (bool, error)) (bool, error) {
+	tx := db.db.Begin()
+	var locked string
+	tx.Raw("SELECT id FROM blobs WHERE id = ? FOR UPDATE", muid).Row().Scan(&locked)
+	missing := false
+	var err error
+	if locked != "" {
+		missing, err = stillMissing()
+	}
+	if err == nil && missing {
+		err = tx.Where("id = ?", muid).Delete(&Media{}).Error
+	}
+	if err == nil && missing {
+		err = tx.Where("id = ?", muid).Delete(&Blob{}).Error
+	}
+	if err != nil || !missing {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit().Error
+}
+
+// setVariant records a variant, replacing what was recorded for a
+// variant made again. The row goes along with the blob's
+func (db postgres) setVariant(v Variant) error {
+	return db.db.Exec(`INSERT INTO variants (muid, suffix, mime, size, created)
+	VALUES (?, ?, ?, ?, now())
+	ON CONFLICT (muid, suffix) DO UPDATE SET mime = EXCLUDED.mime, size = EXCLUDED.size, created = EXCLUDED.created`,
+		v.Muid, v.Suffix, v.Mime, v.Size,
+	).Error
+}
+
+func (db postgres) getVariant(muid, suffix string) Variant {
+	v := Variant{}
+	db.db.Where("muid = ? AND suffix = ?", muid, suffix).First(&v)
+	return v
+}
+
+func (db postgres) getVariants(muid string) []Variant {
+	vs := []Variant{}
+	db.db.Where("muid = ?", muid).Find(&vs)
+	return vs
+}
+
+func (db postgres) deleteVariant(muid, suffix string) error {
+	return db.db.Exec("DELETE FROM variants WHERE muid = ? AND suffix = ?", muid, suffix).Error
+}
+
+// queueJobs queues jobs for a muid outside of an upload
+func (db postgres) queueJobs(muid string, kinds []string) error {
+	tx := db.db.Begin()
+	if err := enqueueJobs(tx, muid, kinds); err != nil {
+		fmt.Println(err)
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	wakeJobs()
+	return nil
+}
+
+// getUsage adds up an owner's live media. Rows deleted or
+// expired do not count, whether or not they are reaped yet.
+// Unfinished uploads that have not expired are reserved
+func (db postgres) getUsage(pubKey string) Usage {
+	u := Usage{}
+	db.db.Raw(`SELECT coalesce(sum(size), 0), count(*),
+	coalesce(sum(size) FILTER (WHERE created > now() - interval '1 day'), 0)
+	FROM media
+	WHERE owner_pub_key = ? AND NOT purged AND (expiry IS NULL OR expiry > now())`,
+		pubKey).Row().Scan(&u.Bytes, &u.Files, &u.BytesToday)
+	db.db.Raw(`SELECT coalesce(sum(length), 0), count(*) FROM uploads
+	WHERE owner_pub_key = ? AND coalesce(muid, '') = '' AND expires > now()`,
+		pubKey).Row().Scan(&u.Reserved, &u.Pending)
+	return u
+}
+
+func (db postgres) getQuota(pubKey string) Quota {
+	q := Quota{}
+	db.db.Where("owner_pub_key = ?", pubKey).First(&q)
+	return q
+}
+
+func (db postgres) createUpload(u Upload) error {
+	err := db.db.Create(&u).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (db postgres) getUpload(id, pubKey string) Upload {
+	u := Upload{}
+	if id == "" {
+		return u
+	}
+	db.db.Where("id = ? and owner_pub_key = ?", id, pubKey).First(&u)
+	return u
+}
+
+// getPresignedUpload is for the signed PUT, which
+// carries no JWT, so the upload is looked up by id alone
+func (db postgres) getPresignedUpload(id string) Upload {
+	u := Upload{}
+	if id == "" {
+		return u
+	}
+	db.db.Where("id = ? and via = ?", id, uploadViaPresign).First(&u)
+	return u
+}
+
+func (db postgres) updateUploadReceived(id string, received int64, expires time.Time) error {
+	err := db.db.Model(&Upload{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"received": received,
+		"expires":  expires,
+	}).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (db postgres) finishUpload(id, muid string) error {
+	err := db.db.Model(&Upload{}).Where("id = ?", id).Update("muid", muid).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// claimUpload records the muid a presigned upload is finalized with,
+// and queues its finalize job. An empty muid drops the claim and the
+// job, so that the upload can be finalized again
+func (db postgres) claimUpload(id, muid string) error {
+	tx := db.db.Begin()
+	err := tx.Model(&Upload{}).Where("id = ?", id).Update("claimed", muid).Error
+	if err == nil && muid != "" {
+		err = enqueueJobs(tx, id, []string{jobFinalize})
+	} else if err == nil {
+		err = tx.Exec("DELETE FROM jobs WHERE muid = ? AND kind = ?", id, jobFinalize).Error
+	}
+	if err != nil {
+		fmt.Println(err)
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	if muid != "" {
+		wakeJobs()
+	}
+	return nil
+}
+
+func (db postgres) deleteUpload(id string) error {
+	err := db.db.Where("id = ?", id).Delete(&Upload{}).Error
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (db postgres) getExpiredUploads() []Upload {
+	us := []Upload{}
+	db.db.Where("expires <= now()").Find(&us)
+	return us
 }
 
-func (db database) searchMedia(s string) []Media {
+func (db postgres) searchMedia(s string) []Media {
 	ms := []Media{}
 	if s == "" {
 		return ms
 	}
 	// set limit
 	db.db.Raw(
-		`SELECT id, owner_pub_key, name, description, price, ttl, filename, mime, size, ts_rank(tsv, q) as rank
+		`SELECT id, owner_pub_key, name, description, price, ttl, filename, mime, size, blurhash, palette, phash, phash_bands, ts_rank(tsv, q) as rank
 		FROM media, to_tsquery('` + s + `') q
-		WHERE tsv @@ q
+		WHERE tsv @@ q AND (expiry IS NULL OR expiry > now())
 		ORDER BY rank DESC LIMIT 12;`).Find(&ms)
 	return ms
 }
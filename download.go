@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// serveMedia writes a stored blob to the response. When the plaintext size
+// is known it goes through http.ServeContent, which answers Range,
+// If-Range and conditional requests by seeking the blob, so players can
+// seek and broken downloads can resume. A size of -1 (the derived
+// variants) streams the whole blob
+func serveMedia(w http.ResponseWriter, r *http.Request, path string, blob Blob, media Media, size int64) {
+	if media.ID == "" || blob.ID == "" {
+		fmt.Println("File not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	contentDisposition := fmt.Sprintf("attachment; filename=%s", media.Filename)
+	store := storage.Backend(blob.Encrypted, blob.KeyID)
+	nonce := blob.NonceBytes()
+
+	if size < 0 {
+		reader, err := store.GetReader(path, nonce)
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("File not found")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer reader.Close()
+
+		w.Header().Set("Content-Disposition", contentDisposition)
+		w.Header().Set("Content-Type", media.Mime)
+		io.Copy(w, reader)
+		return
+	}
+
+	reader := storage.NewReadSeeker(store, path, nonce, size)
+	defer reader.Close()
+
+	// the path is a content hash, so it makes a strong validator
+	// for If-Range and If-None-Match
+	modified := time.Time{}
+	if media.Created != nil {
+		modified = *media.Created
+	}
+	w.Header().Set("Content-Disposition", contentDisposition)
+	w.Header().Set("Content-Type", media.Mime)
+	w.Header().Set("ETag", `"`+path+`"`)
+	http.ServeContent(w, r, media.Filename, modified, reader)
+}
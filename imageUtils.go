@@ -69,7 +69,6 @@ func goTest() {
 		Size:        length,
 		Filename:    filename,
 		Mime:        contentType,
-		Nonce:       nonceString,
 		TTL:         int64(TTL),
 		Price:       0,
 		Created:     &now,
@@ -79,17 +78,27 @@ func goTest() {
 		Width:       imageWidth,
 		Height:      imageHeight,
 		Template:    true,
+		Status:      mediaReady,
 	}
 	fmt.Printf("MEDIA: %+v\n", media)
 
-	created, err := DB.createMedia(media)
+	blob := Blob{
+		ID:        media.ID,
+		Nonce:     nonceString,
+		Size:      length,
+		Encrypted: true,
+		KeyID:     storage.Encrypted.KeyID(),
+		Created:   &now,
+	}
+	created, _, _, err := DB.createMedia(media, blob, nil, func() error {
+		return storage.Store.PostReader(media.ID, &buf, length, contentType, nonce)
+	}, func() error {
+		return storage.Store.Delete(media.ID)
+	})
 	if err != nil {
 		fmt.Println("error", err)
 		return
 	}
 
-	path := media.ID
-	storage.Store.PostReader(path, &buf, length, contentType, nonce)
-
 	fmt.Println(created)
 }
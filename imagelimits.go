@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// images are untrusted: a small file can declare a size that takes
+// gigabytes to decode. Their headers are checked against the limits
+// below before they are decoded, and decoding runs on a pool of
+// IMAGE_WORKERS, so that only so many images are in memory at once
+
+// the most pixels an image, or all the frames of a GIF
+// together, can have. IMAGE_MAX_PIXELS overrides it
+const defaultMaxImagePixels = 40000000
+
+// the most frames a GIF can have. IMAGE_MAX_FRAMES overrides it
+const defaultMaxImageFrames = 500
+
+// how long image work can wait for a worker and run, in
+// seconds. IMAGE_TIMEOUT overrides it
+const defaultImageTimeout = 30
+
+// errImageLimit is an image that is too large to be processed.
+// Trying again does not help
+type errImageLimit struct {
+	message string
+}
+
+func (e errImageLimit) Error() string {
+	return e.message
+}
+
+func isImageLimit(err error) bool {
+	var e errImageLimit
+	return errors.As(err, &e)
+}
+
+var (
+	errImageBusy    = errors.New("Image processing is busy")
+	errImageTimeout = errors.New("Image processing timed out")
+)
+
+// imageErrorStatus is the response to an image that was not
+// processed because of the limits, if that is what err is
+func imageErrorStatus(err error) (int, bool) {
+	switch {
+	case isImageLimit(err):
+		return http.StatusRequestEntityTooLarge, true
+	case err == errImageBusy, err == errImageTimeout:
+		return http.StatusServiceUnavailable, true
+	}
+	return 0, false
+}
+
+func maxImagePixels() int {
+	if n, err := strconv.Atoi(os.Getenv("IMAGE_MAX_PIXELS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxImagePixels
+}
+
+func maxImageFrames() int {
+	if n, err := strconv.Atoi(os.Getenv("IMAGE_MAX_FRAMES")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxImageFrames
+}
+
+func imageTimeout() time.Duration {
+	secs := defaultImageTimeout
+	if n, err := strconv.Atoi(os.Getenv("IMAGE_TIMEOUT")); err == nil && n > 0 {
+		secs = n
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// checkImageSize is whether an image of w by h can be decoded
+func checkImageSize(w, h int) error {
+	if w <= 0 || h <= 0 {
+		return errImageLimit{fmt.Sprintf("Image is %dx%d", w, h)}
+	}
+	if int64(w)*int64(h) > int64(maxImagePixels()) {
+		return errImageLimit{fmt.Sprintf("Image is %dx%d, more than %d pixels", w, h, maxImagePixels())}
+	}
+	return nil
+}
+
+// checkImage reads the header of an image and checks its size. GIFs
+// have all their frames counted too, without decoding them
+func checkImage(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := checkImageSize(config.Width, config.Height); err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		return checkGif(data)
+	}
+	return nil
+}
+
+// checkImageHead checks the size of the image r reads, and returns
+// a reader that reads all of it again from the start
+func checkImageHead(r io.Reader) (io.Reader, image.Config, error) {
+	head := &bytes.Buffer{}
+	config, _, err := image.DecodeConfig(io.TeeReader(r, head))
+	replay := io.MultiReader(head, r)
+	if err != nil {
+		return replay, config, err
+	}
+	return replay, config, checkImageSize(config.Width, config.Height)
+}
+
+// checkGif walks the blocks of a GIF, counting its frames and their
+// pixels. What is not a well formed GIF is left for the decoder
+func checkGif(data []byte) error {
+	if len(data) < 13 {
+		return nil
+	}
+	at := 13
+	if data[10]&0x80 != 0 {
+		at += 3 << (data[10]&7 + 1)
+	}
+	// sub-blocks are a length byte and that many bytes, until a 0
+	skipSubBlocks := func() {
+		for at < len(data) && data[at] != 0 {
+			at += int(data[at]) + 1
+		}
+		at++
+	}
+	frames, pixels := 0, int64(0)
+	for at < len(data) {
+		switch data[at] {
+		case 0x21: // extension
+			at += 2
+			skipSubBlocks()
+		case 0x2C: // image
+			if at+10 > len(data) {
+				return nil
+			}
+			w := int(data[at+5]) | int(data[at+6])<<8
+			h := int(data[at+7]) | int(data[at+8])<<8
+			frames++
+			pixels += int64(w) * int64(h)
+			if frames > maxImageFrames() {
+				return errImageLimit{fmt.Sprintf("GIF has more than %d frames", maxImageFrames())}
+			}
+			if pixels > int64(maxImagePixels()) {
+				return errImageLimit{fmt.Sprintf("GIF frames have more than %d pixels", maxImagePixels())}
+			}
+			flags := data[at+9]
+			at += 10
+			if flags&0x80 != 0 {
+				at += 3 << (flags&7 + 1)
+			}
+			at++ // lzw code size
+			skipSubBlocks()
+		default: // the trailer, or not a gif
+			return nil
+		}
+	}
+	return nil
+}
+
+// the pool's free slots, IMAGE_WORKERS defaults to the number of CPUs
+var imageSlots struct {
+	once  sync.Once
+	slots chan struct{}
+}
+
+func imagePool() chan struct{} {
+	imageSlots.once.Do(func() {
+		workers := runtime.NumCPU()
+		if n, err := strconv.Atoi(os.Getenv("IMAGE_WORKERS")); err == nil && n > 0 {
+			workers = n
+		}
+		fmt.Println("image workers:", workers)
+		imageSlots.slots = make(chan struct{}, workers)
+	})
+	return imageSlots.slots
+}
+
+// acquireImageWorker takes a slot in the pool, waiting up to wait
+// for one. It is false if there was none
+func acquireImageWorker(wait time.Duration) bool {
+	if wait <= 0 {
+		select {
+		case imagePool() <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case imagePool() <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func releaseImageWorker() {
+	<-imagePool()
+}
+
+// runImageWork runs work on the pool, and gives up on it after the
+// timeout. work that is given up on keeps its slot until it is done,
+// so no more than the pool's worth of images are ever being decoded
+func runImageWork(work func() error) error {
+	timeout := imageTimeout()
+	start := time.Now()
+	if !acquireImageWorker(timeout) {
+		return errImageBusy
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer releaseImageWorker()
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- work()
+	}()
+	timer := time.NewTimer(timeout - time.Since(start))
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errImageTimeout
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+	"time"
+)
+
+// a png that claims to be width by height, with nothing in it
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // rgba
+	buf := &bytes.Buffer{}
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(buf, binary.BigEndian, uint32(13))
+	buf.Write(ihdr)
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+func gifOf(t *testing.T, frames int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Black, color.White}))
+		g.Delay = append(g.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckImage(t *testing.T) {
+	if err := checkImage(pngHeader(100000, 100000)); !isImageLimit(err) {
+		t.Errorf("bomb: %v", err)
+	}
+	if err := checkImage(pngOf(t, 20, 20)); err != nil {
+		t.Errorf("png: %v", err)
+	}
+	if _, _, err := checkImageHead(bytes.NewReader(pngHeader(100000, 100000))); !isImageLimit(err) {
+		t.Errorf("head: %v", err)
+	}
+	// the whole image can be read again after its header
+	r, config, err := checkImageHead(bytes.NewReader(pngOf(t, 20, 10)))
+	if err != nil || config.Width != 20 || config.Height != 10 {
+		t.Fatalf("head: %v %v", config, err)
+	}
+	if img, _, err := image.Decode(r); err != nil || img.Bounds().Dx() != 20 {
+		t.Errorf("after head: %v", err)
+	}
+
+	t.Setenv("IMAGE_MAX_PIXELS", "300")
+	if err := checkImage(pngOf(t, 20, 20)); !isImageLimit(err) {
+		t.Errorf("over IMAGE_MAX_PIXELS: %v", err)
+	}
+	// the frames of a gif add up
+	if err := checkImage(gifOf(t, 2)); err != nil {
+		t.Errorf("2 frames: %v", err)
+	}
+	if err := checkImage(gifOf(t, 4)); !isImageLimit(err) {
+		t.Errorf("4 frames: %v", err)
+	}
+
+	t.Setenv("IMAGE_MAX_PIXELS", "")
+	t.Setenv("IMAGE_MAX_FRAMES", "3")
+	if err := checkImage(gifOf(t, 3)); err != nil {
+		t.Errorf("3 frames: %v", err)
+	}
+	if err := checkImage(gifOf(t, 4)); !isImageLimit(err) {
+		t.Errorf("over IMAGE_MAX_FRAMES: %v", err)
+	}
+}
+
+func TestRunImageWork(t *testing.T) {
+	t.Setenv("IMAGE_TIMEOUT", "1")
+	if err := runImageWork(func() error { panic("decoder") }); err == nil {
+		t.Errorf("panic: %v", err)
+	}
+	failed := errors.New("failed")
+	if err := runImageWork(func() error { return failed }); err != failed {
+		t.Errorf("error: %v", err)
+	}
+
+	// work that takes too long is given up on, but keeps its slot
+	done := make(chan struct{})
+	if err := runImageWork(func() error { <-done; return nil }); err != errImageTimeout {
+		t.Errorf("timeout: %v", err)
+	}
+	slots := 0
+	for acquireImageWorker(0) {
+		slots++
+	}
+	if slots != cap(imagePool())-1 {
+		t.Errorf("%d free slots of %d", slots, cap(imagePool()))
+	}
+	start := time.Now()
+	if err := runImageWork(func() error { return nil }); err != errImageBusy || time.Since(start) < time.Second {
+		t.Errorf("busy: %v after %v", err, time.Since(start))
+	}
+	for i := 0; i < slots; i++ {
+		releaseImageWorker()
+	}
+	close(done)
+	if err := runImageWork(func() error { return nil }); err != nil {
+		t.Errorf("after: %v", err)
+	}
+}
+
+// jobs that waited for a worker are tried again for free, ones
+// that ran out of time are not tried again at all
+func TestImageJobErrors(t *testing.T) {
+	if !isBusy(errImageBusy) || isRejection(errImageBusy) {
+		t.Errorf("busy")
+	}
+	if isBusy(errImageTimeout) || !isRejection(errImageTimeout) {
+		t.Errorf("timeout")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// media status, while its derivatives are being made
+const (
+	mediaPending = "pending"
+	mediaReady   = "ready"
+	mediaFailed  = "failed"
+	// too large to process, see imagelimits.go
+	mediaRejected = "rejected"
+)
+
+// job kinds, each generating one derivative from the stored original.
+// Finalize jobs store presigned uploads instead, and carry the upload
+// id where the others have a muid
+const (
+	jobThumb    = "thumb"
+	jobMedium   = "medium"
+	jobPreview  = "preview"
+	jobFinalize = "finalize"
+)
+
+var jobKinds = map[string]func(string, [32]byte, io.ReadCloser) error{
+	jobThumb:   uploadThumb,
+	jobMedium:  uploadMediumSizePic,
+	jobPreview: savePreview,
+}
+
+// job states. done jobs are deleted, failed ones are kept for inspection
+// until the same content is uploaded again. Content that can not be
+// processed, see isRejection, is rejected without retries
+const (
+	jobQueued   = "queued"
+	jobFailed   = "failed"
+	jobRejected = "rejected"
+)
+
+// a job is retried with exponential backoff, starting at jobBackoff,
+// and given up after jobMaxAttempts. A claimed job is picked up again
+// once jobLease has gone by, in case its worker died
+const (
+	jobMaxAttempts = 6
+	jobBackoff     = 10 * time.Second
+	jobPoll        = 5 * time.Second
+	jobLease       = 10 * time.Minute
+)
+
+// jobsWake lets a worker pick up a new job right away
+// instead of on its next poll
+var jobsWake = make(chan struct{}, 1)
+
+func wakeJobs() {
+	select {
+	case jobsWake <- struct{}{}:
+	default:
+	}
+}
+
+// startJobs runs the job queue workers. Jobs live in postgres, so they
+// survive restarts, and a job that was running when the server died is
+// picked up again once its lease is up. JOB_WORKERS defaults to 2
+func startJobs() {
+	workers := 2
+	if n, err := strconv.Atoi(os.Getenv("JOB_WORKERS")); err == nil && n > 0 {
+		workers = n
+	}
+	fmt.Println("job workers:", workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				if DB.runNextJob(runJob) {
+					continue
+				}
+				select {
+				case <-jobsWake:
+				case <-time.After(jobPoll):
+				}
+			}
+		}()
+	}
+}
+
+// runJob generates one derivative. Jobs for content that has
+// been deleted meanwhile have nothing left to do. A panicking
+// decoder fails the job rather than the server
+func runJob(j Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if j.Kind == jobFinalize {
+		return finalizePresigned(j.Muid)
+	}
+	generate, ok := jobKinds[j.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %s", j.Kind)
+	}
+	blob := DB.getBlob(j.Muid)
+	if blob.ID == "" {
+		return nil
+	}
+	return runImageWork(func() error {
+		return fromStore(blob, generate)
+	})
+}
+
+// isRejection is whether a job failed on its content, which
+// trying again would not change. An image that takes longer than
+// IMAGE_TIMEOUT to process would only hold a worker again
+func isRejection(err error) bool {
+	return isImageLimit(err) || isMimeError(err) || storage.IsUnauthentic(err) ||
+		err == errUploadMismatch || err == errExpiryInPast || err == errImageTimeout || isQuotaError(err)
+}
+
+// isBusy is whether a job could not get an image worker in time,
+// which says nothing about the job, so it is not counted as an attempt
+func isBusy(err error) bool {
+	return err == errImageBusy
+}
+
+// failedState is what a job becomes after failing with err,
+// attempts counting this one
+func failedState(attempts int, err error) string {
+	if isRejection(err) {
+		return jobRejected
+	}
+	if attempts >= jobMaxAttempts {
+		return jobFailed
+	}
+	return jobQueued
+}
+
+// backoff before the given retry
+func jobDelay(attempts int) time.Duration {
+	if attempts > 10 {
+		attempts = 10
+	}
+	return jobBackoff << uint(attempts-1)
+}
+
+// enqueueJobs adds jobs for a muid within tx. An identical job that
+// is still queued is enough, and earlier failures are cleared so the
+// status reflects the new attempt
+func enqueueJobs(tx *gorm.DB, muid string, kinds []string) error {
+	for _, kind := range kinds {
+		err := tx.Exec("DELETE FROM jobs WHERE muid = ? AND kind = ? AND state IN (?, ?)", muid, kind, jobFailed, jobRejected).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec(`INSERT INTO jobs (kind, muid, state, attempts, run_at, created)
+		VALUES (?, ?, ?, 0, now(), now())
+		ON CONFLICT DO NOTHING`, kind, muid, jobQueued).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
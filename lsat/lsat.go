@@ -3,7 +3,6 @@ package lsat
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -22,6 +21,9 @@ const (
 	HeaderAuthorization = "Authorization"
 	ContextKey          = contextKey("MEME_LSAT_CAVEATS")
 	MaxUploadSizeContextKey = contextKey("MAX_UPLOAD_SIZE")
+	// MaxFileSizeContextKey holds the caveat's cap, in bytes, on the
+	// file part of a multipart upload
+	MaxFileSizeContextKey = contextKey("MAX_FILE_SIZE")
 )
 
 var (
@@ -132,35 +134,61 @@ func VerifyUploadContext(next http.Handler) http.Handler {
 		// this should always be run after the LsatContext middleware
 		caveats := GetLsatContextCaveats(r)
 
-		// check file size associated with the request to compare against lsat
-		// FormFile returns the first file for the given key `file`
-		// it also returns the FileHeader so we can get the Filename,
-		// the Header and the size of the file
-		_, handler, err := r.FormFile("file")
-		if err != nil {
-			fmt.Println("Error Retrieving the File")
-			fmt.Println(err)
-			// TODO: we may want to generalize this or modularize since
-			// not all LSATs will care about having a file
-			json.NewEncoder(w).Encode("Error Retrieving the File")
+		// creating a tus or presigned upload has no body, the size to check
+		// is the length of the upload to come
+		if length := r.Header.Get("Upload-Length"); length != "" {
+			size, err := strconv.ParseInt(length, 10, 64)
+			if err != nil || size < 0 {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			// TODO: figure out how to generalize and parameterize the
+			// satisfiers so they can be configurable such that different
+			// server hosts can setup their own LSAT requirements
+			if err := VerifyCaveats(caveats, NewUploadSatisfier(size)); err != nil {
+				fmt.Printf("Invalid caveats on lsat %s", err)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		// TODO: figure out how to generalize and parameterize the
-		// satisfiers so they can be configurable such that different
-		// server hosts can setup their own LSAT requirements
-		err = VerifyCaveats(caveats, NewUploadSatisfier(int64(handler.Size)))
-
-		if err != nil {
+		// a multipart body is not parsed here so that the upload handler
+		// can stream the file. Its content length counts the multipart
+		// framing too, so the caveats are only checked against each other
+		// here and the upload handler holds the file part itself to the cap
+		if err := VerifyCaveats(caveats, NewUploadSatisfier(0)); err != nil {
 			fmt.Printf("Invalid caveats on lsat %s", err)
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
+		if max, ok := maxFileSize(caveats); ok {
+			r = r.WithContext(context.WithValue(r.Context(), MaxFileSizeContextKey, max))
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// maxFileSize is the last, and so the tightest, upload size
+// caveat in bytes
+func maxFileSize(caveats []Caveat) (int64, bool) {
+	condition := MaxUploadCapability + CondMaxUploadConstraintSuffix
+	max, ok := int64(0), false
+	for _, caveat := range caveats {
+		if caveat.Condition != condition {
+			continue
+		}
+		val, err := strconv.ParseInt(caveat.Value, 10, 16)
+		if err != nil {
+			continue
+		}
+		max, ok = val<<20, true
+	}
+	return max, ok
+}
+
 // SetHeader sets the provided authentication elements as the default/standard
 // HTTP header for the LSAT protocol.
 // This function is pulled directly from aperture
@@ -107,19 +107,25 @@ func TestVerifyUploadContext(t *testing.T) {
 		{
 			"should accept requests if the file size is below caveat value",
 			[]string{"2"},
-			1,
+			1 << 20,
+			http.StatusOK,
+		},
+		{
+			"should accept requests if the file size is exactly the caveat value",
+			[]string{"2"},
+			2 << 20,
 			http.StatusOK,
 		},
 		{
 			"should reject requests if file size is larger than caveat value",
 			[]string{"32"},
-			33,
-			http.StatusUnauthorized,
+			32<<20 + 1,
+			http.StatusRequestEntityTooLarge,
 		},
 		{
 			"should reject requests if caveats are not of increasing restrictiveness",
 			[]string{"1", "2"},
-			1,
+			1 << 20,
 			http.StatusUnauthorized,
 		},
 	}
@@ -148,13 +154,25 @@ func TestVerifyUploadContext(t *testing.T) {
 			// verify the caveats from the context
 			r.Use(VerifyUploadContext)
 			// a nothing route that we can call to go through the relevant middleware
-			r.Post("/", func(w http.ResponseWriter, r *http.Request) {})
+			// a route that reads the file part under the cap, the way
+			// the upload handler does
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				file, _, err := r.FormFile("file")
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				max := r.Context().Value(MaxFileSizeContextKey).(int64)
+				if _, err := ioutil.ReadAll(http.MaxBytesReader(w, file, max)); err != nil {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+				}
+			})
 
 			// mocking file upload in the request
 			body := new(bytes.Buffer)
 			writer := multipart.NewWriter(body)
 			part, _ := writer.CreateFormFile("file", "file.png")
-			b := make([]byte, tt.fileSize * (1<<20)) // convert size to bytes
+			b := make([]byte, tt.fileSize)
 			part.Write(b)
 			writer.Close()
 
@@ -176,6 +194,32 @@ func TestVerifyUploadContext(t *testing.T) {
 	}
 }
 
+func TestVerifyUploadLength(t *testing.T) {
+	caveatCondition := MaxUploadCapability + CondMaxUploadConstraintSuffix
+	mac, _ := getMacaroon(caveatCondition, "2")
+
+	r := chi.NewRouter()
+	r.Use(LsatContext)
+	r.Use(VerifyUploadContext)
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	for length, want := range map[string]int{
+		fmt.Sprint(2 << 20):   http.StatusOK,
+		fmt.Sprint(2<<20 + 1): http.StatusUnauthorized,
+		"-1":                  http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Upload-Length", length)
+		secret, _ := lntypes.MakePreimageFromStr(preimage)
+		SetHeader(&req.Header, mac, secret)
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, req)
+		if recorder.Code != want {
+			t.Errorf("Upload-Length %s: got %d, want %d", length, recorder.Code, want)
+		}
+	}
+}
+
 func getMacaroon(condition string, value string) (mac *macaroon.Macaroon, rawCaveat string) {
 	// setup test caveat to make sure it gets added via middleware
 	mac = &macaroon.Macaroon{}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memDB is an in-memory database for the handler tests, with what the
+// handlers under test need. The rest panics, being the nil interface
+type memDB struct {
+	database
+
+	mu      sync.Mutex
+	media   map[[2]string]Media // by muid and owner
+	blobs   map[string]Blob
+	uploads map[string]Upload
+	// the queue of derivative jobs, which the tests run with
+	// runNextJob. Finalize jobs are not queued, the tests run them
+	// and fill in jobErrors themselves
+	jobs      []Job
+	nextJob   int64
+	jobErrors map[string]string
+	// blob_migrations, the key id by muid and target
+	migrations map[[2]string]string
+
+	// variants have their own lock, as they are
+	// looked up while releaseMedia holds mu
+	vmu      sync.Mutex
+	variants map[[2]string]Variant // by muid and suffix
+}
+
+func newMemDB() *memDB {
+	return &memDB{
+		media:      map[[2]string]Media{},
+		blobs:      map[string]Blob{},
+		uploads:    map[string]Upload{},
+		jobErrors:  map[string]string{},
+		migrations: map[[2]string]string{},
+		variants:   map[[2]string]Variant{},
+	}
+}
+
+func isLive(m Media) bool {
+	return !m.Purged && !isExpired(m)
+}
+
+// owners sorts like liveFirst, with mu held
+func (db *memDB) owners(muid string) []Media {
+	ms := []Media{}
+	for k, m := range db.media {
+		if k[0] == muid {
+			ms = append(ms, m)
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if isExpired(ms[i]) != isExpired(ms[j]) {
+			return !isExpired(ms[i])
+		}
+		return ms[i].Created.Before(*ms[j].Created)
+	})
+	return ms
+}
+
+func (db *memDB) recount(muid string) {
+	b, ok := db.blobs[muid]
+	if !ok {
+		return
+	}
+	b.Refcount = 0
+	for _, m := range db.owners(muid) {
+		if !m.Purged {
+			b.Refcount++
+		}
+	}
+	db.blobs[muid] = b
+}
+
+func (db *memDB) getMyMedia(pubKey string) []Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ms := []Media{}
+	for k, m := range db.media {
+		if k[1] == pubKey {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func (db *memDB) getMyMediaByMUID(pubKey, muid string) Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.media[[2]string{muid, pubKey}]
+}
+
+func (db *memDB) getMediaByMUID(muid string) Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, m := range db.owners(muid) {
+		return m
+	}
+	return Media{}
+}
+
+func (db *memDB) getMediaWithDimensionsByMuid(muid string) Media {
+	return db.getMediaByMUID(muid)
+}
+
+func (db *memDB) getMediaOwners(muid string) []Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.owners(muid)
+}
+
+func (db *memDB) getBlob(muid string) Blob {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.blobs[muid]
+}
+
+func (db *memDB) getAllBlobs() []Blob {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	bs := []Blob{}
+	for _, b := range db.blobs {
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].ID < bs[j].ID })
+	return bs
+}
+
+func (db *memDB) markMigrated(muid, target, keyID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.migrations[[2]string{muid, target}] = keyID
+	return nil
+}
+
+func (db *memDB) cutoverMigration(target string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	missing := 0
+	for id := range db.blobs {
+		if _, ok := db.migrations[[2]string{id, target}]; !ok {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return missing, nil
+	}
+	for id, b := range db.blobs {
+		b.Encrypted = true
+		b.KeyID = db.migrations[[2]string{id, target}]
+		db.blobs[id] = b
+		delete(db.migrations, [2]string{id, target})
+	}
+	return 0, nil
+}
+
+func (db *memDB) getMediaWithoutBlob() []Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ms := []Media{}
+	for _, m := range db.media {
+		if _, ok := db.blobs[m.ID]; !ok && !m.Purged {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func (db *memDB) markScrubbed(muid string, corrupt bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b, ok := db.blobs[muid]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	b.Corrupt = corrupt
+	b.Scrubbed = &now
+	db.blobs[muid] = b
+	return nil
+}
+
+func (db *memDB) mediaPurchase(pubKey, muid string) Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k := [2]string{muid, pubKey}
+	m, ok := db.media[k]
+	if !ok {
+		return Media{}
+	}
+	m.TotalBuys++
+	m.TotalSats += m.Price
+	db.media[k] = m
+	return Media{ID: m.ID, Price: m.Price, TTL: m.TTL}
+}
+
+// createMedia holds mu for the whole of it, like the
+// blob row lock of the postgres one
+func (db *memDB) createMedia(m Media, b Blob, jobs []string, moveIn, moveOut func() error) (Media, Blob, bool, error) {
+	if m.OwnerPubKey == "" {
+		return Media{}, Blob{}, false, errors.New("no pub key")
+	}
+	if m.Name == "" {
+		m.Name = "name"
+	}
+	if m.Description == "" {
+		m.Description = "description"
+	}
+	if m.Tags == nil {
+		m.Tags = []string{}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	existing, ok := db.blobs[m.ID]
+	if ok {
+		b = existing
+	} else {
+		if err := moveIn(); err != nil {
+			return Media{}, Blob{}, false, err
+		}
+		db.blobs[m.ID] = b
+	}
+	db.media[[2]string{m.ID, m.OwnerPubKey}] = m
+	db.recount(m.ID)
+	db.enqueue(m.ID, jobs)
+	return m, db.blobs[m.ID], !ok, nil
+}
+
+// enqueue is enqueueJobs, with mu held
+func (db *memDB) enqueue(muid string, kinds []string) {
+	now := time.Now()
+	for _, kind := range kinds {
+		queued := false
+		jobs := db.jobs[:0]
+		for _, j := range db.jobs {
+			if j.Muid == muid && j.Kind == kind {
+				if j.State != jobQueued {
+					continue
+				}
+				queued = true
+			}
+			jobs = append(jobs, j)
+		}
+		db.jobs = jobs
+		if !queued {
+			db.nextJob++
+			db.jobs = append(db.jobs, Job{ID: db.nextJob, Kind: kind, Muid: muid, State: jobQueued, RunAt: &now, Created: &now})
+		}
+	}
+}
+
+func (db *memDB) queueJobs(muid string, kinds []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.enqueue(muid, kinds)
+	return nil
+}
+
+// runNextJob follows the postgres one, without leases as
+// there is only ever the one test running the jobs
+func (db *memDB) runNextJob(run func(Job) error) bool {
+	db.mu.Lock()
+	next := -1
+	for i, j := range db.jobs {
+		if j.State == jobQueued && !j.RunAt.After(time.Now()) &&
+			(next < 0 || j.RunAt.Before(*db.jobs[next].RunAt)) {
+			next = i
+		}
+	}
+	if next < 0 {
+		db.mu.Unlock()
+		return false
+	}
+	j := db.jobs[next]
+	db.mu.Unlock()
+
+	runErr := run(j)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := range db.jobs {
+		if db.jobs[i].ID != j.ID {
+			continue
+		}
+		if runErr == nil {
+			db.jobs = append(db.jobs[:i], db.jobs[i+1:]...)
+			break
+		}
+		runAt := time.Now().Add(jobBackoff)
+		if !isBusy(runErr) {
+			j.Attempts++
+			j.State = failedState(j.Attempts, runErr)
+			j.LastError = runErr.Error()
+			runAt = time.Now().Add(jobDelay(j.Attempts))
+		}
+		j.RunAt = &runAt
+		db.jobs[i] = j
+		break
+	}
+
+	status := mediaReady
+	for _, other := range db.jobs {
+		if other.Muid != j.Muid {
+			continue
+		}
+		if other.State == jobQueued {
+			return true
+		}
+		if other.State == jobRejected {
+			status = mediaRejected
+		} else if other.State == jobFailed && status != mediaRejected {
+			status = mediaFailed
+		}
+	}
+	for k, m := range db.media {
+		if k[0] == j.Muid && m.Status != mediaReady {
+			m.Status = status
+			db.media[k] = m
+		}
+	}
+	return true
+}
+
+// dueJobs skips the backoff of the queued jobs
+func (db *memDB) dueJobs() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	for i := range db.jobs {
+		db.jobs[i].RunAt = &now
+	}
+}
+
+func (db *memDB) releaseMedia(muid, pubKey string, tombstone bool, removeFiles func() error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k := [2]string{muid, pubKey}
+	m, ok := db.media[k]
+	if !ok {
+		return nil
+	}
+	if tombstone {
+		m.Purged = true
+		db.media[k] = m
+	} else {
+		delete(db.media, k)
+	}
+	db.recount(muid)
+	if b, ok := db.blobs[muid]; ok && b.Refcount == 0 {
+		if err := removeFiles(); err != nil {
+			return err
+		}
+		delete(db.blobs, muid)
+		db.vmu.Lock()
+		for k := range db.variants {
+			if k[0] == muid {
+				delete(db.variants, k)
+			}
+		}
+		db.vmu.Unlock()
+	}
+	return nil
+}
+
+func (db *memDB) getUsage(pubKey string) Usage {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u := Usage{}
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	for k, m := range db.media {
+		if k[1] != pubKey || !isLive(m) {
+			continue
+		}
+		u.Files++
+		u.Bytes += m.Size
+		if m.Created != nil && m.Created.After(dayAgo) {
+			u.BytesToday += m.Size
+		}
+	}
+	for _, up := range db.uploads {
+		if up.OwnerPubKey == pubKey && up.Muid == "" && up.Expires != nil && up.Expires.After(time.Now()) {
+			u.Reserved += up.Length
+			u.Pending++
+		}
+	}
+	return u
+}
+
+func (db *memDB) getQuota(pubKey string) Quota {
+	return Quota{}
+}
+
+func (db *memDB) setVariant(v Variant) error {
+	if db.getBlob(v.Muid).ID == "" {
+		return errors.New("no blob")
+	}
+	db.vmu.Lock()
+	defer db.vmu.Unlock()
+	db.variants[[2]string{v.Muid, v.Suffix}] = v
+	return nil
+}
+
+func (db *memDB) getVariant(muid, suffix string) Variant {
+	db.vmu.Lock()
+	defer db.vmu.Unlock()
+	return db.variants[[2]string{muid, suffix}]
+}
+
+func (db *memDB) getVariants(muid string) []Variant {
+	db.vmu.Lock()
+	defer db.vmu.Unlock()
+	vs := []Variant{}
+	for k, v := range db.variants {
+		if k[0] == muid {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+func (db *memDB) setPreview(muid, blurhash string, palette []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for k, m := range db.media {
+		if k[0] == muid {
+			m.Blurhash = blurhash
+			m.Palette = palette
+			db.media[k] = m
+		}
+	}
+	return nil
+}
+
+func (db *memDB) setPhash(muid string, phash int64, bands []int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for k, m := range db.media {
+		if k[0] == muid {
+			m.Phash = phash
+			m.PhashBands = bands
+			db.media[k] = m
+		}
+	}
+	return nil
+}
+
+func (db *memDB) similarMedia(phash int64, bands []int64, distance int) []Similar {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ms := []Similar{}
+	for _, m := range db.media {
+		if m.Purged || !m.Public || m.Price != 0 || len(m.PhashBands) == 0 {
+			continue
+		}
+		if d := hamming(phash, m.Phash); d <= distance {
+			ms = append(ms, Similar{Media: m, Distance: d})
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Distance != ms[j].Distance {
+			return ms[i].Distance < ms[j].Distance
+		}
+		return ms[i].ID < ms[j].ID
+	})
+	return ms
+}
+
+// makeTemplate marks the media a template, as the
+// templates table is seeded outside the API
+func (db *memDB) makeTemplate(muid string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for k, m := range db.media {
+		if k[0] == muid {
+			m.Template = true
+			db.media[k] = m
+		}
+	}
+}
+
+// expire moves an owner's expiry into the past, which
+// an upload can not ask for
+func (db *memDB) expire(muid, pubKey string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k := [2]string{muid, pubKey}
+	m := db.media[k]
+	past := time.Now().Add(-time.Minute)
+	m.Expiry = &past
+	db.media[k] = m
+}
+
+func (db *memDB) getExpiredMedia(limit int) []Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ms := []Media{}
+	for _, m := range db.media {
+		if isExpired(m) && !m.Purged && len(ms) < limit {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func (db *memDB) getTemplateByMuid(muid string) Media {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, m := range db.owners(muid) {
+		if m.Template {
+			return m
+		}
+	}
+	return Media{}
+}
+
+func (db *memDB) createUpload(u Upload) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.uploads[u.ID] = u
+	return nil
+}
+
+func (db *memDB) getUpload(id, pubKey string) Upload {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if u := db.uploads[id]; u.OwnerPubKey == pubKey {
+		return u
+	}
+	return Upload{}
+}
+
+func (db *memDB) getPresignedUpload(id string) Upload {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if u := db.uploads[id]; u.Via == uploadViaPresign {
+		return u
+	}
+	return Upload{}
+}
+
+// setUpload changes an upload with mu held, if it is still there
+func (db *memDB) setUpload(id string, change func(u *Upload)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok := db.uploads[id]
+	if !ok {
+		return errors.New("no upload")
+	}
+	change(&u)
+	db.uploads[id] = u
+	return nil
+}
+
+func (db *memDB) updateUploadReceived(id string, received int64, expires time.Time) error {
+	return db.setUpload(id, func(u *Upload) {
+		u.Received = received
+		u.Expires = &expires
+	})
+}
+
+func (db *memDB) finishUpload(id, muid string) error {
+	return db.setUpload(id, func(u *Upload) { u.Muid = muid })
+}
+
+// claimUpload queues nothing, the tests run the finalize job
+func (db *memDB) claimUpload(id, muid string) error {
+	return db.setUpload(id, func(u *Upload) {
+		u.Claimed = muid
+		delete(db.jobErrors, id)
+	})
+}
+
+func (db *memDB) getJobError(muid string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if reason, ok := db.jobErrors[muid]; ok {
+		return reason
+	}
+	reason := ""
+	for _, j := range db.jobs {
+		if j.Muid != muid {
+			continue
+		}
+		if j.State == jobRejected {
+			return j.LastError
+		}
+		if j.State == jobFailed {
+			reason = j.LastError
+		}
+	}
+	return reason
+}
+
+// giveUp is the job queue giving up on a muid's jobs with err
+func (db *memDB) giveUp(muid string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.jobErrors[muid] = err.Error()
+}
+
+func (db *memDB) deleteUpload(id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.uploads, id)
+	return nil
+}
+
+func (db *memDB) getExpiredUploads() []Upload {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	us := []Upload{}
+	for _, u := range db.uploads {
+		if u.Expires != nil && !u.Expires.After(time.Now()) {
+			us = append(us, u)
+		}
+	}
+	return us
+}
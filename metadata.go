@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// photos carry EXIF, XMP and IPTC metadata: GPS coordinates, device
+// serials, the time they were taken. Uploads can have it stripped from
+// the stored original, which changes its muid. The EXIF orientation is
+// put back on its own, so that the stripped image still shows upright.
+// Pixel data is copied as it is, nothing is re-encoded
+
+// what was done to an upload's metadata, see Media.Metadata
+const (
+	metadataKept     = "kept"
+	metadataStripped = "stripped"
+)
+
+// whether each kind of upload is stripped, unless the upload says
+// otherwise. STRIP_METADATA_FILE, STRIP_METADATA_PUBLIC and
+// STRIP_METADATA_TEMPLATE override them
+var defaultStripMetadata = map[string]bool{
+	uploadKindFile:     false,
+	uploadKindPublic:   true,
+	uploadKindTemplate: true,
+}
+
+// at most this much of an eXIf chunk is read for the orientation
+const maxMetadataSegment = 1 << 16
+
+// the EXIF orientation tag
+const tagOrientation = 0x0112
+
+// wantsStripped is the upload's strip_metadata value, or the kind's default
+func wantsStripped(kind string, form url.Values) bool {
+	if strip, err := strconv.ParseBool(form.Get("strip_metadata")); err == nil {
+		return strip
+	}
+	if strip, err := strconv.ParseBool(os.Getenv("STRIP_METADATA_" + strings.ToUpper(kind))); err == nil {
+		return strip
+	}
+	return defaultStripMetadata[kind]
+}
+
+// a stripper copies an image from r to w without its metadata,
+// and returns its EXIF orientation, 0 if it has none
+type stripper func(r *bufio.Reader, w io.Writer) (int, error)
+
+func stripperFor(contentType string) stripper {
+	switch canonicalMime(essence(contentType)) {
+	case "image/jpeg":
+		return stripJPEG
+	case "image/png":
+		return stripPNG
+	case "image/gif":
+		return stripGIF
+	case "image/webp":
+		return stripWebP
+	}
+	return nil
+}
+
+// stripMetadata is src without its metadata, as it is being read.
+// Types that can not be stripped come back as they are, and false.
+// Closing it stops the stripping when not all of it was read
+func stripMetadata(src io.Reader, contentType string) (io.ReadCloser, bool) {
+	strip := stripperFor(contentType)
+	if strip == nil {
+		return ioutil.NopCloser(src), false
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		_, err := strip(bufio.NewReader(src), bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = errMime{fmt.Sprintf("Content is not a whole %s", essence(contentType))}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, true
+}
+
+// exifOrientation of an image in memory, 1 when it has none
+func exifOrientation(data []byte) int {
+	strip := stripperFor(http.DetectContentType(data))
+	if strip == nil {
+		return 1
+	}
+	o, _ := strip(bufio.NewReader(bytes.NewReader(data)), ioutil.Discard)
+	if o == 0 {
+		return 1
+	}
+	return o
+}
+
+// applyOrientation turns img upright. Orientations 5 to 8
+// are rotated a quarter turn, so they swap width and height
+func applyOrientation(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if o >= 5 {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch o {
+			case 2: // mirrored
+				dx = w - 1 - x
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				dy = h - 1 - y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // a quarter turn clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // a quarter turn anticlockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// tiffOrientation reads the orientation tag out of EXIF's TIFF
+// structure, optionally behind the "Exif\0\0" header. 0 if it has none
+func tiffOrientation(tiff []byte) int {
+	tiff = bytes.TrimPrefix(tiff, []byte("Exif\x00\x00"))
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd+2 > int64(len(tiff)) {
+		return 0
+	}
+	n := int64(order.Uint16(tiff[ifd:]))
+	for i := int64(0); i < n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > int64(len(tiff)) {
+			break
+		}
+		// a SHORT, left-justified in the value field
+		if order.Uint16(tiff[e:]) == tagOrientation && order.Uint16(tiff[e+2:]) == 3 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 0
+}
+
+// orientationTIFF is EXIF with nothing but the orientation
+func orientationTIFF(o int) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1}
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry, tagOrientation)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], uint16(o))
+	tiff = append(tiff, entry...)
+	return append(tiff, 0, 0, 0, 0) // no next IFD
+}
+
+func notA(t string) error {
+	return errMime{fmt.Sprintf("Content is not a well-formed %s", t)}
+}
+
+// stripJPEG keeps the JFIF and Adobe segments and the ICC profile, and
+// drops the other APPn segments and comments. Whatever follows the end
+// of the image goes too, it is where phones put extra pictures (with
+// their own EXIF) for the MPF segment that is dropped along with them
+func stripJPEG(r *bufio.Reader, w io.Writer) (int, error) {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		return 0, err
+	}
+	if soi[0] != 0xFF || soi[1] != 0xD8 {
+		return 0, notA("image/jpeg")
+	}
+	w.Write(soi)
+	orientation := 0
+	orientationDone := false
+	for {
+		marker, err := jpegMarker(r)
+		if err != nil {
+			return orientation, err
+		}
+		if marker == 0xD9 { // the end, without an image
+			_, err := w.Write([]byte{0xFF, marker})
+			return orientation, err
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { // no length
+			w.Write([]byte{0xFF, marker})
+			continue
+		}
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return orientation, err
+		}
+		length := int64(binary.BigEndian.Uint16(head)) - 2
+		if length < 0 {
+			return orientation, notA("image/jpeg")
+		}
+
+		if (marker >= 0xE0 && marker <= 0xEF) || marker == 0xFE {
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return orientation, err
+			}
+			if marker == 0xE1 && orientation == 0 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				orientation = tiffOrientation(payload)
+			}
+			keep := marker == 0xE0 || marker == 0xEE ||
+				(marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")))
+			if keep {
+				w.Write([]byte{0xFF, marker})
+				w.Write(head)
+				w.Write(payload)
+			}
+			continue
+		}
+
+		// the metadata segments come first, the orientation
+		// goes back in once they have all gone by
+		if !orientationDone {
+			orientationDone = true
+			if orientation > 1 {
+				exif := append([]byte("Exif\x00\x00"), orientationTIFF(orientation)...)
+				seg := []byte{0xFF, 0xE1, 0, 0}
+				binary.BigEndian.PutUint16(seg[2:], uint16(len(exif)+2))
+				w.Write(seg)
+				w.Write(exif)
+			}
+		}
+		w.Write([]byte{0xFF, marker})
+		w.Write(head)
+		if _, err := io.CopyN(w, r, length); err != nil {
+			return orientation, err
+		}
+		if marker == 0xDA { // start of scan
+			return orientation, copyToEOI(r, w)
+		}
+	}
+}
+
+// jpegMarker skips to the next marker, past any fill bytes
+func jpegMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, notA("image/jpeg")
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// copyToEOI copies the scans, in which 0xFF 0xD9 can only be the end
+// of the image (a 0xFF in the data is followed by a 0)
+func copyToEOI(r *bufio.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	previous := byte(0)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		bw.WriteByte(b)
+		if previous == 0xFF && b == 0xD9 {
+			return bw.Flush()
+		}
+		previous = b
+	}
+}
+
+// PNG chunks that carry metadata
+var pngMetadata = map[string]bool{
+	"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+}
+
+// stripPNG drops the EXIF, text (XMP is an iTXt) and time chunks
+func stripPNG(r *bufio.Reader, w io.Writer) (int, error) {
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return 0, err
+	}
+	if string(signature) != "\x89PNG\r\n\x1a\n" {
+		return 0, notA("image/png")
+	}
+	w.Write(signature)
+	orientation := 0
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return orientation, err
+		}
+		length := int64(binary.BigEndian.Uint32(head))
+		kind := string(head[4:])
+		if !pngMetadata[kind] {
+			w.Write(head)
+			if _, err := io.CopyN(w, r, length+4); err != nil { // and the crc
+				return orientation, err
+			}
+			if kind == "IEND" {
+				return orientation, nil
+			}
+			continue
+		}
+		if kind != "eXIf" || orientation != 0 {
+			if _, err := io.CopyN(ioutil.Discard, r, length+4); err != nil {
+				return orientation, err
+			}
+			continue
+		}
+		exif, err := ioutil.ReadAll(io.LimitReader(r, min64(length, maxMetadataSegment)))
+		if err != nil {
+			return orientation, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, length-int64(len(exif))+4); err != nil {
+			return orientation, err
+		}
+		if orientation = tiffOrientation(exif); orientation > 1 {
+			w.Write(pngChunk("eXIf", orientationTIFF(orientation)))
+		}
+	}
+}
+
+func pngChunk(kind string, data []byte) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// stripGIF drops comments and the XMP application extension
+func stripGIF(r *bufio.Reader, w io.Writer) (int, error) {
+	header := make([]byte, 13) // and the logical screen descriptor
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(header, []byte("GIF87a")) && !bytes.HasPrefix(header, []byte("GIF89a")) {
+		return 0, notA("image/gif")
+	}
+	w.Write(header)
+	if err := copyColorTable(r, w, header[10]); err != nil {
+		return 0, err
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case 0x21: // extension
+			label, err := r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if label == 0xFE { // comment
+				if err := copySubBlocks(r, ioutil.Discard); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			if label == 0xFF {
+				// the application identifier is the first sub-block
+				app, err := r.Peek(12)
+				if err != nil {
+					return 0, err
+				}
+				if string(app) == "\x0bXMP DataXMP" {
+					if err := copySubBlocks(r, ioutil.Discard); err != nil {
+						return 0, err
+					}
+					continue
+				}
+			}
+			w.Write([]byte{b, label})
+			if err := copySubBlocks(r, w); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return 0, err
+			}
+			w.Write([]byte{b})
+			w.Write(descriptor)
+			if err := copyColorTable(r, w, descriptor[8]); err != nil {
+				return 0, err
+			}
+			codeSize, err := r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			w.Write([]byte{codeSize})
+			if err := copySubBlocks(r, w); err != nil {
+				return 0, err
+			}
+		case 0x3B: // trailer
+			_, err := w.Write([]byte{b})
+			return 0, err
+		default:
+			return 0, notA("image/gif")
+		}
+	}
+}
+
+func copyColorTable(r io.Reader, w io.Writer, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := io.CopyN(w, r, 3<<((flags&7)+1))
+	return err
+}
+
+func copySubBlocks(r *bufio.Reader, w io.Writer) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{size}); err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(w, r, int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// stripWebP drops the EXIF and XMP chunks. The RIFF header has the
+// size of the whole file, so it is held in memory to be rewritten
+func stripWebP(r *bufio.Reader, w io.Writer) (int, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, notA("image/webp")
+	}
+	// only the extended format has metadata
+	if len(data) < 30 || string(data[12:16]) != "VP8X" {
+		_, err := w.Write(data)
+		return 0, err
+	}
+	out := append([]byte{}, data[:12]...)
+	orientation := 0
+	for at := 12; at < len(data); {
+		if at+8 > len(data) {
+			return orientation, notA("image/webp")
+		}
+		kind := string(data[at : at+4])
+		size := int(binary.LittleEndian.Uint32(data[at+4:]))
+		end := at + 8 + size + size%2 // chunks are padded to even
+		if size < 0 || end > len(data) {
+			return orientation, notA("image/webp")
+		}
+		switch kind {
+		case "EXIF":
+			if orientation == 0 {
+				orientation = tiffOrientation(data[at+8 : at+8+size])
+			}
+		case "XMP ":
+		default:
+			out = append(out, data[at:end]...)
+		}
+		at = end
+	}
+	// EXIF goes after the image data
+	flags := out[20] &^ 0x0C
+	if orientation > 1 {
+		exif := orientationTIFF(orientation)
+		chunk := make([]byte, 8)
+		copy(chunk, "EXIF")
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(len(exif)))
+		out = append(append(out, chunk...), exif...)
+		flags |= 0x08
+	}
+	out[20] = flags
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	_, err = w.Write(out)
+	return orientation, err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+const secret = "GPS 52.37N 4.89E serial 0xC0FFEE"
+
+func strip(t *testing.T, contents []byte, contentType string) []byte {
+	stripped, ok := stripMetadata(bytes.NewReader(contents), contentType)
+	defer stripped.Close()
+	if !ok {
+		t.Fatalf("%s is not stripped", contentType)
+	}
+	got, err := ioutil.ReadAll(stripped)
+	if err != nil {
+		t.Fatalf("%s: %v", contentType, err)
+	}
+	if bytes.Contains(got, []byte(secret)) {
+		t.Errorf("%s: metadata is still there", contentType)
+	}
+	return got
+}
+
+// exifWith is EXIF with an orientation and something to hide
+func exifWith(orientation int) []byte {
+	tiff := orientationTIFF(orientation)
+	return append(tiff, secret...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	buf := &bytes.Buffer{}
+	jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 4)), nil)
+	plain := buf.Bytes()
+
+	photo := append([]byte{}, plain[:2]...)
+	photo = append(photo, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifWith(6)...))...)
+	photo = append(photo, jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+secret))...)
+	photo = append(photo, jpegSegment(0xED, []byte("Photoshop 3.0\x00"+secret))...)
+	photo = append(photo, jpegSegment(0xFE, []byte(secret))...)
+	photo = append(photo, jpegSegment(0xE2, []byte("ICC_PROFILE\x00profile"))...)
+	photo = append(photo, plain[2:]...)
+	photo = append(photo, []byte("another picture, "+secret)...)
+
+	got := strip(t, photo, "image/jpeg")
+	if !bytes.Contains(got, []byte("ICC_PROFILE\x00profile")) {
+		t.Errorf("icc profile dropped")
+	}
+	if o := exifOrientation(got); o != 6 {
+		t.Errorf("orientation %d", o)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(got))
+	if err != nil || img.Bounds().Dx() != 8 {
+		t.Errorf("decode: %v", err)
+	}
+
+	// without metadata it is stored as it was
+	if got := strip(t, plain, "image/jpeg"); !bytes.Equal(got, plain) {
+		t.Errorf("plain jpeg changed")
+	}
+
+	stripped, _ := stripMetadata(bytes.NewReader(plain[:len(plain)/2]), "image/jpeg")
+	if _, err := ioutil.ReadAll(stripped); !isMimeError(err) {
+		t.Errorf("truncated: %v", err)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, 3, 5)))
+	plain := buf.Bytes()
+
+	// after the IHDR
+	photo := append([]byte{}, plain[:33]...)
+	photo = append(photo, pngChunk("eXIf", exifWith(3))...)
+	photo = append(photo, pngChunk("tEXt", []byte("Comment\x00"+secret))...)
+	photo = append(photo, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+secret))...)
+	photo = append(photo, plain[33:]...)
+
+	got := strip(t, photo, "image/png")
+	if o := exifOrientation(got); o != 3 {
+		t.Errorf("orientation %d", o)
+	}
+	if _, err := png.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("decode: %v", err)
+	}
+}
+
+func TestStripGIF(t *testing.T) {
+	buf := &bytes.Buffer{}
+	frame := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, color.White})
+	gif.EncodeAll(buf, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{5, 5}})
+	plain := buf.Bytes()
+
+	// after the header and the global color table, if any
+	at := 13
+	if plain[10]&0x80 != 0 {
+		at += 3 << ((plain[10] & 7) + 1)
+	}
+	xmp := append([]byte{0x21, 0xFF, 11}, "XMP DataXMP"...)
+	xmp = append(xmp, byte(len(secret)))
+	xmp = append(xmp, secret...)
+	xmp = append(xmp, 0)
+	comment := append([]byte{0x21, 0xFE, byte(len(secret))}, secret...)
+	comment = append(comment, 0)
+	photo := append(append(append([]byte{}, plain[:at]...), xmp...), comment...)
+	photo = append(photo, plain[at:]...)
+
+	got := strip(t, photo, "image/gif")
+	if !bytes.Equal(got, plain) {
+		t.Errorf("stripped gif is not the plain one")
+	}
+	if g, err := gif.DecodeAll(bytes.NewReader(got)); err != nil || len(g.Image) != 2 {
+		t.Errorf("decode: %v", err)
+	}
+}
+
+func webpChunk(kind string, payload []byte) []byte {
+	chunk := append([]byte(kind), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	file := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(file[4:], uint32(len(body)))
+	return append(file, body...)
+}
+
+func TestStripWebP(t *testing.T) {
+	// the image data is not looked at, only the chunks around it
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x0C // has EXIF and XMP
+	photo := riff(
+		webpChunk("VP8X", vp8x),
+		webpChunk("VP8L", []byte("image data")),
+		webpChunk("EXIF", append([]byte("Exif\x00\x00"), exifWith(8)...)),
+		webpChunk("XMP ", []byte(secret)),
+	)
+
+	got := strip(t, photo, "image/webp")
+	vp8x[0] = 0x08 // the orientation is kept
+	want := riff(
+		webpChunk("VP8X", vp8x),
+		webpChunk("VP8L", []byte("image data")),
+		webpChunk("EXIF", orientationTIFF(8)),
+	)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+	if o, _ := stripWebP(bufio.NewReader(bytes.NewReader(got)), ioutil.Discard); o != 8 {
+		t.Errorf("orientation %d", o)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 3 wide, 2 high, the top left corner marked
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.White)
+	for o, corner := range map[int]image.Point{
+		1: {0, 0}, 2: {2, 0}, 3: {2, 1}, 4: {0, 1},
+		5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2},
+	} {
+		got := applyOrientation(img, o)
+		size := got.Bounds().Size()
+		if (o >= 5) != (size == image.Point{2, 3}) {
+			t.Errorf("%d: size %v", o, size)
+		}
+		if r, _, _, _ := got.At(corner.X, corner.Y).RGBA(); r == 0 {
+			t.Errorf("%d: corner not at %v", o, corner)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// uploads are sniffed rather than taken at their word: the first bytes
+// decide the type, and a declared type that they contradict is turned
+// away. The type that is stored (and sent back on download) is the
+// verified one, under the sniffer's name and without parameters. A type
+// the sniffer can not recognize is taken at its word when the kind's
+// allowed types take it, by name, by wildcard or with "*"
+
+// the sniffer only looks this far, see http.DetectContentType
+const sniffLen = 512
+
+// what each kind of upload may be, as a comma separated list of types
+// or "image/*" style wildcards. ALLOWED_TYPES_FILE, ALLOWED_TYPES_PUBLIC
+// and ALLOWED_TYPES_TEMPLATE override them
+var defaultAllowedTypes = map[string]string{
+	uploadKindFile:     "*",
+	uploadKindPublic:   "image/png,image/jpeg,image/gif,image/webp",
+	uploadKindTemplate: "image/png,image/jpeg",
+}
+
+// declared types that are another name for what the sniffer says
+var mimeAliases = map[string]string{
+	"image/jpg":                "image/jpeg",
+	"image/pjpeg":              "image/jpeg",
+	"image/vnd.microsoft.icon": "image/x-icon",
+	"audio/mp3":                "audio/mpeg",
+	"audio/wav":                "audio/wave",
+	"audio/x-wav":              "audio/wave",
+	"audio/mp4":                "video/mp4",
+	"audio/m4a":                "video/mp4",
+	"audio/x-m4a":              "video/mp4",
+	"audio/ogg":                "application/ogg",
+	"video/ogg":                "application/ogg",
+	"audio/webm":               "video/webm",
+	"application/gzip":         "application/x-gzip",
+	"image/svg+xml":            "text/xml",
+}
+
+// types the sniffer recognizes: declaring one of these, the
+// content has to be recognized as it too
+var sniffable = map[string]bool{
+	"image/bmp": true, "image/gif": true, "image/jpeg": true, "image/png": true,
+	"image/webp": true, "image/x-icon": true,
+	"audio/aiff": true, "audio/basic": true, "audio/midi": true, "audio/mpeg": true, "audio/wave": true,
+	"video/avi": true, "video/mp4": true, "video/webm": true, "application/ogg": true,
+	"application/pdf": true, "application/postscript": true, "application/zip": true,
+	"application/x-gzip": true, "application/x-rar-compressed": true, "application/wasm": true,
+	"text/html": true,
+}
+
+// errMime is a type that does not match the content, or is not allowed
+type errMime struct {
+	message string
+}
+
+func (e errMime) Error() string {
+	return e.message
+}
+
+func isMimeError(err error) bool {
+	var e errMime
+	return errors.As(err, &e)
+}
+
+// essence is the lowercase type without parameters, "" if it is not one
+func essence(t string) string {
+	mt, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+func canonicalMime(t string) string {
+	if alias, ok := mimeAliases[t]; ok {
+		return alias
+	}
+	return t
+}
+
+// isGeneric is a sniffed type that only says it is text or binary
+func isGeneric(sniffed string) bool {
+	e := essence(sniffed)
+	return e == "application/octet-stream" || e == "text/plain"
+}
+
+// reconcileMime is the type to store for content of a kind of upload
+// that sniffed as sniffed and was declared as declared
+func reconcileMime(declared, sniffed, kind string) (string, error) {
+	d := essence(declared)
+	verified := canonicalMime(essence(sniffed))
+	if d == "" || d == "application/octet-stream" || canonicalMime(d) == verified {
+		return verified, nil
+	}
+	if isGeneric(sniffed) {
+		if sniffable[canonicalMime(d)] {
+			return "", errMime{fmt.Sprintf("Content is not %s", d)}
+		}
+		if !typeAllowed(kind, d) {
+			return "", errMime{fmt.Sprintf("%s is not allowed for %s uploads", d, kind)}
+		}
+		return canonicalMime(d), nil
+	}
+	return "", errMime{fmt.Sprintf("Content is %s, not %s", essence(sniffed), d)}
+}
+
+func allowedTypes(kind string) []string {
+	list := os.Getenv("ALLOWED_TYPES_" + strings.ToUpper(kind))
+	if list == "" {
+		list = defaultAllowedTypes[kind]
+	}
+	types := []string{}
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// checkAllowed is an error unless t is one of the kind's types
+func checkAllowed(kind, t string) error {
+	if typeAllowed(kind, t) {
+		return nil
+	}
+	e := essence(t)
+	if e == "" {
+		e = t
+	}
+	return errMime{fmt.Sprintf("%s is not allowed for %s uploads", e, kind)}
+}
+
+// typeAllowed matches the essence of t against the kind's list, under
+// its own name or the one the sniffer knows it by
+func typeAllowed(kind, t string) bool {
+	e := essence(t)
+	for _, allowed := range allowedTypes(kind) {
+		if allowed == "*" {
+			return true
+		}
+		for _, name := range []string{e, canonicalMime(e)} {
+			if canonicalMime(allowed) == name {
+				return true
+			}
+			if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(name, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sniffUpload reads the start of src to find out what it is. The
+// returned reader still has everything, the bytes read are buffered
+func sniffUpload(src io.Reader, declared, kind string) (io.Reader, string, error) {
+	br := bufio.NewReaderSize(src, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	verified, err := reconcileMime(declared, http.DetectContentType(head), kind)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkAllowed(kind, verified); err != nil {
+		return nil, "", err
+	}
+	return br, verified, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReconcileMime(t *testing.T) {
+	t.Setenv("ALLOWED_TYPES_FILE", "")
+	cases := []struct {
+		declared, sniffed, want string
+	}{
+		{"", "image/png", "image/png"},
+		{"application/octet-stream", "text/plain; charset=utf-8", "text/plain"},
+		{"text/plain", "text/plain; charset=utf-8", "text/plain"},
+		{"image/png", "image/png", "image/png"},
+		{"image/jpg", "image/jpeg", "image/jpeg"},
+		{"audio/x-m4a", "video/mp4", "video/mp4"},
+		{"application/json; charset=utf-8", "text/plain; charset=utf-8", "application/json"},
+		{"image/heic", "application/octet-stream", "image/heic"},
+		{"video/quicktime", "application/octet-stream", "video/quicktime"},
+		{"application/xhtml+xml", "text/plain; charset=utf-8", "application/xhtml+xml"},
+		{"image/png", "text/plain; charset=utf-8", ""},
+		{"text/html", "text/plain; charset=utf-8", ""},
+		{"image/gif", "image/png", ""},
+		{"text/plain", "text/html; charset=utf-8", ""},
+	}
+	for _, c := range cases {
+		got, err := reconcileMime(c.declared, c.sniffed, uploadKindFile)
+		if c.want == "" {
+			if !isMimeError(err) {
+				t.Errorf("%s as %s: %s, want a mismatch", c.sniffed, c.declared, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s as %s: %s %v, want %s", c.sniffed, c.declared, got, err, c.want)
+		}
+	}
+
+	// a kind without "*" only takes the unverified types it names
+	t.Setenv("ALLOWED_TYPES_FILE", "application/json,image/*")
+	if got, err := reconcileMime("image/heic", "application/octet-stream", uploadKindFile); err != nil || got != "image/heic" {
+		t.Errorf("named by wildcard: %s %v", got, err)
+	}
+	if _, err := reconcileMime("text/csv", "text/plain; charset=utf-8", uploadKindFile); !isMimeError(err) {
+		t.Errorf("not named: %v", err)
+	}
+}
+
+func TestCheckAllowed(t *testing.T) {
+	t.Setenv("ALLOWED_TYPES_FILE", "")
+	t.Setenv("ALLOWED_TYPES_PUBLIC", "")
+	t.Setenv("ALLOWED_TYPES_TEMPLATE", "")
+	cases := []struct {
+		kind, mime string
+		allowed    bool
+	}{
+		{uploadKindFile, "application/zip", true},
+		{uploadKindPublic, "image/webp", true},
+		{uploadKindPublic, "image/svg+xml", false},
+		{uploadKindPublic, "video/mp4", false},
+		{uploadKindTemplate, "image/jpg", true},
+		{uploadKindTemplate, "image/gif", false},
+	}
+	for _, c := range cases {
+		if err := checkAllowed(c.kind, c.mime); (err == nil) != c.allowed {
+			t.Errorf("%s %s: %v", c.kind, c.mime, err)
+		}
+	}
+
+	t.Setenv("ALLOWED_TYPES_PUBLIC", "image/*, audio/mpeg")
+	if checkAllowed(uploadKindPublic, "image/svg+xml") != nil || checkAllowed(uploadKindPublic, "audio/mp3") != nil {
+		t.Errorf("wildcard or alias not allowed")
+	}
+}
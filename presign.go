@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/stakwork/sphinx-meme/auth"
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// presigned uploads let a client put a large file straight into the
+// store, with a short lived url from aws3store. The other backends get
+// an HMAC-signed url to this server instead. Blobs are encrypted at
+// rest, so the client seals the file itself, DARE 2.0 under a key made
+// for the upload, and nothing is ever staged in plaintext. Finalize
+// queues a job that decrypts it, checks it against what the client
+// says it sent, and stores it like a tus upload
+const presignPrefix = "presign_"
+
+func presignPath(id string) string {
+	return presignPrefix + id
+}
+
+// presigned urls are good for PRESIGN_EXPIRY seconds, 15 minutes by
+// default. The upload itself expires like a tus upload, see tusExpiry
+func presignExpiry() time.Duration {
+	if secs, err := strconv.Atoi(os.Getenv("PRESIGN_EXPIRY")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 15 * time.Minute
+}
+
+// signURL is the HMAC scheme for backends that can not presign: a
+// path on this server, valid for method until expires. It is signed
+// with JWT_KEY, which every server behind the same host shares
+func signURL(method, path string, expires time.Time) string {
+	e := strconv.FormatInt(expires.Unix(), 10)
+	return path + "?expires=" + e + "&signature=" + urlSignature(method, path, e)
+}
+
+func urlSignature(method, path, expires string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_KEY")))
+	mac.Write([]byte(method + "\n" + path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSignature(r *http.Request, method string) bool {
+	q := r.URL.Query()
+	e := q.Get("expires")
+	exp, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	want := urlSignature(method, r.URL.Path, e)
+	return hmac.Equal([]byte(want), []byte(q.Get("signature")))
+}
+
+type presignedUpload struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Expires time.Time         `json:"expires"`
+	// the file is sealed under key before it is put,
+	// which makes it length bytes long
+	Key    string `json:"key"`
+	Length int64  `json:"length"`
+}
+
+// presignUpload starts an upload like tusCreate does, with the same
+// Upload-Length and Upload-Metadata headers, so the quota and LSAT
+// checks apply to it the same way
+func presignUpload(w http.ResponseWriter, r *http.Request) {
+	u, ok := newUpload(w, r, uploadViaPresign)
+	if !ok {
+		return
+	}
+	const contentType = "application/octet-stream"
+
+	expires := time.Now().Add(presignExpiry())
+	res := presignedUpload{
+		ID:      u.ID,
+		Method:  "PUT",
+		Headers: map[string]string{"Content-Type": contentType},
+		Expires: expires,
+	}
+	nonce, err := storage.Store.GenNonce()
+	var key [32]byte
+	if err == nil {
+		u.Nonce, u.KeyID = hex.EncodeToString(nonce[:]), storage.Encrypted.KeyID()
+		key, err = storage.Encrypted.BlobKey(u.KeyID, nonce)
+		res.Key = hex.EncodeToString(key[:])
+	}
+	if err == nil {
+		res.Length, err = storage.EncryptedSize(u.Length)
+	}
+	if err == nil {
+		if p, ok := storage.Presign(); ok {
+			res.URL, err = p.PresignPut(presignPath(u.ID), res.Length, contentType, presignExpiry())
+		} else {
+			res.URL = signURL("PUT", "/signed/upload/"+u.ID, expires)
+		}
+	}
+	if err == nil {
+		err = DB.createUpload(u)
+	}
+	if err != nil {
+		fmt.Println(err)
+		tusError(w, http.StatusInternalServerError, "Could not create upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// signedUpload takes the PUT of a signed url, for backends that can
+// not presign. It stores exactly what aws3store would: the sealed file
+func signedUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkSignature(r, "PUT") {
+		tusError(w, http.StatusForbidden, "Invalid signature")
+		return
+	}
+	id := chi.URLParam(r, "id")
+	lock := tusLock(id)
+	if !lock.TryLock() {
+		tusError(w, http.StatusConflict, "Upload is busy")
+		return
+	}
+	defer lock.Unlock()
+
+	u := DB.getPresignedUpload(id)
+	if u.ID == "" {
+		tusError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+	if u.Muid != "" {
+		tusError(w, http.StatusConflict, "Upload is finished")
+		return
+	}
+
+	sealed, err := storage.EncryptedSize(u.Length)
+	if err != nil {
+		tusError(w, http.StatusRequestEntityTooLarge, "File too big")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, sealed)
+	var nonce [32]byte // the client sealed it, see presignPrefix
+	err = storage.Raw.PostReader(presignPath(id), r.Body, -1, "application/octet-stream", nonce)
+	if err != nil {
+		fmt.Println(err)
+		storage.Raw.Delete(presignPath(id))
+		if isTooLarge(err) {
+			tusError(w, http.StatusRequestEntityTooLarge, "File too big")
+			return
+		}
+		tusError(w, http.StatusInternalServerError, "Error Storing the File")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// presignFinalize queues the staged file to be made into media, once it
+// decrypts, hashes to the muid and has the size the client gives. It is
+// 202 until then. Finalizing again hands back the media that was made,
+// or why it was not, after which the upload can be finalized again
+func presignFinalize(w http.ResponseWriter, r *http.Request) {
+	pubKey := r.Context().Value(auth.ContextKey).(string)
+	lock := tusLock(chi.URLParam(r, "id"))
+	if !lock.TryLock() {
+		tusError(w, http.StatusConflict, "Upload is busy")
+		return
+	}
+	defer lock.Unlock()
+
+	u, ok := loadUpload(w, r, uploadViaPresign)
+	if !ok {
+		return
+	}
+	if u.Muid != "" {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(DB.getMyMediaByMUID(pubKey, u.Muid))
+		return
+	}
+	if u.Claimed != "" {
+		reason := DB.getJobError(u.ID)
+		if reason == "" {
+			finalizePending(w, u)
+			return
+		}
+		if err := DB.claimUpload(u.ID, ""); err != nil {
+			tusError(w, http.StatusInternalServerError, "Could not finalize the upload")
+			return
+		}
+		tusError(w, http.StatusBadRequest, reason)
+		return
+	}
+
+	muid := r.FormValue("muid")
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if muid == "" || err != nil {
+		tusError(w, http.StatusBadRequest, "muid and size are required")
+		return
+	}
+	if size != u.Length {
+		tusError(w, http.StatusBadRequest, errUploadMismatch.Error())
+		return
+	}
+	if err := DB.claimUpload(u.ID, muid); err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not finalize the upload")
+		return
+	}
+	finalizePending(w, u)
+}
+
+func finalizePending(w http.ResponseWriter, u Upload) {
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":     u.ID,
+		"status": mediaPending,
+	})
+}
+
+// finalizePresigned is the finalize job. The sealed file is read back
+// with the key the client was given, and stored like a tus upload,
+// which checks it against the claimed muid and the length
+func finalizePresigned(id string) error {
+	u := DB.getPresignedUpload(id)
+	if u.ID == "" || u.Muid != "" || u.Claimed == "" {
+		return nil
+	}
+	nonce := Blob{Nonce: u.Nonce}.NonceBytes()
+	src, err := storage.Uncached(true, u.KeyID).GetReader(presignPath(u.ID), nonce)
+	if err != nil {
+		return err
+	}
+	_, err = completeUpload(u, src, u.Claimed)
+	src.Close()
+	if err != nil {
+		return err
+	}
+	return storage.Raw.Delete(presignPath(u.ID))
+}
+
+type presignedDownload struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	// straight from the bucket, where the backend can presign. The
+	// blob is stored encrypted if key is set: DARE 2.0 under this key,
+	// which opens this one blob and nothing else
+	DirectURL string `json:"direct_url,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// presignDownload hands out urls for a file, after the same mediaToken
+// checks as /file. url serves it decrypted, through this server
+func presignDownload(w http.ResponseWriter, r *http.Request) {
+	media, ok := authorizeMedia(w, r)
+	if !ok {
+		return
+	}
+	blob := DB.getBlob(media.ID)
+	if blob.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	expires := time.Now().Add(presignExpiry())
+	res := presignedDownload{
+		URL:     signURL("GET", "/signed/media/"+media.OwnerPubKey+"/"+media.ID, expires),
+		Expires: expires,
+	}
+	if p, ok := storage.Presign(); ok {
+		direct, err := p.PresignGet(blob.ID, presignExpiry())
+		if err == nil && blob.Encrypted {
+			var key [32]byte
+			key, err = storage.Encrypted.BlobKey(blob.KeyID, blob.NonceBytes())
+			res.Key = hex.EncodeToString(key[:])
+		}
+		if err != nil {
+			fmt.Println(err)
+			res.Key = ""
+		} else {
+			res.DirectURL = direct
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// signedMedia serves the url of presignDownload. The url names the
+// owner whose row the token was checked against, so that is the row
+// the file is served as, and whose expiry counts
+func signedMedia(w http.ResponseWriter, r *http.Request) {
+	if !checkSignature(r, "GET") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	muid := chi.URLParam(r, "muid")
+	media := DB.getMyMediaByMUID(chi.URLParam(r, "owner"), muid)
+	if isExpired(media) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	serveMedia(w, r, muid, DB.getBlob(muid), media, media.Size)
+}
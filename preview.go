@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/nfnt/resize"
+)
+
+// images get a BlurHash (https://blurha.sh) and a few dominant colors,
+// for clients to show in place of an image that is still downloading.
+// They are worked out from a small copy, where the detail is gone anyway
+
+// the small copy is at most this wide and high
+const previewSize = 64
+
+// at most this many dominant colors
+const paletteSize = 5
+
+// colors in the palette are at least this far apart, in
+// summed up differences of their 0 to 255 components
+const paletteDistance = 48
+
+// imageInfo is what is worked out from an image, see readImage
+type imageInfo struct {
+	blurhash   string
+	palette    []string
+	phash      int64
+	phashBands []int64 // none if there is no phash, see similar.go
+}
+
+// isPreviewable is whether the type can be decoded into a preview
+func isPreviewable(contentType string) bool {
+	switch canonicalMime(essence(contentType)) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// savePreview is the preview job, for all the rows with the muid.
+// Images over the limits are stored all the same, they just have none
+func savePreview(muid string, nonce [32]byte, reader io.ReadCloser) error {
+	defer reader.Close()
+	_, info, err := readImage(reader)
+	if isImageLimit(err) {
+		fmt.Println(muid, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := DB.setPreview(muid, info.blurhash, info.palette); err != nil {
+		return err
+	}
+	return DB.setPhash(muid, info.phash, info.phashBands)
+}
+
+// readImage decodes an image, once its header is checked,
+// and works out its preview and phash
+func readImage(r io.Reader) (image.Image, imageInfo, error) {
+	r, _, err := checkImageHead(r)
+	if err != nil {
+		return nil, imageInfo{}, err
+	}
+	// the orientation is in the first few segments
+	head := &headWriter{max: maxMetadataSegment}
+	img, _, err := image.Decode(io.TeeReader(r, head))
+	if err != nil {
+		return nil, imageInfo{}, err
+	}
+	return img, preview(img, exifOrientation(head.buf)), nil
+}
+
+// headWriter keeps the first max bytes written to it
+type headWriter struct {
+	buf []byte
+	max int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := h.max - len(h.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		h.buf = append(h.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// preview is the BlurHash, palette and phash of an image, upright
+func preview(img image.Image, orientation int) imageInfo {
+	small := applyOrientation(resize.Thumbnail(previewSize, previewSize, img, resize.Bilinear), orientation)
+	// transparency shows as white
+	b := small.Bounds()
+	flat := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(flat, flat.Bounds(), small, b.Min, draw.Over)
+
+	x, y := 4, 3
+	if b.Dy() > b.Dx() {
+		x, y = 3, 4
+	}
+	hash := dHash(flat)
+	return imageInfo{
+		blurhash:   blurhash(flat, x, y),
+		palette:    dominantColors(small, paletteSize),
+		phash:      int64(hash),
+		phashBands: phashBands(hash),
+	}
+}
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encode83(value, length int) string {
+	s := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		s[i] = base83[value%83]
+		value /= 83
+	}
+	return string(s)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(f float64) int {
+	f = math.Max(0, math.Min(1, f))
+	if f <= 0.0031308 {
+		return int(f*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(f, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurhash encodes img with x by y components, as in the reference
+// implementation at https://github.com/woltapp/blurhash
+func blurhash(img *image.NRGBA, x, y int) string {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	factors := make([][3]float64, 0, x*y)
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for py := 0; py < h; py++ {
+				for px := 0; px < w; px++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(px)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(py)/float64(h))
+					p := img.Pix[img.PixOffset(px, py):]
+					f[0] += basis * srgbToLinear(p[0])
+					f[1] += basis * srgbToLinear(p[1])
+					f[2] += basis * srgbToLinear(p[2])
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	hash := encode83((x-1)+(y-1)*9, 1)
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		hash += encode83(quantised, 1)
+	} else {
+		hash += encode83(0, 1)
+	}
+	hash += encode83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4)
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		hash += encode83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return hash
+}
+
+// dominantColors are the most common colors of img as #rrggbb, most
+// common first. Pixels are counted in buckets of similar colors, and
+// a bucket too close to one already picked is passed over. Pixels
+// that are mostly transparent do not count
+func dominantColors(img image.Image, n int) []string {
+	type bucket struct {
+		key, r, g, b, count int
+	}
+	buckets := map[int]*bucket{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{key: key}
+				buckets[key] = bk
+			}
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			bk.count++
+		}
+	}
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		// the same colors come out in the same order every time
+		return sorted[i].key < sorted[j].key
+	})
+
+	picked := [][3]int{}
+	for _, bk := range sorted {
+		c := [3]int{bk.r / bk.count, bk.g / bk.count, bk.b / bk.count}
+		far := true
+		for _, p := range picked {
+			if absInt(c[0]-p[0])+absInt(c[1]-p[1])+absInt(c[2]-p[2]) < paletteDistance {
+				far = false
+				break
+			}
+		}
+		if far {
+			picked = append(picked, c)
+		}
+		if len(picked) == n {
+			break
+		}
+	}
+	palette := []string{}
+	for _, c := range picked {
+		palette = append(palette, fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2]))
+	}
+	return palette
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// backfillPreviews works out the preview and phash of images uploaded
+// before they were. Owners of the same content get the same ones
+func backfillPreviews() {
+
+	all := DB.getAllMedia()
+	fmt.Printf("=> %+v\n", len(all))
+
+	total := len(all)
+
+	done := map[string]bool{}
+	failed := 0
+	for i, m := range all {
+		if done[m.ID] || (m.Blurhash != "" && len(m.PhashBands) > 0) || !isPreviewable(m.Mime) {
+			continue
+		}
+		done[m.ID] = true
+		fmt.Printf("=> %v:%v\n", total, i)
+
+		if err := backfillPreview(m.ID); err != nil {
+			fmt.Println("failed", m.ID, err)
+			failed++
+		}
+	}
+	fmt.Printf("=> done, %d failed\n", failed)
+}
+
+func backfillPreview(muid string) error {
+	blob := DB.getBlob(muid)
+	if blob.ID == "" {
+		return fmt.Errorf("no blob")
+	}
+	return fromStore(blob, savePreview)
+}
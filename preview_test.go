@@ -0,0 +1,41 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+func TestBlurhash(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.ZP, draw.Src)
+
+	hash := blurhash(img, 4, 3)
+	if len(hash) != 6+2*(4*3-1) {
+		t.Fatalf("length %d: %s", len(hash), hash)
+	}
+	// 4 by 3 components, then the average color
+	if hash[0] != 'L' || hash[2:6] != encode83(0xff0000, 4) {
+		t.Errorf("got %s", hash)
+	}
+	if again := blurhash(img, 4, 3); again != hash {
+		t.Errorf("not the same twice: %s", again)
+	}
+}
+
+func TestDominantColors(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 10, 3), image.NewUniform(color.NRGBA{255, 255, 0, 255}), image.ZP, draw.Src)
+	// too close to the blue to count as another color
+	img.Set(9, 9, color.NRGBA{0, 0, 230, 255})
+	// transparent
+	img.Set(0, 9, color.NRGBA{255, 0, 0, 0})
+
+	got := dominantColors(img, paletteSize)
+	if want := []string{"#0000ff", "#ffff00"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
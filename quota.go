@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/stakwork/sphinx-meme/auth"
+	"github.com/stakwork/sphinx-meme/lsat"
+)
+
+// quotaFromEnv reads QUOTA_MAX_BYTES, QUOTA_MAX_FILES and
+// QUOTA_MAX_BYTES_PER_DAY, unset or 0 means no limit
+func quotaFromEnv(name string) int64 {
+	n, _ := strconv.ParseInt(os.Getenv(name), 10, 64)
+	return n
+}
+
+// usageOf is what a pubkey stores, and what it may: the defaults
+// from the env, or its row in the quotas table where it has one
+func usageOf(pubKey string) Usage {
+	u := DB.getUsage(pubKey)
+	u.MaxBytes = quotaFromEnv("QUOTA_MAX_BYTES")
+	u.MaxFiles = quotaFromEnv("QUOTA_MAX_FILES")
+	u.MaxBytesPerDay = quotaFromEnv("QUOTA_MAX_BYTES_PER_DAY")
+
+	q := DB.getQuota(pubKey)
+	if q.MaxBytes != nil {
+		u.MaxBytes = *q.MaxBytes
+	}
+	if q.MaxFiles != nil {
+		u.MaxFiles = *q.MaxFiles
+	}
+	if q.MaxBytesPerDay != nil {
+		u.MaxBytesPerDay = *q.MaxBytesPerDay
+	}
+	return u
+}
+
+// errQuota is an upload that would go over its owner's quota
+type errQuota struct {
+	status  int
+	message string
+}
+
+func (e errQuota) Error() string {
+	return e.message
+}
+
+func isQuotaError(err error) bool {
+	_, ok := err.(errQuota)
+	return ok
+}
+
+// checkQuota is an errQuota if one more file of incoming bytes would
+// go over u: 507 for the stored bytes and file count, 402 for the bytes
+// per day. Unfinished tus and presigned uploads count as stored already
+func checkQuota(u Usage, incoming int64) error {
+	if u.MaxFiles > 0 && u.Files+u.Pending+1 > u.MaxFiles {
+		return errQuota{http.StatusInsufficientStorage, "File count quota exceeded"}
+	}
+	if u.MaxBytes > 0 && u.Bytes+u.Reserved+incoming > u.MaxBytes {
+		return errQuota{http.StatusInsufficientStorage, "Storage quota exceeded"}
+	}
+	if u.MaxBytesPerDay > 0 && u.BytesToday+u.Reserved+incoming > u.MaxBytesPerDay {
+		return errQuota{http.StatusPaymentRequired, "Daily upload quota exceeded"}
+	}
+	return nil
+}
+
+// checkUploadQuota checks a tus or presigned upload again as it
+// completes, in case others got in first, its own reservation aside
+func checkUploadQuota(up Upload) error {
+	u := usageOf(up.OwnerPubKey)
+	u.Reserved -= up.Length
+	u.Pending--
+	return checkQuota(u, up.Length)
+}
+
+// quotaContext turns away uploads that would go over the owner's quota
+// before the body is read. The request's Content-Length stands in for
+// the file size, or Upload-Length when a tus or presigned upload is
+// created, which reserves it until the upload is done. The max upload
+// size is lowered to what is left, so that a body without a length
+// can not get past the quota either
+func quotaContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		pubKey, _ := ctx.Value(auth.ContextKey).(string)
+		if pubKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := usageOf(pubKey)
+
+		incoming := r.ContentLength
+		// creating a tus or presigned upload has no body, only the length to come
+		if l, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64); err == nil {
+			incoming = l
+		}
+		if incoming < 0 {
+			incoming = 0
+		}
+		if err := checkQuota(u, incoming); err != nil {
+			e := err.(errQuota)
+			quotaExceeded(w, e.status, e.message)
+			return
+		}
+
+		maxUpload, _ := ctx.Value(lsat.MaxUploadSizeContextKey).(int64)
+		for _, left := range []int64{
+			remaining(u.MaxBytes, u.Bytes+u.Reserved),
+			remaining(u.MaxBytesPerDay, u.BytesToday+u.Reserved),
+		} {
+			// the multipart framing around the file is not
+			// part of the quota, hence the same 512 bytes of
+			// slack as the max upload size
+			if left >= 0 && left+512 < maxUpload {
+				maxUpload = left + 512
+			}
+		}
+		ctx = context.WithValue(ctx, lsat.MaxUploadSizeContextKey, maxUpload)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// remaining is -1 for no limit
+func remaining(max, used int64) int64 {
+	if max <= 0 {
+		return -1
+	}
+	if used > max {
+		return 0
+	}
+	return max - used
+}
+
+func quotaExceeded(w http.ResponseWriter, status int, message string) {
+	fmt.Println(message)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(message)
+}
+
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pubKey := ctx.Value(auth.ContextKey).(string)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(usageOf(pubKey))
+}
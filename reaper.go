@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// how many expired rows the reaper handles per pass
+const reapBatchSize = 100
+
+// startReaper periodically purges expired media. The rows are kept
+// (marked purged) so downloads can tell an expired muid from one that
+// never existed, the files go once no other owner still uses them.
+// REAPER_INTERVAL is in seconds, defaulting to ten minutes
+func startReaper() {
+	interval := 10 * time.Minute
+	if secs, err := strconv.Atoi(os.Getenv("REAPER_INTERVAL")); err == nil && secs > 0 {
+		interval = time.Duration(secs) * time.Second
+	}
+	fmt.Println("expiry reaper every", interval)
+	go func() {
+		for {
+			reapExpired()
+			reapUploads()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func reapExpired() {
+	for {
+		expired := DB.getExpiredMedia(reapBatchSize)
+		purged := 0
+		for _, m := range expired {
+			err := DB.releaseMedia(m.ID, m.OwnerPubKey, true, func() error {
+				return deleteBlobs(m.ID)
+			})
+			if err != nil {
+				fmt.Println("reaper: could not purge", m.ID, err)
+				continue
+			}
+			purged++
+		}
+		if purged > 0 {
+			fmt.Printf("reaper: purged %d expired media\n", purged)
+		}
+		// a short or fully failed batch means there is nothing left
+		// that this pass can do
+		if len(expired) < reapBatchSize || purged == 0 {
+			return
+		}
+	}
+}
+
+// isExpired is true once a media row is past its expiry,
+// whether or not the reaper has got to its files yet
+func isExpired(m Media) bool {
+	return m.Expiry != nil && !m.Expiry.After(time.Now())
+}
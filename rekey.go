@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// how many blobs the re-encryption job loads at a time
+const rekeyBatchSize = 100
+
+// startRekeying rewrites, in the background, every blob that is still
+// encrypted under a retired master key. Until it is done those blobs
+// are read with the retired key, so it can go from
+// RETIRED_ENCRYPTION_KEYS once this has logged that it is finished
+func startRekeying() {
+	go func() {
+		current := storage.Encrypted.KeyID()
+		rekeyed, failed := 0, 0
+		for {
+			bs := DB.getBlobsToRekey(current, rekeyBatchSize)
+			done := 0
+			for _, b := range bs {
+				err := DB.rekeyBlob(b.ID, current, func() error {
+					return rekeyBlob(b)
+				})
+				if err != nil {
+					fmt.Println("rekey: failed", b.ID, err)
+					failed++
+					continue
+				}
+				done++
+			}
+			rekeyed += done
+			// failures stay in the result, so a batch
+			// without progress is as far as this run gets
+			if len(bs) < rekeyBatchSize || done == 0 {
+				break
+			}
+		}
+		if rekeyed > 0 || failed > 0 {
+			fmt.Printf("rekey: %d blobs now under key %s, %d failed\n", rekeyed, current, failed)
+		}
+	}()
+}
+
+func rekeyBlob(b Blob) error {
+	nonce := b.NonceBytes()
+	if err := storage.Encrypted.WithKey(b.KeyID).Rekey(b.ID, nonce, ""); err != nil {
+		return err
+	}
+	// variants are optional, a missing one is not a failure
+	for _, suffix := range blobVariants(b.ID) {
+		if err := storage.Encrypted.WithKey(b.KeyID).Rekey(b.ID+suffix, nonce, ""); err != nil {
+			fmt.Println("rekey: skipping", b.ID+suffix, err)
+		}
+	}
+
+	// make sure the original decrypts back to its content hash
+	reader, err := storage.Uncached(true, storage.Encrypted.KeyID()).GetReader(b.ID, nonce)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	muid, err := muidOf(reader)
+	if err != nil {
+		return err
+	}
+	if muid != b.ID {
+		return fmt.Errorf("hash mismatch after rekeying: %s", muid)
+	}
+	return nil
+}
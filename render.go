@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+
+	"github.com/stakwork/sphinx-meme/auth"
+	"github.com/stakwork/sphinx-meme/lsat"
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// memes are rendered from a template and caption layers, with the Go
+// fonts, so that clients do not each have to composite the text. The
+// result is a new media of the caller's, pointing back at its template
+
+// the bundled fonts a layer can be in, bold is the default
+var captionFonts = map[string][]byte{
+	"regular": goregular.TTF,
+	"bold":    gobold.TTF,
+	"italic":  goitalic.TTF,
+	"mono":    gomono.TTF,
+}
+
+const defaultCaptionFont = "bold"
+
+// limits on what a render can ask for
+const (
+	maxCaptionLayers  = 10
+	maxCaptionText    = 500
+	maxCaptionOutline = 20
+)
+
+// captionLayer is a block of text drawn on the template. x and y are
+// fractions of the template's width and height, where the block is
+// placed by align (left, center or right) and valign (top, middle or
+// bottom). size is the font size and outline the width of the outline
+// in pixels. Lines wrap at width, a fraction of the template's width
+type captionLayer struct {
+	Text         string  `json:"text"`
+	X            float64 `json:"x"`
+	Y            float64 `json:"y"`
+	Size         float64 `json:"size"`
+	Font         string  `json:"font"`
+	Color        string  `json:"color"`
+	Outline      float64 `json:"outline"`
+	OutlineColor string  `json:"outline_color"`
+	Align        string  `json:"align"`
+	Valign       string  `json:"valign"`
+	Width        float64 `json:"width"`
+}
+
+// renderRequest is the body of a render. The media
+// fields are the same as those of an upload
+type renderRequest struct {
+	Layers      []captionLayer `json:"layers"`
+	Format      string         `json:"format"` // png (the default) or jpeg
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Price       int64          `json:"price"`
+	TTL         int64          `json:"ttl"`
+	Tags        []string       `json:"tags"`
+	Expiry      int64          `json:"expiry"`
+}
+
+// errCaption is a layer that can not be drawn
+type errCaption struct {
+	message string
+}
+
+func (e errCaption) Error() string {
+	return e.message
+}
+
+// parsed fonts, sfnt.Font can be shared as long as each user has its own Buffer
+var parsedFonts = struct {
+	sync.Mutex
+	byName map[string]*sfnt.Font
+}{byName: map[string]*sfnt.Font{}}
+
+func captionFont(name string) (*sfnt.Font, error) {
+	if name == "" {
+		name = defaultCaptionFont
+	}
+	ttf, ok := captionFonts[name]
+	if !ok {
+		return nil, errCaption{fmt.Sprintf("No font %s", name)}
+	}
+	parsedFonts.Lock()
+	defer parsedFonts.Unlock()
+	if f, ok := parsedFonts.byName[name]; ok {
+		return f, nil
+	}
+	f, err := sfnt.Parse(ttf)
+	if err != nil {
+		return nil, err
+	}
+	parsedFonts.byName[name] = f
+	return f, nil
+}
+
+// parseHexColor reads #rgb, #rrggbb or #rrggbbaa
+func parseHexColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, errCaption{fmt.Sprintf("%s is not a color", s)}
+	}
+	return color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, nil
+}
+
+// captionText is a layer laid out: its glyph outlines, at their place
+// on the template, and the rectangle they are drawn within
+type captionText struct {
+	segments []sfnt.Segment
+	bounds   image.Rectangle
+}
+
+// layout wraps and places the text of a layer on a w by h template
+func (l captionLayer) layout(w, h int) (captionText, error) {
+	f, err := captionFont(l.Font)
+	if err != nil {
+		return captionText{}, err
+	}
+	size := l.Size
+	if size == 0 {
+		size = float64(h) / 10
+	}
+	if size < 1 || size > float64(h) {
+		return captionText{}, errCaption{"size is more than the template is high"}
+	}
+	ppem := fixed.Int26_6(size * 64)
+	buf := &sfnt.Buffer{}
+	metrics, err := f.Metrics(buf, ppem, font.HintingNone)
+	if err != nil {
+		return captionText{}, err
+	}
+
+	// the glyph of a rune, the kerning between it and the one
+	// before, and how far the glyph moves the pen
+	glyph := func(prev sfnt.GlyphIndex, r rune) (sfnt.GlyphIndex, fixed.Int26_6, fixed.Int26_6) {
+		i, _ := f.GlyphIndex(buf, r)
+		a, _ := f.GlyphAdvance(buf, i, ppem, font.HintingNone)
+		k := fixed.Int26_6(0)
+		if prev != 0 {
+			k, _ = f.Kern(buf, prev, i, ppem, font.HintingNone)
+		}
+		return i, k, a
+	}
+	measure := func(line string) fixed.Int26_6 {
+		width := fixed.Int26_6(0)
+		prev := sfnt.GlyphIndex(0)
+		for _, r := range line {
+			i, k, a := glyph(prev, r)
+			width += k + a
+			prev = i
+		}
+		return width
+	}
+
+	maxWidth := l.Width
+	if maxWidth == 0 {
+		maxWidth = 0.9
+	}
+	wrapAt := fixed.Int26_6(maxWidth * float64(w) * 64)
+	lines := []string{}
+	for _, paragraph := range strings.Split(l.Text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			if line != "" && measure(line+" "+word) > wrapAt {
+				lines = append(lines, line)
+				line = word
+				continue
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		lines = append(lines, line)
+	}
+
+	lineHeight := metrics.Height
+	if lineHeight == 0 {
+		lineHeight = metrics.Ascent + metrics.Descent
+	}
+	blockHeight := lineHeight * fixed.Int26_6(len(lines))
+	top := fixed.Int26_6(l.Y * float64(h) * 64)
+	switch l.Valign {
+	case "", "top":
+	case "middle":
+		top -= blockHeight / 2
+	case "bottom":
+		top -= blockHeight
+	default:
+		return captionText{}, errCaption{"valign is top, middle or bottom"}
+	}
+
+	text := captionText{}
+	anchor := fixed.Int26_6(l.X * float64(w) * 64)
+	minX, maxX := anchor, anchor
+	for n, line := range lines {
+		width := measure(line)
+		x := anchor
+		switch l.Align {
+		case "", "left":
+		case "center":
+			x -= width / 2
+		case "right":
+			x -= width
+		default:
+			return captionText{}, errCaption{"align is left, center or right"}
+		}
+		if x < minX {
+			minX = x
+		}
+		if x+width > maxX {
+			maxX = x + width
+		}
+		baseline := top + lineHeight*fixed.Int26_6(n) + metrics.Ascent
+		prev := sfnt.GlyphIndex(0)
+		for _, r := range line {
+			i, k, a := glyph(prev, r)
+			x += k
+			at := fixed.Point26_6{X: x, Y: baseline}
+			segments, _ := f.LoadGlyph(buf, i, ppem, nil)
+			for _, s := range segments {
+				for n := range s.Args {
+					s.Args[n] = s.Args[n].Add(at)
+				}
+				text.segments = append(text.segments, s)
+			}
+			x += a
+			prev = i
+		}
+	}
+
+	// glyphs can reach a little past their advance and the line
+	margin := int(size/4) + int(math.Ceil(l.Outline))
+	text.bounds = image.Rect(
+		minX.Floor()-margin, top.Floor()-margin,
+		maxX.Ceil()+margin, (top+blockHeight).Ceil()+margin,
+	).Intersect(image.Rect(0, 0, w, h))
+	return text, nil
+}
+
+// rasterize draws the outlines into a mask the size of the
+// text's bounds, moved by dx, dy
+func (t captionText) rasterize(z *vector.Rasterizer, mask *image.Alpha, dx, dy float32) {
+	b := t.bounds
+	z.Reset(b.Dx(), b.Dy())
+	z.DrawOp = draw.Over
+	pt := func(p fixed.Point26_6) (float32, float32) {
+		return float32(p.X)/64 - float32(b.Min.X) + dx, float32(p.Y)/64 - float32(b.Min.Y) + dy
+	}
+	for _, s := range t.segments {
+		switch s.Op {
+		case sfnt.SegmentOpMoveTo:
+			// each contour of a glyph is a path of its own
+			z.ClosePath()
+			z.MoveTo(pt(s.Args[0]))
+		case sfnt.SegmentOpLineTo:
+			z.LineTo(pt(s.Args[0]))
+		case sfnt.SegmentOpQuadTo:
+			bx, by := pt(s.Args[0])
+			cx, cy := pt(s.Args[1])
+			z.QuadTo(bx, by, cx, cy)
+		case sfnt.SegmentOpCubeTo:
+			bx, by := pt(s.Args[0])
+			cx, cy := pt(s.Args[1])
+			ex, ey := pt(s.Args[2])
+			z.CubeTo(bx, by, cx, cy, ex, ey)
+		}
+	}
+	z.ClosePath()
+	z.Draw(mask, mask.Bounds(), image.Opaque, image.ZP)
+}
+
+// drawCaption draws a layer onto canvas, its outline first
+func drawCaption(canvas *image.RGBA, l captionLayer) error {
+	if len([]rune(l.Text)) > maxCaptionText {
+		return errCaption{fmt.Sprintf("text is more than %d characters", maxCaptionText)}
+	}
+	if l.Outline < 0 || l.Outline > maxCaptionOutline {
+		return errCaption{fmt.Sprintf("outline is more than %d", maxCaptionOutline)}
+	}
+	fill, outline := "#ffffff", "#000000"
+	if l.Color != "" {
+		fill = l.Color
+	}
+	if l.OutlineColor != "" {
+		outline = l.OutlineColor
+	}
+	fillColor, err := parseHexColor(fill)
+	if err != nil {
+		return err
+	}
+	outlineColor, err := parseHexColor(outline)
+	if err != nil {
+		return err
+	}
+
+	text, err := l.layout(canvas.Bounds().Dx(), canvas.Bounds().Dy())
+	if err != nil {
+		return err
+	}
+	if text.bounds.Empty() || len(text.segments) == 0 {
+		return nil
+	}
+	z := vector.NewRasterizer(0, 0)
+
+	// the outline is the text drawn around in a circle,
+	// and half way in for the wider ones
+	if l.Outline > 0 {
+		mask := image.NewAlpha(image.Rect(0, 0, text.bounds.Dx(), text.bounds.Dy()))
+		for _, radius := range []float64{l.Outline, l.Outline / 2} {
+			steps := 8 + int(radius*4)
+			for i := 0; i < steps; i++ {
+				angle := 2 * math.Pi * float64(i) / float64(steps)
+				text.rasterize(z, mask, float32(radius*math.Cos(angle)), float32(radius*math.Sin(angle)))
+			}
+			if radius <= 1 {
+				break
+			}
+		}
+		draw.DrawMask(canvas, text.bounds, image.NewUniform(outlineColor), image.ZP, mask, image.ZP, draw.Over)
+	}
+	mask := image.NewAlpha(image.Rect(0, 0, text.bounds.Dx(), text.bounds.Dy()))
+	text.rasterize(z, mask, 0, 0)
+	draw.DrawMask(canvas, text.bounds, image.NewUniform(fillColor), image.ZP, mask, image.ZP, draw.Over)
+	return nil
+}
+
+// renderMeme draws the layers over the template and encodes it
+func renderMeme(template image.Image, layers []captionLayer, format string) ([]byte, string, error) {
+	contentType := "image/png"
+	switch format {
+	case "", "png":
+	case "jpeg", "jpg":
+		contentType = "image/jpeg"
+	default:
+		return nil, "", errCaption{"format is png or jpeg"}
+	}
+	if len(layers) > maxCaptionLayers {
+		return nil, "", errCaption{fmt.Sprintf("more than %d layers", maxCaptionLayers)}
+	}
+
+	b := template.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if contentType == "image/jpeg" {
+		// jpeg has no transparency
+		draw.Draw(canvas, canvas.Bounds(), image.White, image.ZP, draw.Src)
+	}
+	draw.Draw(canvas, canvas.Bounds(), template, b.Min, draw.Over)
+	for _, l := range layers {
+		if err := drawCaption(canvas, l); err != nil {
+			return nil, "", err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(buf, canvas, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(buf, canvas)
+	}
+	return buf.Bytes(), contentType, err
+}
+
+// renderTemplate renders a meme from the template and stores it
+// as a new media of the caller's, like a public upload
+func renderTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pubKey := ctx.Value(auth.ContextKey).(string)
+	muid := chi.URLParam(r, "muid")
+
+	req := renderRequest{}
+	body := http.MaxBytesReader(w, r.Body, maxFormValueSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Could not read the layers")
+		return
+	}
+
+	template := DB.getTemplateByMuid(muid)
+	if template.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("Template not found")
+		return
+	}
+	if isExpired(template) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	blob := DB.getBlob(muid)
+	if blob.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("Template not found")
+		return
+	}
+	var rendered []byte
+	var contentType string
+	err := runImageWork(func() error {
+		reader, err := storage.Backend(blob.Encrypted, blob.KeyID).GetReader(muid, blob.NonceBytes())
+		if err != nil {
+			return err
+		}
+		img, _, err := decodeImage(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		rendered, contentType, err = renderMeme(img, req.Layers, req.Format)
+		return err
+	})
+	if err != nil {
+		fmt.Println(err)
+		if status, ok := imageErrorStatus(err); ok {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		if _, ok := err.(errCaption); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode("Could not render the meme")
+		return
+	}
+	// the rendered file counts towards the quota like an upload
+	if max, ok := ctx.Value(lsat.MaxUploadSizeContextKey).(int64); ok && int64(len(rendered)) > max {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode("File too big")
+		return
+	}
+
+	filename := "meme.png"
+	if contentType == "image/jpeg" {
+		filename = "meme.jpg"
+	}
+	media, err := mediaFromParams(pubKey, uploadParams{
+		Price:       req.Price,
+		TTL:         req.TTL,
+		Name:        req.Name,
+		Description: req.Description,
+		Tags:        req.Tags,
+		Expiry:      req.Expiry,
+	}, filename, contentType)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+
+	nonce, _ := storage.Store.GenNonce()
+	stored, err := storeUpload(bytes.NewReader(rendered), contentType, nonce, true)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode("Error Storing the File")
+		return
+	}
+	stored.applyTo(&media)
+	media.Metadata = metadataStripped
+	media.FromTemplate = muid
+	media.Public = true
+	fmt.Printf("MEDIA: %+v\n", media)
+
+	created, _, err := saveUpload(stored, nonce, media, derivativeJobs(media.Mime, true, true))
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(created)
+}
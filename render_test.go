@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func grayTemplate(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{128}), image.ZP, draw.Src)
+	return img
+}
+
+func TestRenderMeme(t *testing.T) {
+	rendered, contentType, err := renderMeme(grayTemplate(200, 100), []captionLayer{{
+		Text:    "TOP TEXT",
+		X:       0.5,
+		Y:       0.05,
+		Size:    30,
+		Outline: 2,
+		Align:   "center",
+	}}, "")
+	if err != nil || contentType != "image/png" {
+		t.Fatalf("render: %s %v", contentType, err)
+	}
+	img, err := png.Decode(bytes.NewReader(rendered))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// white text outlined in black, at the top, and nothing below it
+	counts := map[color.RGBA]int{}
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			if y > 50 && c != (color.RGBA{128, 128, 128, 255}) {
+				t.Fatalf("drawn at %d,%d", x, y)
+			}
+			counts[c]++
+		}
+	}
+	if counts[color.RGBA{255, 255, 255, 255}] < 100 || counts[color.RGBA{0, 0, 0, 255}] < 100 {
+		t.Errorf("white %d, black %d", counts[color.RGBA{255, 255, 255, 255}], counts[color.RGBA{0, 0, 0, 255}])
+	}
+	// centered
+	left, right := 0, 0
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 200; x++ {
+			if c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA); c.R == 255 && x < 100 {
+				left++
+			} else if c.R == 255 {
+				right++
+			}
+		}
+	}
+	if left == 0 || right == 0 || left > right*2 || right > left*2 {
+		t.Errorf("left %d, right %d", left, right)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	for _, l := range []captionLayer{
+		{Text: "a", Color: "red"},
+		{Text: "a", Font: "comic sans"},
+		{Text: "a", Align: "justify"},
+		{Text: "a", Size: 500},
+		{Text: "a", Outline: 50},
+	} {
+		_, _, err := renderMeme(grayTemplate(20, 20), []captionLayer{l}, "png")
+		if _, ok := err.(errCaption); !ok {
+			t.Errorf("%+v: %v", l, err)
+		}
+	}
+	if _, _, err := renderMeme(grayTemplate(20, 20), nil, "gif"); err == nil {
+		t.Errorf("gif rendered")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	short, err := captionLayer{Text: "one two three four five six", Size: 20}.layout(1000, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := captionLayer{Text: "one two three four five six", Size: 20, Width: 0.5}.layout(200, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.bounds.Dy() <= short.bounds.Dy() {
+		t.Errorf("not wrapped: %v %v", wrapped.bounds, short.bounds)
+	}
+}
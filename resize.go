@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/oliamb/cutter"
+)
+
+// public images are resized on demand with ?w=&h=&fit=&crop=. Each size
+// is made once and stored as a variant under a key made of the
+// parameters, later requests are served what was stored. Only the
+// sizes in RESIZE_SIZES can be asked for, so the variants of a file
+// are bounded
+
+// resized variants are stored under the muid with a suffix starting
+// with this, followed by the parameters, see resizeSpec.suffix
+const resizePrefix = "_r"
+
+// widths and heights that can be asked for, RESIZE_SIZES overrides it
+const defaultResizeSizes = "32,64,128,256,400,512,800,1024,1600"
+
+// how a resized image fills w by h: cover crops it to exactly w by h,
+// contain fits it within, fill stretches it to exactly w by h
+const (
+	fitCover   = "cover"
+	fitContain = "contain"
+	fitFill    = "fill"
+)
+
+// which part of the image cover keeps. smart picks the
+// part with the most detail, its edges adding up highest
+const (
+	cropCenter = "center"
+	cropTop    = "top"
+	cropSmart  = "smart"
+)
+
+// resizeSpec is a resize as asked for, normalized so that
+// asking for the same image twice gives the same spec
+type resizeSpec struct {
+	w, h int
+	fit  string
+	crop string
+}
+
+// errResize is a resize that can not be asked for
+type errResize struct {
+	message string
+}
+
+func (e errResize) Error() string {
+	return e.message
+}
+
+func allowedResizeSizes() map[int]bool {
+	list := os.Getenv("RESIZE_SIZES")
+	if list == "" {
+		list = defaultResizeSizes
+	}
+	sizes := map[int]bool{}
+	for _, s := range strings.Split(list, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && n > 0 {
+			sizes[n] = true
+		}
+	}
+	return sizes
+}
+
+// isResize is whether the query asks for a resized image
+func isResize(q url.Values) bool {
+	return q.Get("w") != "" || q.Get("h") != ""
+}
+
+// parseResize reads w, h, fit and crop. With only a width or a height
+// the aspect ratio is kept, so fit and crop make no difference
+func parseResize(q url.Values) (resizeSpec, error) {
+	s := resizeSpec{fit: q.Get("fit"), crop: q.Get("crop")}
+	allowed := allowedResizeSizes()
+	for _, d := range []struct {
+		name string
+		n    *int
+	}{{"w", &s.w}, {"h", &s.h}} {
+		v := q.Get(d.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || !allowed[n] {
+			return resizeSpec{}, errResize{fmt.Sprintf("%s=%s is not one of the allowed sizes", d.name, v)}
+		}
+		*d.n = n
+	}
+	if s.w == 0 && s.h == 0 {
+		return resizeSpec{}, errResize{"No size"}
+	}
+
+	switch s.fit {
+	case "":
+		s.fit = fitCover
+	case fitCover, fitContain, fitFill:
+	default:
+		return resizeSpec{}, errResize{"fit is cover, contain or fill"}
+	}
+	switch s.crop {
+	case "":
+		s.crop = cropCenter
+	case cropCenter, cropTop, cropSmart:
+	default:
+		return resizeSpec{}, errResize{"crop is center, top or smart"}
+	}
+	if s.w == 0 || s.h == 0 {
+		s.fit = fitContain
+	}
+	if s.fit != fitCover {
+		s.crop = ""
+	}
+	return s, nil
+}
+
+// suffix is the variant key, e.g. _r400x0_contain or _r256x256_cover_smart
+func (s resizeSpec) suffix() string {
+	suffix := fmt.Sprintf("%s%dx%d_%s", resizePrefix, s.w, s.h, s.fit)
+	if s.crop != "" {
+		suffix += "_" + s.crop
+	}
+	return suffix
+}
+
+// resizeImage does what s asks for. contain does not make an image
+// any bigger, cover and fill do as they have to come out at w by h
+func resizeImage(img image.Image, s resizeSpec) image.Image {
+	b := img.Bounds()
+	switch {
+	case s.fit == fitContain:
+		w, h := s.w, s.h
+		if w == 0 {
+			w = b.Dx()
+		}
+		if h == 0 {
+			h = b.Dy()
+		}
+		return resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
+	case s.fit == fitFill:
+		return resize.Resize(uint(s.w), uint(s.h), img, resize.Lanczos3)
+	}
+
+	// cover: scale to cover w by h, then cut off what sticks out
+	scale := math.Max(float64(s.w)/float64(b.Dx()), float64(s.h)/float64(b.Dy()))
+	sw := maxInt(s.w, int(math.Ceil(float64(b.Dx())*scale)))
+	sh := maxInt(s.h, int(math.Ceil(float64(b.Dy())*scale)))
+	scaled := resize.Resize(uint(sw), uint(sh), img, resize.Lanczos3)
+
+	at := image.Point{(sw - s.w) / 2, (sh - s.h) / 2}
+	switch s.crop {
+	case cropTop:
+		at.Y = 0
+	case cropSmart:
+		at = smartCrop(scaled, s.w, s.h)
+	}
+	cropped, err := cutter.Crop(scaled, cutter.Config{
+		Width: s.w, Height: s.h,
+		Anchor: scaled.Bounds().Min.Add(at),
+		Mode:   cutter.TopLeft,
+	})
+	if err != nil {
+		return scaled
+	}
+	return cropped
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// smartCrop is where a w by h window over img has the most edges.
+// img covers w by h, so it only sticks out one way
+func smartCrop(img image.Image, w, h int) image.Point {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+
+	horizontal := b.Dx() > w
+	length, window := b.Dy(), h
+	if horizontal {
+		length, window = b.Dx(), w
+	}
+	// the edges in each column, or row
+	energy := make([]int64, length)
+	for y := 1; y < b.Dy(); y++ {
+		for x := 1; x < b.Dx(); x++ {
+			i := gray.PixOffset(x, y)
+			p := int64(gray.Pix[i])
+			e := abs64(p-int64(gray.Pix[i-1])) + abs64(p-int64(gray.Pix[i-gray.Stride]))
+			if horizontal {
+				energy[x] += e
+			} else {
+				energy[y] += e
+			}
+		}
+	}
+	best, bestAt := int64(-1), 0
+	sum := int64(0)
+	for i := 0; i < length; i++ {
+		sum += energy[i]
+		if i >= window {
+			sum -= energy[i-window]
+		}
+		if i >= window-1 && sum > best {
+			best, bestAt = sum, i-window+1
+		}
+	}
+	if horizontal {
+		return image.Point{bestAt, 0}
+	}
+	return image.Point{0, bestAt}
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// resizer generates the variant s asks for, like those in jobKinds
+func resizer(s resizeSpec) func(string, [32]byte, io.ReadCloser) error {
+	return func(muid string, nonce [32]byte, reader io.ReadCloser) error {
+		defer reader.Close()
+		img, transparent, err := decodeImage(reader)
+		if err != nil {
+			return err
+		}
+		return postVariant(muid, s.suffix(), nonce, resizeImage(img, s), transparent)
+	}
+}
+
+// resizes being made, requests for the same one wait for it. A resize
+// is in flight until it is done, even after whoever asked for it has
+// given up on it, so that it is never made twice at once
+var resizing = struct {
+	sync.Mutex
+	inFlight map[string]*resizeFlight
+}{inFlight: map[string]*resizeFlight{}}
+
+type resizeFlight struct {
+	done chan struct{}
+	err  error
+}
+
+var errResizeFailed = errors.New("Could not resize")
+
+// resizedVariant is the variant s asks for, made first if there is none
+func resizedVariant(blob Blob, s resizeSpec) (Variant, error) {
+	suffix := s.suffix()
+	if v := DB.getVariant(blob.ID, suffix); v.Muid != "" {
+		return v, nil
+	}
+	key := blob.ID + suffix
+	resizing.Lock()
+	f, ok := resizing.inFlight[key]
+	if !ok {
+		f = &resizeFlight{done: make(chan struct{})}
+		resizing.inFlight[key] = f
+	}
+	resizing.Unlock()
+	finish := func(err error) {
+		resizing.Lock()
+		delete(resizing.inFlight, key)
+		resizing.Unlock()
+		f.err = err
+		close(f.done)
+	}
+
+	if !ok {
+		err := runImageWork(func() (err error) {
+			defer func() { finish(err) }()
+			return fromStore(blob, resizer(s))
+		})
+		// busy is the one error the work was never started on
+		if err == errImageBusy {
+			finish(err)
+		}
+		if err != nil {
+			return Variant{}, err
+		}
+	} else {
+		select {
+		case <-f.done:
+		case <-time.After(imageTimeout()):
+			return Variant{}, errImageTimeout
+		}
+		if f.err != nil {
+			return Variant{}, f.err
+		}
+	}
+	v := DB.getVariant(blob.ID, suffix)
+	if v.Muid == "" {
+		return Variant{}, errResizeFailed
+	}
+	return v, nil
+}
+
+// blobVariants are the suffixes of all the variants a blob can have
+// stored: the thumbnails, and whatever resizes were made of it
+func blobVariants(muid string) []string {
+	suffixes := append([]string{}, variantSuffixes...)
+	for _, v := range DB.getVariants(muid) {
+		if strings.HasPrefix(v.Suffix, resizePrefix) {
+			suffixes = append(suffixes, v.Suffix)
+		}
+	}
+	return suffixes
+}
+
+// warmResizes makes the resizes of a blob that are not there yet
+func warmResizes(blob Blob, specs []resizeSpec) error {
+	for _, s := range specs {
+		if _, err := resizedVariant(blob, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseResizeSpecs reads sizes like 400x0 or 256x256:cover:smart
+func parseResizeSpecs(args []string) ([]resizeSpec, error) {
+	specs := []resizeSpec{}
+	for _, arg := range args {
+		parts := strings.Split(arg, ":")
+		wh := strings.SplitN(parts[0], "x", 2)
+		q := url.Values{}
+		if len(wh) != 2 {
+			return nil, errResize{fmt.Sprintf("%s is not WxH", arg)}
+		}
+		if wh[0] != "0" {
+			q.Set("w", wh[0])
+		}
+		if wh[1] != "0" {
+			q.Set("h", wh[1])
+		}
+		if len(parts) > 1 {
+			q.Set("fit", parts[1])
+		}
+		if len(parts) > 2 {
+			q.Set("crop", parts[2])
+		}
+		s, err := parseResize(q)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
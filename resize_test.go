@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/url"
+	"testing"
+)
+
+func TestParseResize(t *testing.T) {
+	for query, want := range map[string]string{
+		"w=256&h=256":                      "_r256x256_cover_center",
+		"w=256&h=128&fit=cover&crop=smart": "_r256x128_cover_smart",
+		"w=256&h=128&fit=contain&crop=top": "_r256x128_contain",
+		"w=400":                            "_r400x0_contain",
+		"h=400&fit=fill&crop=smart":        "_r0x400_contain",
+		"w=257":                            "",
+		"w=256&h=256&fit=stretch":          "",
+		"w=256&h=256&crop=left":            "",
+		"w=big":                            "",
+	} {
+		q, _ := url.ParseQuery(query)
+		s, err := parseResize(q)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: %s", query, s.suffix())
+			}
+			continue
+		}
+		if err != nil || s.suffix() != want {
+			t.Errorf("%s: %s %v", query, s.suffix(), err)
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for _, c := range []struct {
+		spec resizeSpec
+		size image.Point
+	}{
+		{resizeSpec{w: 50, h: 50, fit: fitCover, crop: cropCenter}, image.Point{50, 50}},
+		{resizeSpec{w: 50, h: 50, fit: fitContain}, image.Point{50, 25}},
+		{resizeSpec{w: 50, h: 50, fit: fitFill}, image.Point{50, 50}},
+		{resizeSpec{w: 400, fit: fitContain}, image.Point{200, 100}},
+		{resizeSpec{h: 50, fit: fitContain}, image.Point{100, 50}},
+	} {
+		if got := resizeImage(img, c.spec).Bounds().Size(); got != c.size {
+			t.Errorf("%s: %v, want %v", c.spec.suffix(), got, c.size)
+		}
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	// flat but for a checkerboard at 70 to 80
+	img := image.NewGray(image.Rect(0, 0, 100, 10))
+	for y := 0; y < 10; y++ {
+		for x := 70; x < 80; x++ {
+			if (x+y)%2 == 0 {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	at := smartCrop(img, 20, 10)
+	if at.Y != 0 || at.X < 60 || at.X > 70 {
+		t.Errorf("cropped at %v", at)
+	}
+}
@@ -1,22 +1,20 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/jwtauth"
 	"github.com/rs/cors"
-	"golang.org/x/crypto/blake2b"
 
 	"github.com/stakwork/sphinx-meme/auth"
 	"github.com/stakwork/sphinx-meme/ecdsa"
@@ -39,6 +37,7 @@ func initRouter() *chi.Mux {
 		r.Get("/ask", ask)
 		r.Post("/verify", verify)
 		r.Get("/search/{searchTerm}", search) // do not return total_sats or total_buys
+		r.Get("/similar/{muid}", getSimilar)
 	})
 
 	r.Group(func(r chi.Router) {
@@ -51,6 +50,12 @@ func initRouter() *chi.Mux {
 		r.Get("/manifest.json", frontend.ManifestRoute)
 
 		r.Get("/public/{muid}", getPublicMedia)
+
+		r.Options("/tus", tusOptions)
+
+		// presigned urls carry their own signature
+		r.Put("/signed/upload/{id}", signedUpload)
+		r.Get("/signed/media/{owner}/{muid}", signedMedia)
 	})
 
 	// route for getting media files
@@ -63,11 +68,16 @@ func initRouter() *chi.Mux {
 		r.Use(auth.PubKeyContext)
 
 		r.Get("/mymedia", getMyMedia)              // only owner
+		r.Get("/usage", getUsage)                  // only owner
 		r.Get("/mymedia/{muid}", getMyMediaByMUID) // only owner
+		r.Get("/mymedia/{muid}/status", getMyMediaStatus)
 		r.Get("/media/{muid}", getMediaByMUID)
 		r.Get("/template/{muid}", getTemplate)
 		r.Get("/templates", getTemplates)
 		r.Get("/file/{token}", getMedia)
+		r.Get("/presign/download/{token}", presignDownload)
+		r.Get("/cache/stats", getCacheStats)
+		r.With(lsat.GetMaxUploadSizeContext).Post("/similar", searchByImage)
 	})
 
 	// route for updating or adding media files
@@ -80,10 +90,19 @@ func initRouter() *chi.Mux {
 		r.Use(auth.NotReadOnlyContext)
 		r.Use(lsat.GetMaxUploadSizeContext)
 
-		r.Post("/file", uploadEncryptedFile)
-		r.Post("/public", uploadPublic)
-		r.Post("/template", uploadTemplate)
-		r.Put("/purchase/{muid}", mediaPurchase) // from owners relay node to update stats (and check current price)
+		r.With(quotaContext).Post("/file", uploadEncryptedFile)
+		r.With(quotaContext).Post("/public", uploadPublic)
+		r.With(quotaContext).Post("/template", uploadTemplate)
+		r.With(quotaContext).Post("/template/{muid}/render", renderTemplate)
+		r.With(quotaContext).Post("/gif", makeGif)
+		r.With(quotaContext).Post("/tus", tusCreate)
+		r.Head("/tus/{id}", tusHead)
+		r.Patch("/tus/{id}", tusPatch)
+		r.Delete("/tus/{id}", tusDelete)
+		r.With(quotaContext).Post("/presign/upload", presignUpload)
+		r.Post("/presign/upload/{id}/finalize", presignFinalize)
+		r.Put("/purchase/{muid}", mediaPurchase)   // from owners relay node to update stats (and check current price)
+		r.Delete("/mymedia/{muid}", deleteMyMedia) // only owner
 	})
 
 	// a set of middleware and a route for size restricted
@@ -100,7 +119,24 @@ func initRouter() *chi.Mux {
 		r.Use(lsat.GetMaxUploadSizeContextLarge)
 		// we're segregating the upload paths for now
 		// so this will be for large files that require payment
-		r.Post("/largefile", uploadEncryptedFile)
+		r.With(quotaContext).Post("/largefile", uploadEncryptedFile)
+	})
+
+	// creating a large tus or presigned upload goes through the same lsat
+	// checks, against its Upload-Length. Its chunks then go to /tus/{id}.
+	// The JWT comes in the query, the Authorization header is the LSAT
+	r.Group(func(r chi.Router) {
+		r.Use(auth.Verifier(auth.TokenAuth))
+		r.Use(jwtauth.Authenticator)
+		r.Use(auth.HostContext)
+		r.Use(auth.PubKeyContext)
+		r.Use(auth.NotReadOnlyContext)
+		r.Use(lsat.LsatContext)
+		r.Use(lsat.VerifyUploadContext)
+		r.Use(lsat.SetMaxUploadValue)
+		r.Use(lsat.GetMaxUploadSizeContextLarge)
+		r.With(quotaContext).Post("/tus/large", tusCreate)
+		r.With(quotaContext).Post("/presign/upload/large", presignUpload)
 	})
 
 	return r
@@ -117,33 +153,27 @@ func getPodcast(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(latest)
 }
 
+func getCacheStats(w http.ResponseWriter, r *http.Request) {
+	if storage.Cache == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("No cache")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(storage.Cache.Stats())
+}
+
 func getTemplate(w http.ResponseWriter, r *http.Request) {
 
 	muid := chi.URLParam(r, "muid")
 
 	media := DB.getMediaWithDimensionsByMuid(muid)
-
-	nonceBytes, err := hex.DecodeString(media.Nonce)
-	var nonce [32]byte
-	if err == nil {
-		copy(nonce[:], nonceBytes)
-	}
-
-	reader, err := storage.Store.GetReader(muid, nonce)
-	if err != nil {
-		fmt.Println(err)
-		fmt.Println("File not found")
-		w.WriteHeader(http.StatusNotFound)
+	if isExpired(media) {
+		w.WriteHeader(http.StatusGone)
 		return
 	}
-	defer reader.Close()
 
-	fmt.Println("")
-	contentDisposition := fmt.Sprintf("attachment; filename=%s", media.Filename)
-	w.Header().Set("Content-Disposition", contentDisposition)
-	w.Header().Set("Content-Type", media.Mime)
-	w.Header().Set("Content-Length", strconv.Itoa(int(media.Size)))
-	io.Copy(w, reader)
+	serveMedia(w, r, muid, DB.getBlob(muid), media, media.Size)
 }
 
 func getPublicMedia(w http.ResponseWriter, r *http.Request) {
@@ -151,40 +181,81 @@ func getPublicMedia(w http.ResponseWriter, r *http.Request) {
 	muid := chi.URLParam(r, "muid")
 
 	media := DB.getMediaByMUID(muid)
-
-	nonceBytes, err := hex.DecodeString(media.Nonce)
-	var nonce [32]byte
-	if err == nil {
-		copy(nonce[:], nonceBytes)
+	if isExpired(media) {
+		w.WriteHeader(http.StatusGone)
+		return
 	}
 
 	thumb := r.URL.Query().Get("thumb")
 	medium := r.URL.Query().Get("medium")
 
 	themuid := muid
+	size := media.Size
+	suffix := ""
 	if thumb == "true" {
-		themuid = muid + "_thumb"
+		suffix = thumbSuffix
 	}
 	if medium == "true" {
-		themuid = muid + "_medium"
+		suffix = mediumSuffix
+	}
+	if suffix != "" {
+		themuid = muid + suffix
+		// variants from before their size was
+		// recorded can not be served in ranges
+		media.Mime = legacyVariantMime
+		size = -1
+		if v := DB.getVariant(muid, suffix); v.Muid != "" {
+			media.Mime = v.Mime
+			size = v.Size
+		}
+	}
+	blob := DB.getBlob(muid)
+	if suffix == "" && isResize(r.URL.Query()) && media.ID != "" && blob.ID != "" {
+		v, ok := resizeMedia(w, r, media, blob)
+		if !ok {
+			return
+		}
+		themuid = muid + v.Suffix
+		media.Mime = v.Mime
+		size = v.Size
 	}
-
 	fmt.Println(themuid)
-	reader, err := storage.Store.GetReader(themuid, nonce)
+	serveMedia(w, r, themuid, blob, media, size)
+}
+
+// resizeMedia is the variant the ?w=&h=&fit=&crop= of the request asks
+// for, made now if it is not there yet. Otherwise it answers the request
+func resizeMedia(w http.ResponseWriter, r *http.Request, media Media, blob Blob) (Variant, bool) {
+	spec, err := parseResize(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err.Error())
+		return Variant{}, false
+	}
+	if !strings.HasPrefix(media.Mime, "image/") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode("Only images can be resized")
+		return Variant{}, false
+	}
+	// variants are always written encrypted
+	if !blob.Encrypted {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode("Not resized until encrypt-at-rest has run")
+		return Variant{}, false
+	}
+	v, err := resizedVariant(blob, spec)
 	if err != nil {
 		fmt.Println(err)
-		fmt.Println("File not found")
-		w.WriteHeader(http.StatusNotFound)
-		return
+		if status, ok := imageErrorStatus(err); ok {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(err.Error())
+			return Variant{}, false
+		}
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(errResizeFailed.Error())
+		return Variant{}, false
 	}
-	defer reader.Close()
-
-	fmt.Println("")
-	contentDisposition := fmt.Sprintf("attachment; filename=%s", media.Filename)
-	w.Header().Set("Content-Disposition", contentDisposition)
-	w.Header().Set("Content-Type", media.Mime)
-	// w.Header().Set("Content-Length", strconv.Itoa(int(media.Size)))
-	io.Copy(w, reader)
+	return v, true
 }
 
 func getTemplates(w http.ResponseWriter, r *http.Request) {
@@ -208,6 +279,9 @@ func getMyMedia(w http.ResponseWriter, r *http.Request) {
 func search(w http.ResponseWriter, r *http.Request) {
 	searchTerm := chi.URLParam(r, "searchTerm")
 	medias := DB.searchMedia(searchTerm)
+	if collapse, _ := strconv.ParseBool(r.URL.Query().Get("collapse")); collapse {
+		medias = collapseSimilar(medias)
+	}
 
 	ms := []Media{}
 	for _, m := range medias { // hidden vals
@@ -252,6 +326,64 @@ func getMyMediaByMUID(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(media)
 }
 
+// lets apps poll until an upload's derivatives
+// are made, the original is readable right away
+func getMyMediaStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pubKey := ctx.Value(auth.ContextKey).(string)
+
+	muid := chi.URLParam(r, "muid")
+
+	media := DB.getMyMediaByMUID(pubKey, muid)
+	if media.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("Media not found")
+		return
+	}
+	status := map[string]string{
+		"muid":   media.ID,
+		"status": media.Status,
+	}
+	if media.Status == mediaFailed || media.Status == mediaRejected {
+		status["reason"] = DB.getJobError(muid)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// removes the caller's row. The original and its variants
+// go with the last owner of the same content
+func deleteMyMedia(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pubKey := ctx.Value(auth.ContextKey).(string)
+
+	muid := chi.URLParam(r, "muid")
+
+	media := DB.getMyMediaByMUID(pubKey, muid)
+	if media.ID == "" {
+		if DB.getMediaByMUID(muid).ID != "" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode("Not the owner")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("Media not found")
+		return
+	}
+
+	err := DB.releaseMedia(muid, pubKey, false, func() error {
+		return deleteBlobs(muid)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode("Could not delete file")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(media.ID)
+}
+
 func getMediaByMUID(w http.ResponseWriter, r *http.Request) {
 	muid := chi.URLParam(r, "muid")
 
@@ -268,20 +400,21 @@ func getMediaByMUID(w http.ResponseWriter, r *http.Request) {
 }
 
 func uploadEncryptedFile(w http.ResponseWriter, r *http.Request) {
-	uploadFile(w, r, false, false, false)
+	uploadFile(w, r, uploadKindFile)
 }
 
 func uploadTemplate(w http.ResponseWriter, r *http.Request) {
-	uploadFile(w, r, true, false, false)
+	uploadFile(w, r, uploadKindTemplate)
 }
 
 func uploadPublic(w http.ResponseWriter, r *http.Request) {
-	uploadFile(w, r, false, true, true)
+	uploadFile(w, r, uploadKindPublic)
 }
 
-// UploadFile uploads a file of any type
-// need a "name" of "file"
-func uploadFile(w http.ResponseWriter, r *http.Request, measureDimensions bool, thumb bool, medium bool) {
+// UploadFile uploads a file of whatever types the kind allows
+// need a "name" of "file". Templates are measured, public
+// images get a thumbnail and a medium size one
+func uploadFile(w http.ResponseWriter, r *http.Request, kind string) {
 	ctx := r.Context()
 	pubKey := ctx.Value(auth.ContextKey).(string)
 	fmt.Println("File Upload ===> ")
@@ -295,114 +428,150 @@ func uploadFile(w http.ResponseWriter, r *http.Request, measureDimensions bool,
 	// https://pkg.go.dev/net/http#MaxBytesReader
 	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE)
 
-	if err := r.ParseMultipartForm(MAX_UPLOAD_SIZE); err != nil {
-		fmt.Println("err:", err)
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		json.NewEncoder(w).Encode("File too big")
-		return
-	}
-
-	// FormFile returns the first file for the given key `file`
-	// it also returns the FileHeader so we can get the Filename,
-	// the Header and the size of the file
-	file, handler, err := r.FormFile("file")
-
-	// in case other size checks fail
-	if handler.Size > MAX_UPLOAD_SIZE {
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		json.NewEncoder(w).Encode("File too big")
-		return
-	}
-
+	// the multipart body is read part by part, and the file part
+	// goes straight to the store instead of into memory or temp files
+	mr, err := r.MultipartReader()
 	if err != nil {
 		fmt.Println("Error Retrieving the File")
 		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode("Error Retrieving the File")
 		return
 	}
-	defer file.Close()
 
-	p := uploadParams{}
-	decodeForm(r.Form, &p)
-	if p.TTL == 0 { // default to one year
-		p.TTL = 60 * 60 * 24 * 365
-	}
-
-	filename := handler.Filename
-	if filename == "" {
-		filename = "file"
-	}
+	form := r.URL.Query()
+	var stored *storedUpload
+	var nonce [32]byte
+	filename := ""
 	contentType := "application/octet-stream"
-	contentTypes := handler.Header["Content-Type"]
-	if len(contentTypes) > 0 {
-		contentType = contentTypes[0]
+	metadata := metadataKept
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("err:", err)
+			if isTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode("File too big")
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode("Error Retrieving the File")
+			return
+		}
+
+		if part.FormName() != "file" || stored != nil {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+			if err != nil {
+				fmt.Println("err:", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			form.Add(part.FormName(), string(value))
+			continue
+		}
+
+		filename = part.FileName()
+		// an lsat caps the file itself, not the framing around it
+		var file io.Reader = part
+		if max, ok := ctx.Value(lsat.MaxFileSizeContextKey).(int64); ok {
+			file = http.MaxBytesReader(w, part, max)
+		}
+		src, verified, err := sniffUpload(file, part.Header.Get("Content-Type"), kind)
+		if err != nil {
+			fmt.Println(err)
+			if isMimeError(err) {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				json.NewEncoder(w).Encode(err.Error())
+				return
+			}
+			if isTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode("File too big")
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode("Error Retrieving the File")
+			return
+		}
+		contentType = verified
+		// metadata is dealt with as the file goes by, so a strip_metadata
+		// form field has to come before the file
+		metadata = metadataKept
+		if wantsStripped(kind, form) {
+			stripped, ok := stripMetadata(src, contentType)
+			defer stripped.Close()
+			if ok {
+				src, metadata = stripped, metadataStripped
+			}
+		}
+		nonce, _ = storage.Store.GenNonce()
+		s, err := storeUpload(src, contentType, nonce, kind == uploadKindTemplate)
+		if err != nil {
+			fmt.Println(err)
+			if isTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode("File too big")
+				return
+			}
+			if isMimeError(err) {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				json.NewEncoder(w).Encode(err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode("Error Storing the File")
+			return
+		}
+		stored = &s
 	}
 
-	imageWidth := 0
-	imageHeight := 0
-	if measureDimensions {
-		imageWidth, imageHeight = getImageDimension(file)
+	if stored == nil {
+		fmt.Println("Error Retrieving the File")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Error Retrieving the File")
+		return
 	}
 
-	var buf bytes.Buffer
-	hasher, _ := blake2b.New256(nil) // hash it
-	length, err := io.Copy(&buf, io.TeeReader(file, hasher))
+	media, err := mediaFromForm(pubKey, form, filename, contentType)
 	if err != nil {
-		fmt.Println(err)
+		storage.Store.Delete(stored.staging)
 		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err.Error())
 		return
 	}
-	hash := hasher.Sum(nil)
-	defer file.Close()
-
-	nonce, _ := storage.Store.GenNonce()
-	nonceString := hex.EncodeToString(nonce[:])
-	now := time.Now()
-	media := Media{
-		ID:          base64.URLEncoding.EncodeToString(hash[:]),
-		OwnerPubKey: pubKey,
-		Name:        p.Name,
-		Description: p.Description,
-		Tags:        p.Tags,
-		Size:        handler.Size,
-		Filename:    filename,
-		Mime:        contentType,
-		Nonce:       nonceString,
-		TTL:         p.TTL,
-		Price:       p.Price,
-		Created:     &now,
-		Updated:     &now,
-		TotalBuys:   0,
-		TotalSats:   0,
-		Width:       imageWidth,
-		Height:      imageHeight,
-	}
+	public := kind == uploadKindPublic
+	stored.applyTo(&media)
+	media.Metadata = metadata
+	media.Public = public
 	fmt.Printf("MEDIA: %+v\n", media)
 
-	created, err := DB.createMedia(media)
+	created, _, err := saveUpload(*stored, nonce, media, derivativeJobs(media.Mime, public, public))
 	if err != nil {
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(err.Error())
 		return
 	}
 
-	if thumb {
-		go uploadThumb(media.ID, nonce, ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
-	}
-
-	if medium {
-		go uploadMediumSizePic(media.ID, nonce, ioutil.NopCloser(bytes.NewReader(buf.Bytes())))
-	}
-
-	path := media.ID
-	go storage.Store.PostReader(path, &buf, length, contentType, nonce)
-
-	fmt.Println(length)
+	fmt.Println(stored.size)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(created)
 }
 
 func getMedia(w http.ResponseWriter, r *http.Request) {
+	media, ok := authorizeMedia(w, r)
+	if !ok {
+		return
+	}
+	fmt.Printf("GET: %s\n", media.ID)
+	serveMedia(w, r, media.ID, DB.getBlob(media.ID), media, media.Size)
+}
+
+// authorizeMedia checks the mediaToken in the url, and answers
+// the request itself when it does not give access to the media
+func authorizeMedia(w http.ResponseWriter, r *http.Request) (Media, bool) {
 	ctx := r.Context()
 	mypubkey, _ := ctx.Value(auth.ContextKey).(string)
 	host, _ := ctx.Value(auth.ContextHost).(string)
@@ -412,7 +581,7 @@ func getMedia(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Println("Error parsing terms")
 		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return Media{}, false
 	}
 
 	fmt.Println(parsed.Terms)
@@ -423,26 +592,28 @@ func getMedia(w http.ResponseWriter, r *http.Request) {
 	if muid == "" || host == "" {
 		fmt.Println("No MUID")
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return Media{}, false
 	}
 
 	if host != terms.Host {
 		fmt.Println("Wrong Host")
 		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return Media{}, false
 	}
 
 	exp := terms.Exp
 	if exp < time.Now().Unix() {
 		fmt.Println("Access Expired")
 		w.WriteHeader(http.StatusGone)
-		return
+		return Media{}, false
 	}
 
-	media := DB.getMediaByMUID(muid)
-	if media.ID == "" {
+	// several owners can share a muid: the caller's own row
+	// needs no token, otherwise the token's signer must own one
+	owners := DB.getMediaOwners(muid)
+	if len(owners) == 0 {
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return Media{}, false
 	}
 
 	// BuyerPubKey is optional
@@ -450,61 +621,44 @@ func getMedia(w http.ResponseWriter, r *http.Request) {
 		if mypubkey != terms.BuyerPubKey { // pubkey must match terms pubkey
 			fmt.Println("Wrong Buyer Pub Key")
 			w.WriteHeader(http.StatusUnauthorized)
-			return
+			return Media{}, false
 		}
 	}
 
-	nonceBytes, err := hex.DecodeString(media.Nonce)
-	var nonce [32]byte
-	if err == nil {
-		copy(nonce[:], nonceBytes)
+	media := Media{}
+	for _, m := range owners {
+		if m.OwnerPubKey == mypubkey {
+			media = m
+			break
+		}
 	}
 
 	// the following logic is for non-owners (owner dont need token)
-	if media.OwnerPubKey != mypubkey {
-
+	if media.ID == "" {
 		bytesToVerify := parsed.Bytes
 		bytes64 := base64.URLEncoding.EncodeToString(bytesToVerify)
 
-		_, valid, err := ecdsa.VerifyAndExtract(bytes64, sig, media.OwnerPubKey)
-		if !valid || err != nil {
+		for _, m := range owners {
+			_, valid, err := ecdsa.VerifyAndExtract(bytes64, sig, m.OwnerPubKey)
+			if valid && err == nil {
+				media = m
+				break
+			}
+		}
+		if media.ID == "" {
 			fmt.Println("Cant Verify")
 			w.WriteHeader(http.StatusUnauthorized)
-			return
+			return Media{}, false
 		}
-
-	}
-
-	fmt.Printf("GET: %s\n", muid)
-	reader, err := storage.Store.GetReader(muid, nonce)
-	if err != nil {
-		fmt.Println(err)
-		fmt.Println("File not found")
-		w.WriteHeader(http.StatusNotFound)
-		return
 	}
-	defer reader.Close()
 
-	contentDisposition := fmt.Sprintf("attachment; filename=%s", media.Filename)
-	w.Header().Set("Content-Disposition", contentDisposition)
-	w.Header().Set("Content-Type", media.Mime)
-	w.Header().Set("Content-Length", strconv.Itoa(int(media.Size)))
-	io.Copy(w, reader)
-}
-
-// NOT USED yet:
-
-func deleteFile(w http.ResponseWriter, r *http.Request) {
-
-	err := storage.Store.Delete("/deleteme")
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if isExpired(media) {
+		fmt.Println("Media Expired")
+		w.WriteHeader(http.StatusGone)
+		return Media{}, false
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode("deleteme")
+	return media, true
 }
 
 func initChi() *chi.Mux {
@@ -514,9 +668,9 @@ func initChi() *chi.Mux {
 	r.Use(middleware.Recoverer)
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-User", "authorization"},
-		ExposedHeaders:   []string{"Content-Disposition"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "HEAD", "PATCH"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-User", "authorization", "Range", "If-Range", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposedHeaders:   []string{"Content-Disposition", "Content-Range", "Accept-Ranges", "ETag", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-Muid"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 		//Debug:            true,
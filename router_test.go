@@ -0,0 +1,1313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/minio/sio"
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stakwork/sphinx-meme/auth"
+	"github.com/stakwork/sphinx-meme/ecdsa"
+	"github.com/stakwork/sphinx-meme/ldat"
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+const testHost = "memes.test"
+
+// newTestServer runs the router against the memory store and memDB,
+// nothing outside the process is needed
+func newTestServer(t *testing.T) (*httptest.Server, *memDB) {
+	t.Setenv("JWT_KEY", "test jwt key")
+	t.Setenv("HOST", testHost)
+	t.Setenv("STORAGE_MODE", "memory")
+	t.Setenv("ENCRYPTION_KEY", "6368616e676520746869732070617373776f726420746f206120736563726574")
+	t.Setenv("CACHE_DIR", "")
+	auth.Init()
+	storage.Init()
+	db := newMemDB()
+	DB = db
+	server := httptest.NewServer(initRouter())
+	t.Cleanup(server.Close)
+	return server, db
+}
+
+type testUser struct {
+	key    *btcec.PrivateKey
+	pubKey string // as in the JWT, base64
+	token  string
+}
+
+func newTestKey(t *testing.T) *btcec.PrivateKey {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func pubKeyOf(key *btcec.PrivateKey) string {
+	return base64.URLEncoding.EncodeToString(key.PubKey().SerializeCompressed())
+}
+
+func login(t *testing.T, server *httptest.Server) testUser {
+	key := newTestKey(t)
+	res, err := http.Get(server.URL + "/ask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := map[string]string{}
+	json.NewDecoder(res.Body).Decode(&challenge)
+	res.Body.Close()
+
+	res, err = http.PostForm(server.URL+"/verify", url.Values{
+		"id":     {challenge["id"]},
+		"sig":    {ecdsa.Sign(challenge["challenge"], key)},
+		"pubkey": {hex.EncodeToString(key.PubKey().SerializeCompressed())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("verify: %d", res.StatusCode)
+	}
+	token := map[string]string{}
+	json.NewDecoder(res.Body).Decode(&token)
+	return testUser{key: key, pubKey: pubKeyOf(key), token: token["token"]}
+}
+
+// mediaToken is the token an owner hands out for a muid, for
+// anyone or for buyer only
+func mediaToken(t *testing.T, owner *btcec.PrivateKey, muid, buyer string, exp time.Time) string {
+	start, err := ldat.Start(testHost, muid, buyer, uint32(exp.Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ldat.Parse(start + "AA==") // a placeholder sig
+	if err != nil {
+		t.Fatal(err)
+	}
+	return start + ecdsa.Sign(base64.URLEncoding.EncodeToString(parsed.Bytes), owner)
+}
+
+func request(t *testing.T, method, url, token string, body []byte, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, _ := ioutil.ReadAll(res.Body)
+	return res, got
+}
+
+// postFile sends contents as the file part, declared as contentType
+func postFile(t *testing.T, server *httptest.Server, route, token, contentType string, contents []byte, fields map[string]string) (*http.Response, []byte) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="meme"`)
+	header.Set("Content-Type", contentType)
+	part, _ := mw.CreatePart(header)
+	part.Write(contents)
+	mw.Close()
+
+	return request(t, "POST", server.URL+route, token, body.Bytes(), http.Header{
+		"Content-Type": {mw.FormDataContentType()},
+	})
+}
+
+func upload(t *testing.T, server *httptest.Server, route, token string, contents []byte, fields map[string]string) Media {
+	res, got := postFile(t, server, route, token, "application/octet-stream", contents, fields)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("upload to %s: %d %s", route, res.StatusCode, got)
+	}
+	m := Media{}
+	if err := json.Unmarshal(got, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// previewed runs the preview job of an uploaded image, as the job
+// queue would, and gives back its row with the preview
+func previewed(t *testing.T, m Media) Media {
+	if err := runJob(Job{Kind: jobPreview, Muid: m.ID}); err != nil {
+		t.Fatalf("preview of %s: %v", m.ID, err)
+	}
+	return DB.getMyMediaByMUID(m.OwnerPubKey, m.ID)
+}
+
+func pngOf(t *testing.T, width, height int) []byte {
+	buf := &bytes.Buffer{}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func muidFor(contents []byte) string {
+	hash := blake2b.Sum256(contents)
+	return base64.URLEncoding.EncodeToString(hash[:])
+}
+
+func TestAskVerify(t *testing.T) {
+	server, _ := newTestServer(t)
+	user := login(t, server)
+	if user.token == "" {
+		t.Fatal("no token")
+	}
+	res, _ := request(t, "GET", server.URL+"/mymedia", user.token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("token not accepted: %d", res.StatusCode)
+	}
+	res, _ = request(t, "GET", server.URL+"/mymedia", "", nil, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no token: %d", res.StatusCode)
+	}
+
+	// signed by another key than the pubkey claimed
+	id := strconv.FormatInt(time.Now().Unix(), 10)
+	ts := url.Values{}
+	ts.Set("id", id)
+	ts.Set("sig", ecdsa.Sign(base64.URLEncoding.EncodeToString([]byte(id)), newTestKey(t)))
+	ts.Set("pubkey", hex.EncodeToString(user.key.PubKey().SerializeCompressed()))
+	res, err := http.PostForm(server.URL+"/verify", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("wrong key verified: %d", res.StatusCode)
+	}
+
+	// a challenge that is too old
+	old := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	ts.Set("id", old)
+	ts.Set("sig", ecdsa.Sign(base64.URLEncoding.EncodeToString([]byte(old)), user.key))
+	res, err = http.PostForm(server.URL+"/verify", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("old challenge verified: %d", res.StatusCode)
+	}
+}
+
+func TestUploadAndFile(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	buyer := login(t, server)
+	stranger := login(t, server)
+
+	contents := []byte("a meme for sale\n")
+	m := upload(t, server, "/file", owner.token, contents, map[string]string{
+		"name":  "for sale",
+		"price": "100",
+	})
+	if m.ID != muidFor(contents) || m.Size != int64(len(contents)) || m.Price != 100 {
+		t.Fatalf("uploaded %+v", m)
+	}
+	// stored encrypted
+	stored, err := storage.Memory.GetReader(m.ID, [32]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadAll(stored)
+	if bytes.Contains(raw, contents) {
+		t.Errorf("stored in plaintext")
+	}
+	if db.getBlob(m.ID).Refcount != 1 {
+		t.Errorf("blob %+v", db.getBlob(m.ID))
+	}
+
+	exp := time.Now().Add(time.Hour)
+	cases := []struct {
+		name   string
+		token  string
+		caller string
+		status int
+	}{
+		{"owner", mediaToken(t, owner.key, m.ID, "", exp), owner.token, http.StatusOK},
+		{"buyer", mediaToken(t, owner.key, m.ID, buyer.pubKey, exp), buyer.token, http.StatusOK},
+		{"not the buyer", mediaToken(t, owner.key, m.ID, buyer.pubKey, exp), stranger.token, http.StatusUnauthorized},
+		{"not signed by the owner", mediaToken(t, stranger.key, m.ID, "", exp), stranger.token, http.StatusUnauthorized},
+		{"expired", mediaToken(t, owner.key, m.ID, "", time.Now().Add(-time.Minute)), buyer.token, http.StatusGone},
+		{"unknown muid", mediaToken(t, owner.key, muidFor([]byte("nope")), "", exp), buyer.token, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		res, got := request(t, "GET", server.URL+"/file/"+c.token, c.caller, nil, nil)
+		if res.StatusCode != c.status {
+			t.Errorf("%s: %d, want %d", c.name, res.StatusCode, c.status)
+			continue
+		}
+		if c.status == http.StatusOK && !bytes.Equal(got, contents) {
+			t.Errorf("%s: got %q", c.name, got)
+		}
+	}
+
+	// seeking
+	res, got := request(t, "GET", server.URL+"/file/"+cases[0].token, owner.token, nil, http.Header{
+		"Range": {"bytes=2-5"},
+	})
+	if res.StatusCode != http.StatusPartialContent || string(got) != string(contents[2:6]) {
+		t.Errorf("range: %d %q", res.StatusCode, got)
+	}
+
+	// the same bytes from someone else share the blob
+	again := upload(t, server, "/file", stranger.token, contents, nil)
+	if again.ID != m.ID || db.getBlob(m.ID).Refcount != 2 {
+		t.Errorf("not shared: %+v", db.getBlob(m.ID))
+	}
+	res, _ = request(t, "DELETE", server.URL+"/mymedia/"+m.ID, owner.token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("delete: %d", res.StatusCode)
+	}
+	res, got = request(t, "GET", server.URL+"/file/"+mediaToken(t, stranger.key, m.ID, "", exp), stranger.token, nil, nil)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(got, contents) {
+		t.Errorf("gone with the other owner: %d", res.StatusCode)
+	}
+}
+
+// only an owner can delete their media. Owners of the same bytes
+// share a blob, which goes once the last of them has deleted theirs
+func TestDeleteMedia(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	other := login(t, server)
+	stranger := login(t, server)
+
+	contents := []byte("a meme to delete\n")
+	m := upload(t, server, "/file", owner.token, contents, nil)
+	if db.getBlob(m.ID).Refcount != 1 {
+		t.Fatalf("blob %+v", db.getBlob(m.ID))
+	}
+	upload(t, server, "/file", other.token, contents, nil)
+	if db.getBlob(m.ID).Refcount != 2 {
+		t.Fatalf("re-upload did not count: %+v", db.getBlob(m.ID))
+	}
+
+	res, _ := request(t, "DELETE", server.URL+"/mymedia/"+m.ID, stranger.token, nil, nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("delete by a stranger: %d", res.StatusCode)
+	}
+	res, _ = request(t, "DELETE", server.URL+"/mymedia/"+muidFor([]byte("nope")), owner.token, nil, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("delete of unknown media: %d", res.StatusCode)
+	}
+	if db.getBlob(m.ID).Refcount != 2 {
+		t.Errorf("refused deletes changed the blob: %+v", db.getBlob(m.ID))
+	}
+
+	res, _ = request(t, "DELETE", server.URL+"/mymedia/"+m.ID, owner.token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %d", res.StatusCode)
+	}
+	if db.getBlob(m.ID).Refcount != 1 {
+		t.Errorf("delete did not count: %+v", db.getBlob(m.ID))
+	}
+	if _, err := storage.Memory.GetReader(m.ID, [32]byte{}); err != nil {
+		t.Errorf("shared file deleted: %v", err)
+	}
+	res, _ = request(t, "DELETE", server.URL+"/mymedia/"+m.ID, owner.token, nil, nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("deleting it again: %d", res.StatusCode)
+	}
+
+	res, _ = request(t, "DELETE", server.URL+"/mymedia/"+m.ID, other.token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete by the last owner: %d", res.StatusCode)
+	}
+	if b := db.getBlob(m.ID); b.ID != "" {
+		t.Errorf("blob left: %+v", b)
+	}
+	if _, err := storage.Memory.GetReader(m.ID, [32]byte{}); err == nil {
+		t.Errorf("file left in the store")
+	}
+	res, _ = request(t, "DELETE", server.URL+"/mymedia/"+m.ID, other.token, nil, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("delete once gone: %d", res.StatusCode)
+	}
+}
+
+// expired media is gone for everyone at once, and its files
+// are deleted once the reaper gets to it
+func TestExpiry(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+
+	contents := []byte("a meme for a day\n")
+	m := upload(t, server, "/file", owner.token, contents, map[string]string{
+		"expiry": strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10),
+	})
+	if m.Expiry == nil {
+		t.Fatalf("no expiry: %+v", m)
+	}
+	public := upload(t, server, "/public", owner.token, pngOf(t, 4, 3), nil)
+	token := mediaToken(t, owner.key, m.ID, "", time.Now().Add(time.Hour))
+	if res, _ := request(t, "GET", server.URL+"/file/"+token, owner.token, nil, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("before expiry: %d", res.StatusCode)
+	}
+
+	db.expire(m.ID, owner.pubKey)
+	db.expire(public.ID, owner.pubKey)
+	if res, _ := request(t, "GET", server.URL+"/file/"+token, owner.token, nil, nil); res.StatusCode != http.StatusGone {
+		t.Errorf("file after expiry: %d", res.StatusCode)
+	}
+	if res, _ := request(t, "GET", server.URL+"/public/"+public.ID, "", nil, nil); res.StatusCode != http.StatusGone {
+		t.Errorf("public after expiry: %d", res.StatusCode)
+	}
+
+	reapExpired()
+	for _, muid := range []string{m.ID, public.ID} {
+		if b := db.getBlob(muid); b.ID != "" {
+			t.Errorf("blob left after reaping: %+v", b)
+		}
+		if _, err := storage.Memory.GetReader(muid, [32]byte{}); err == nil {
+			t.Errorf("%s left in the store", muid)
+		}
+	}
+	if len(db.getExpiredMedia(10)) != 0 {
+		t.Errorf("reaped media still expiring")
+	}
+	if res, _ := request(t, "GET", server.URL+"/file/"+token, owner.token, nil, nil); res.StatusCode != http.StatusGone {
+		t.Errorf("file after reaping: %d", res.StatusCode)
+	}
+}
+
+// media is pending while its jobs are queued, and ready once they are
+// done. Content the jobs can not process is rejected right away, and
+// jobs that keep failing are given up on after jobMaxAttempts
+func TestJobStatus(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	status := func(muid string) map[string]string {
+		res, got := request(t, "GET", server.URL+"/mymedia/"+muid+"/status", owner.token, nil, nil)
+		s := map[string]string{}
+		if err := json.Unmarshal(got, &s); err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("status of %s: %d %s", muid, res.StatusCode, got)
+		}
+		return s
+	}
+	runJobs := func() {
+		db.dueJobs()
+		for db.runNextJob(runJob) {
+		}
+	}
+
+	public := upload(t, server, "/public", owner.token, pngOf(t, 4, 3), nil)
+	if s := status(public.ID); s["status"] != mediaPending {
+		t.Errorf("uploaded: %v", s)
+	}
+	runJobs()
+	if s := status(public.ID); s["status"] != mediaReady || s["reason"] != "" {
+		t.Errorf("jobs done: %v", s)
+	}
+	if len(db.jobs) != 0 {
+		t.Errorf("jobs left: %+v", db.jobs)
+	}
+
+	// too many pixels once the jobs run
+	tooBig := upload(t, server, "/public", owner.token, pngOf(t, 5, 5), nil)
+	t.Setenv("IMAGE_MAX_PIXELS", "20")
+	runJobs()
+	if s := status(tooBig.ID); s["status"] != mediaRejected || s["reason"] == "" {
+		t.Errorf("over the limit: %v", s)
+	}
+	for _, j := range db.jobs {
+		if j.State != jobRejected || j.Attempts != 1 {
+			t.Errorf("retried: %+v", j)
+		}
+	}
+
+	// a blob the jobs can not read fails every attempt
+	contents := pngOf(t, 3, 2)
+	m := upload(t, server, "/public", owner.token, contents, nil)
+	storage.Memory.Delete(m.ID)
+	if s := status(m.ID); s["status"] != mediaPending {
+		t.Fatalf("uploaded: %v", s)
+	}
+	for i := 1; i < jobMaxAttempts; i++ {
+		runJobs()
+		if s := status(m.ID); s["status"] != mediaPending {
+			t.Fatalf("attempt %d: %v", i, s)
+		}
+	}
+	runJobs()
+	if s := status(m.ID); s["status"] != mediaFailed || s["reason"] == "" {
+		t.Errorf("given up: %v", s)
+	}
+
+	// uploading it again tries again
+	upload(t, server, "/public", owner.token, contents, nil)
+	if s := status(m.ID); s["status"] != mediaPending {
+		t.Errorf("uploaded again: %v", s)
+	}
+}
+
+func TestPublicMedia(t *testing.T) {
+	server, _ := newTestServer(t)
+	owner := login(t, server)
+
+	contents := pngOf(t, 4, 3)
+	m := upload(t, server, "/public", owner.token, contents, nil)
+	if m.Status != mediaPending {
+		t.Errorf("status %s, thumbnails are queued", m.Status)
+	}
+
+	res, got := request(t, "GET", server.URL+"/public/"+m.ID, "", nil, nil)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(got, contents) {
+		t.Errorf("public: %d %q", res.StatusCode, got)
+	}
+	res, _ = request(t, "GET", server.URL+"/public/"+muidFor([]byte("nope")), "", nil, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown: %d", res.StatusCode)
+	}
+
+	res, got = request(t, "GET", server.URL+"/media/"+m.ID, owner.token, nil, nil)
+	info := Media{}
+	json.Unmarshal(got, &info)
+	if res.StatusCode != http.StatusOK || info.Mime != "image/png" {
+		t.Errorf("info: %d %+v", res.StatusCode, info)
+	}
+
+	// with an expiry in the past nothing is stored
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	res, _ = postFile(t, server, "/public", owner.token, "image/png", pngOf(t, 2, 2), map[string]string{
+		"expiry": past,
+	})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("past expiry: %d", res.StatusCode)
+	}
+}
+
+// variants are made from whichever image format was uploaded,
+// and served with the type they were stored as
+func TestVariants(t *testing.T) {
+	server, _ := newTestServer(t)
+	owner := login(t, server)
+
+	opaque := &bytes.Buffer{}
+	jpeg.Encode(opaque, image.NewGray(image.Rect(0, 0, 8, 6)), nil)
+	paletted := image.NewPaletted(image.Rect(0, 0, 5, 7), color.Palette{color.Transparent, color.White})
+	paletted.SetColorIndex(2, 2, 1)
+	animated := &bytes.Buffer{}
+	gif.EncodeAll(animated, &gif.GIF{Image: []*image.Paletted{paletted, paletted}, Delay: []int{10, 10}})
+
+	for _, c := range []struct {
+		contents []byte
+		mime     string
+	}{
+		{pngOf(t, 4, 3), "image/png"},
+		{animated.Bytes(), "image/png"},
+		{opaque.Bytes(), "image/jpeg"},
+	} {
+		m := upload(t, server, "/public", owner.token, c.contents, nil)
+		for _, kind := range []string{jobThumb, jobMedium} {
+			if err := runJob(Job{Kind: kind, Muid: m.ID}); err != nil {
+				t.Fatalf("%s of %s: %v", kind, m.Mime, err)
+			}
+		}
+		for _, query := range []string{"?thumb=true", "?medium=true"} {
+			res, got := request(t, "GET", server.URL+"/public/"+m.ID+query, "", nil, nil)
+			if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != c.mime {
+				t.Errorf("%s%s: %d %s", m.Mime, query, res.StatusCode, res.Header.Get("Content-Type"))
+				continue
+			}
+			img, format, err := image.Decode(bytes.NewReader(got))
+			if err != nil || "image/"+format != c.mime {
+				t.Errorf("%s%s: %s %v", m.Mime, query, format, err)
+				continue
+			}
+			if opaque := img.(interface{ Opaque() bool }).Opaque(); opaque != (c.mime == "image/jpeg") {
+				t.Errorf("%s%s: opaque is %v", m.Mime, query, opaque)
+			}
+		}
+	}
+}
+
+// public uploads are stripped of their metadata unless they say
+// otherwise, which makes them a different file
+func TestUploadMetadata(t *testing.T) {
+	server, _ := newTestServer(t)
+	owner := login(t, server)
+
+	buf := &bytes.Buffer{}
+	jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil)
+	photo := append([]byte{}, buf.Bytes()[:2]...)
+	photo = append(photo, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifWith(6)...))...)
+	photo = append(photo, buf.Bytes()[2:]...)
+
+	m := upload(t, server, "/public", owner.token, photo, nil)
+	if m.Metadata != metadataStripped || m.ID == muidFor(photo) {
+		t.Errorf("public: %s %s", m.Metadata, m.ID)
+	}
+	res, got := request(t, "GET", server.URL+"/public/"+m.ID, "", nil, nil)
+	if res.StatusCode != http.StatusOK || bytes.Contains(got, []byte(secret)) || exifOrientation(got) != 6 {
+		t.Errorf("stored: %d", res.StatusCode)
+	}
+
+	m = upload(t, server, "/public?strip_metadata=false", owner.token, photo, nil)
+	if m.Metadata != metadataKept || m.ID != muidFor(photo) {
+		t.Errorf("kept: %s %s", m.Metadata, m.ID)
+	}
+	m = upload(t, server, "/file", owner.token, photo, nil)
+	if m.Metadata != metadataKept || m.ID != muidFor(photo) {
+		t.Errorf("file: %s %s", m.Metadata, m.ID)
+	}
+}
+
+// resizes are made on the first request and stored
+func TestResize(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	m := upload(t, server, "/public", owner.token, pngOf(t, 40, 20), nil)
+
+	get := func(query string) (*http.Response, []byte) {
+		return request(t, "GET", server.URL+"/public/"+m.ID+"?"+query, "", nil, nil)
+	}
+	for query, size := range map[string]image.Point{
+		"w=32&h=32":                      {32, 32},
+		"w=32&h=32&crop=smart":           {32, 32},
+		"w=64":                           {40, 20},
+		"w=32&h=32&fit=contain&crop=top": {32, 16},
+	} {
+		res, got := get(query)
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/png" {
+			t.Errorf("%s: %d %s", query, res.StatusCode, got)
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(got))
+		if err != nil || img.Bounds().Size() != size {
+			t.Errorf("%s: %v %v", query, img.Bounds(), err)
+		}
+		// served from the store the second time
+		if _, again := get(query); !bytes.Equal(again, got) {
+			t.Errorf("%s: made again", query)
+		}
+	}
+	if vs := db.getVariants(m.ID); len(vs) != 4 {
+		t.Errorf("%d variants", len(vs))
+	}
+
+	for _, query := range []string{"w=33", "w=32&fit=squash", "h=32&crop=left"} {
+		if res, _ := get(query); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %d", query, res.StatusCode)
+		}
+	}
+
+	// a request for a resize that is being made gets how it ends
+	spec, _ := parseResize(url.Values{"w": {"128"}})
+	key := m.ID + spec.suffix()
+	f := &resizeFlight{done: make(chan struct{})}
+	resizing.Lock()
+	resizing.inFlight[key] = f
+	resizing.Unlock()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f.err = errImageLimit{"too big"}
+		resizing.Lock()
+		delete(resizing.inFlight, key)
+		resizing.Unlock()
+		close(f.done)
+	}()
+	if res, _ := get("w=128"); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("waiting: %d", res.StatusCode)
+	}
+
+	// they go along with the file
+	res, _ := request(t, "DELETE", server.URL+"/mymedia/"+m.ID, owner.token, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %d", res.StatusCode)
+	}
+	keys, _ := storage.Store.List(m.ID)
+	if len(keys) != 0 || len(db.getVariants(m.ID)) != 0 {
+		t.Errorf("left behind: %v", keys)
+	}
+}
+
+// images over the limits are stored, but not processed
+func TestImageLimits(t *testing.T) {
+	server, _ := newTestServer(t)
+	owner := login(t, server)
+	t.Setenv("IMAGE_MAX_PIXELS", "300")
+	m := upload(t, server, "/public", owner.token, pngOf(t, 40, 20), nil)
+	if m.ID == "" {
+		t.Errorf("upload: %q", m.ID)
+	}
+	if m = previewed(t, m); m.Blurhash != "" {
+		t.Errorf("preview: %q", m.Blurhash)
+	}
+	if err := runJob(Job{Kind: jobThumb, Muid: m.ID}); !isImageLimit(err) {
+		t.Errorf("thumb: %v", err)
+	}
+	if res, _ := request(t, "GET", server.URL+"/public/"+m.ID+"?w=32", "", nil, nil); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("resize: %d", res.StatusCode)
+	}
+}
+
+// images get a preview to show while they load, made by
+// a job so that nothing is decoded while they upload
+func TestPreview(t *testing.T) {
+	server, _ := newTestServer(t)
+	owner := login(t, server)
+	m := upload(t, server, "/file", owner.token, pngOf(t, 40, 20), nil)
+	if m.Blurhash != "" || m.Status != mediaPending {
+		t.Errorf("upload: %q %s", m.Blurhash, m.Status)
+	}
+	if m = previewed(t, m); len(m.Blurhash) != 28 || len(m.Palette) == 0 {
+		t.Errorf("preview: %q %v", m.Blurhash, m.Palette)
+	}
+
+	res, got := request(t, "GET", server.URL+"/mymedia", owner.token, nil, nil)
+	mine := []Media{}
+	if err := json.Unmarshal(got, &mine); err != nil || res.StatusCode != http.StatusOK || len(mine) != 1 {
+		t.Fatalf("mymedia: %d %s", res.StatusCode, got)
+	}
+	if mine[0].Blurhash != m.Blurhash || len(mine[0].Palette) != len(m.Palette) {
+		t.Errorf("mymedia: %q %v", mine[0].Blurhash, mine[0].Palette)
+	}
+
+	// other files have none
+	m = upload(t, server, "/file", owner.token, []byte("just some text"), nil)
+	if m.Blurhash != "" || len(m.Palette) != 0 || m.Status != mediaReady {
+		t.Errorf("file: %q %v %s", m.Blurhash, m.Palette, m.Status)
+	}
+}
+
+// the same picture saved again is found by the way it looks
+func TestSimilar(t *testing.T) {
+	server, _ := newTestServer(t)
+	owner := login(t, server)
+
+	buf := &bytes.Buffer{}
+	png.Encode(buf, scene(200, 150, 1))
+	original := upload(t, server, "/public", owner.token, buf.Bytes(), nil)
+	// not compared until its preview job has run
+	if res, _ := request(t, "GET", server.URL+"/similar/"+original.ID, "", nil, nil); res.StatusCode != http.StatusConflict {
+		t.Errorf("pending: %d", res.StatusCode)
+	}
+	previewed(t, original)
+	buf = &bytes.Buffer{}
+	jpeg.Encode(buf, scene(200, 150, 1), &jpeg.Options{Quality: 30})
+	resaved := previewed(t, upload(t, server, "/public", owner.token, buf.Bytes(), nil))
+	buf = &bytes.Buffer{}
+	png.Encode(buf, scene(200, 150, 2))
+	previewed(t, upload(t, server, "/public", owner.token, buf.Bytes(), nil))
+	// private and priced copies are not found
+	buf = &bytes.Buffer{}
+	jpeg.Encode(buf, scene(200, 150, 1), &jpeg.Options{Quality: 50})
+	previewed(t, upload(t, server, "/file", owner.token, buf.Bytes(), nil))
+	buf = &bytes.Buffer{}
+	jpeg.Encode(buf, scene(200, 150, 1), &jpeg.Options{Quality: 70})
+	previewed(t, upload(t, server, "/public", owner.token, buf.Bytes(), map[string]string{"price": "10"}))
+
+	res, got := request(t, "GET", server.URL+"/similar/"+original.ID, "", nil, nil)
+	similar := []Similar{}
+	if err := json.Unmarshal(got, &similar); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("similar: %d %s", res.StatusCode, got)
+	}
+	if len(similar) != 1 || similar[0].ID != resaved.ID {
+		t.Errorf("similar: %s", got)
+	}
+
+	// searching by an image that is not stored
+	buf = &bytes.Buffer{}
+	jpeg.Encode(buf, scene(100, 75, 1), nil)
+	res, got = postFile(t, server, "/similar", owner.token, "image/jpeg", buf.Bytes(), nil)
+	similar = []Similar{}
+	if err := json.Unmarshal(got, &similar); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("search by image: %d %s", res.StatusCode, got)
+	}
+	if len(similar) != 2 || similar[0].Distance > similar[1].Distance {
+		t.Errorf("search by image: %s", got)
+	}
+
+	res, _ = postFile(t, server, "/similar", owner.token, "text/plain", []byte("not a picture"), nil)
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("text: %d", res.StatusCode)
+	}
+	file := upload(t, server, "/file", owner.token, []byte("just some text"), nil)
+	if res, _ := request(t, "GET", server.URL+"/similar/"+file.ID, "", nil, nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("file: %d", res.StatusCode)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	template := upload(t, server, "/template", owner.token, pngOf(t, 120, 80), nil)
+	if res, _ := request(t, "POST", server.URL+"/template/"+template.ID+"/render", owner.token, []byte(`{"layers": []}`), http.Header{
+		"Content-Type": {"application/json"},
+	}); res.StatusCode != http.StatusNotFound {
+		t.Errorf("uploads are not templates: %d", res.StatusCode)
+	}
+	db.makeTemplate(template.ID)
+	caller := login(t, server)
+
+	render := func(muid, body string) (*http.Response, []byte) {
+		return request(t, "POST", server.URL+"/template/"+muid+"/render", caller.token, []byte(body), http.Header{
+			"Content-Type": {"application/json"},
+		})
+	}
+	res, got := render(template.ID, `{"name": "mine", "format": "jpeg", "layers": [
+		{"text": "top text", "x": 0.5, "y": 0.05, "align": "center", "outline": 2},
+		{"text": "bottom text", "x": 0.5, "y": 0.95, "align": "center", "valign": "bottom", "color": "#ff0"}
+	]}`)
+	m := Media{}
+	if err := json.Unmarshal(got, &m); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("render: %d %s", res.StatusCode, got)
+	}
+	if m.OwnerPubKey != caller.pubKey || m.FromTemplate != template.ID || m.Name != "mine" ||
+		m.Mime != "image/jpeg" || m.Width != 120 || m.Height != 80 || m.ID == template.ID {
+		t.Errorf("rendered: %s", got)
+	}
+	res, got = request(t, "GET", server.URL+"/public/"+m.ID, "", nil, nil)
+	if img, err := jpeg.Decode(bytes.NewReader(got)); res.StatusCode != http.StatusOK || err != nil || img.Bounds().Dx() != 120 {
+		t.Errorf("public: %d %v", res.StatusCode, err)
+	}
+
+	if res, got := render(template.ID, `{"layers": [{"text": "a", "color": "blue"}]}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad color: %d %s", res.StatusCode, got)
+	}
+	// only templates are rendered from
+	if res, _ := render(m.ID, `{"layers": []}`); res.StatusCode != http.StatusNotFound {
+		t.Errorf("not a template: %d", res.StatusCode)
+	}
+	// a template row whose blob is gone
+	db.mu.Lock()
+	delete(db.blobs, template.ID)
+	db.mu.Unlock()
+	if res, _ := render(template.ID, `{"layers": []}`); res.StatusCode != http.StatusNotFound {
+		t.Errorf("no blob: %d", res.StatusCode)
+	}
+}
+
+func TestMakeGif(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	one := upload(t, server, "/public", owner.token, pngOf(t, 40, 30), nil)
+	buf := &bytes.Buffer{}
+	png.Encode(buf, scene(40, 30, 2))
+	two := upload(t, server, "/public", owner.token, buf.Bytes(), nil)
+
+	makeGif := func(token, body string) (*http.Response, []byte) {
+		return request(t, "POST", server.URL+"/gif", token, []byte(body), http.Header{
+			"Content-Type": {"application/json"},
+		})
+	}
+	res, got := makeGif(owner.token, `{"frames": ["`+one.ID+`", "`+two.ID+`"], "delays": [50], "delay": 20,
+		"captions": [{"text": "hi", "x": 0.5, "align": "center", "outline": 1}]}`)
+	m := Media{}
+	if err := json.Unmarshal(got, &m); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("gif: %d %s", res.StatusCode, got)
+	}
+	if m.Mime != "image/gif" || m.Width != 40 || m.Height != 30 {
+		t.Errorf("gif: %s", got)
+	}
+	res, got = request(t, "GET", server.URL+"/public/"+m.ID, "", nil, nil)
+	g, err := gif.DecodeAll(bytes.NewReader(got))
+	if res.StatusCode != http.StatusOK || err != nil || len(g.Image) != 2 || g.Delay[0] != 50 || g.Delay[1] != 20 {
+		t.Fatalf("public: %d %v", res.StatusCode, err)
+	}
+
+	// a gif made from that one, slowed down
+	res, got = makeGif(owner.token, `{"gif": "`+m.ID+`", "delay": 100, "loop": -1}`)
+	if err := json.Unmarshal(got, &m); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("from gif: %d %s", res.StatusCode, got)
+	}
+	_, got = request(t, "GET", server.URL+"/public/"+m.ID, "", nil, nil)
+	if g, err := gif.DecodeAll(bytes.NewReader(got)); err != nil || len(g.Image) != 2 || g.Delay[0] != 100 || g.LoopCount != -1 {
+		t.Errorf("from gif: %v", err)
+	}
+
+	// only from one's own images
+	other := login(t, server)
+	if res, _ := makeGif(other.token, `{"frames": ["`+one.ID+`"]}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("not mine: %d", res.StatusCode)
+	}
+	// a frame whose blob is gone
+	db.mu.Lock()
+	delete(db.blobs, two.ID)
+	db.mu.Unlock()
+	if res, _ := makeGif(owner.token, `{"frames": ["`+one.ID+`", "`+two.ID+`"]}`); res.StatusCode != http.StatusNotFound {
+		t.Errorf("no blob: %d", res.StatusCode)
+	}
+}
+
+func TestPurchase(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	buyer := login(t, server)
+
+	m := upload(t, server, "/file", owner.token, []byte("paywalled\n"), map[string]string{
+		"price": "25",
+		"ttl":   "3600",
+	})
+
+	for i := 0; i < 2; i++ {
+		res, got := request(t, "PUT", server.URL+"/purchase/"+m.ID, owner.token, nil, nil)
+		bought := Media{}
+		json.Unmarshal(got, &bought)
+		if res.StatusCode != http.StatusOK || bought.Price != 25 || bought.TTL != 3600 {
+			t.Fatalf("purchase: %d %s", res.StatusCode, got)
+		}
+	}
+	stats := db.getMyMediaByMUID(owner.pubKey, m.ID)
+	if stats.TotalBuys != 2 || stats.TotalSats != 50 {
+		t.Errorf("stats %d buys %d sats", stats.TotalBuys, stats.TotalSats)
+	}
+
+	// only the owner's relay reports purchases of their media
+	res, _ := request(t, "PUT", server.URL+"/purchase/"+m.ID, buyer.token, nil, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("purchase by someone else: %d", res.StatusCode)
+	}
+
+	// stats are for the owner only
+	_, got := request(t, "GET", server.URL+"/media/"+m.ID, buyer.token, nil, nil)
+	info := Media{}
+	json.Unmarshal(got, &info)
+	if info.TotalBuys != 0 || info.TotalSats != 0 {
+		t.Errorf("stats shown: %+v", info)
+	}
+}
+
+func TestUploadTypes(t *testing.T) {
+	server, _ := newTestServer(t)
+	owner := login(t, server)
+	picture := pngOf(t, 5, 7)
+	text := []byte("just some text\n")
+
+	cases := []struct {
+		route    string
+		declared string
+		contents []byte
+		status   int
+		stored   string
+	}{
+		{"/file", "image/png", picture, http.StatusOK, "image/png"},
+		{"/file", "application/octet-stream", picture, http.StatusOK, "image/png"},
+		{"/file", "text/csv", text, http.StatusOK, "text/csv"},
+		{"/file", "application/json", []byte(`{"a": 1}`), http.StatusOK, "application/json"},
+		{"/file", "text/plain; charset=utf-8", text, http.StatusOK, "text/plain"},
+		{"/file", "image/png", text, http.StatusUnsupportedMediaType, ""},
+		{"/file", "image/jpeg", picture, http.StatusUnsupportedMediaType, ""},
+		{"/public", "image/png", picture, http.StatusOK, "image/png"},
+		{"/public", "text/plain", text, http.StatusUnsupportedMediaType, ""},
+		{"/public", "application/octet-stream", text, http.StatusUnsupportedMediaType, ""},
+		{"/template", "image/png", picture, http.StatusOK, "image/png"},
+		{"/template", "image/gif", []byte("GIF89a\x01\x00\x01\x00"), http.StatusUnsupportedMediaType, ""},
+	}
+	for _, c := range cases {
+		res, got := postFile(t, server, c.route, owner.token, c.declared, c.contents, nil)
+		if res.StatusCode != c.status {
+			t.Errorf("%s %s: %d %s", c.route, c.declared, res.StatusCode, got)
+			continue
+		}
+		m := Media{}
+		json.Unmarshal(got, &m)
+		if c.status == http.StatusOK && m.Mime != c.stored {
+			t.Errorf("%s %s: stored as %s", c.route, c.declared, m.Mime)
+		}
+	}
+
+	// operators can open a route up, or close
+	// it down to the types they name
+	t.Setenv("ALLOWED_TYPES_PUBLIC", "image/*,text/plain")
+	res, got := postFile(t, server, "/public", owner.token, "text/plain", text, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("allowed text: %d %s", res.StatusCode, got)
+	}
+	t.Setenv("ALLOWED_TYPES_FILE", "image/*,text/plain")
+	if res, got := postFile(t, server, "/file", owner.token, "text/csv", text, nil); res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("csv not allowed: %d %s", res.StatusCode, got)
+	}
+}
+
+// tusRequest is a tus request to path, with the version header
+func tusRequest(t *testing.T, server *httptest.Server, method, path, token string, body []byte, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Tus-Resumable", tusVersion)
+	res, _ := request(t, method, server.URL+path, token, body, header)
+	return res
+}
+
+// tusCreated starts a tus upload of length bytes and gives its path
+func tusCreated(t *testing.T, server *httptest.Server, token string, length int, metadata string) string {
+	res := tusRequest(t, server, "POST", "/tus", token, nil, http.Header{
+		"Upload-Length":   {strconv.Itoa(length)},
+		"Upload-Metadata": {metadata},
+	})
+	if res.StatusCode != http.StatusCreated || res.Header.Get("Location") == "" || res.Header.Get("Upload-Expires") == "" {
+		t.Fatalf("create: %d %v", res.StatusCode, res.Header)
+	}
+	return res.Header.Get("Location")
+}
+
+// cutReader gives data, then fails as a dropped connection would
+type cutReader struct {
+	data []byte
+	read bool
+}
+
+func (c *cutReader) Read(p []byte) (int, error) {
+	if c.read {
+		return 0, errors.New("connection lost")
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	c.read = len(c.data) == 0
+	return n, nil
+}
+
+func TestTus(t *testing.T) {
+	server, db := newTestServer(t)
+	t.Setenv("TUS_DIR", t.TempDir())
+	owner := login(t, server)
+	contents := bytes.Repeat([]byte("a chunk of a meme "), 4000)
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	metadata := "filename " + b64("meme.txt") + ",filetype " + b64("text/plain") + ",name " + b64("tus meme")
+
+	if res, _ := request(t, "POST", server.URL+"/tus", owner.token, nil, http.Header{"Upload-Length": {"10"}}); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("no version: %d", res.StatusCode)
+	}
+	if res := tusRequest(t, server, "POST", "/tus", owner.token, nil, http.Header{
+		"Upload-Length":   {"10"},
+		"Upload-Metadata": {"kind " + b64("nonsense")},
+	}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown kind: %d", res.StatusCode)
+	}
+	path := tusCreated(t, server, owner.token, len(contents), metadata)
+	patch := func(offset int, body []byte) *http.Response {
+		return tusRequest(t, server, "PATCH", path, owner.token, body, http.Header{
+			"Content-Type":  {"application/offset+octet-stream"},
+			"Upload-Offset": {strconv.Itoa(offset)},
+		})
+	}
+	offsetOf := func(res *http.Response) int {
+		n, _ := strconv.Atoi(res.Header.Get("Upload-Offset"))
+		return n
+	}
+
+	if res := patch(5, contents); res.StatusCode != http.StatusConflict || offsetOf(res) != 0 {
+		t.Errorf("wrong offset: %d %s", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+	other := login(t, server)
+	if res := tusRequest(t, server, "HEAD", path, other.token, nil, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("someone else's: %d", res.StatusCode)
+	}
+
+	// a PATCH cut off halfway keeps what arrived, which the client
+	// finds out with HEAD and resumes from
+	req, _ := http.NewRequest("PATCH", server.URL+path, &cutReader{data: contents[:len(contents)/2]})
+	req.Header.Set("Authorization", "Bearer "+owner.token)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	if res, err := http.DefaultClient.Do(req); err == nil {
+		res.Body.Close()
+		t.Fatalf("cut PATCH went through: %d", res.StatusCode)
+	}
+	offset := 0
+	for deadline := time.Now().Add(5 * time.Second); offset == 0 && time.Now().Before(deadline); {
+		res := tusRequest(t, server, "HEAD", path, owner.token, nil, nil)
+		if res.StatusCode != http.StatusOK || res.Header.Get("Upload-Length") != strconv.Itoa(len(contents)) {
+			t.Fatalf("head: %d %v", res.StatusCode, res.Header)
+		}
+		offset = offsetOf(res)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if offset == 0 || offset > len(contents)/2 {
+		t.Fatalf("resume from %d", offset)
+	}
+
+	// the last chunk hands the file over to become media
+	res := patch(offset, contents[offset:])
+	muid := res.Header.Get("Upload-Muid")
+	if res.StatusCode != http.StatusNoContent || offsetOf(res) != len(contents) || muid != muidFor(contents) {
+		t.Fatalf("last chunk: %d %v", res.StatusCode, res.Header)
+	}
+	m := db.getMyMediaByMUID(owner.pubKey, muid)
+	if m.Name != "tus meme" || m.Filename != "meme.txt" || m.Mime != "text/plain" || m.Size != int64(len(contents)) {
+		t.Errorf("media: %+v", m)
+	}
+	if res := tusRequest(t, server, "HEAD", path, owner.token, nil, nil); res.Header.Get("Upload-Muid") != muid {
+		t.Errorf("head after: %v", res.Header)
+	}
+
+	// unfinished uploads expire, and the reaper drops them
+	path = tusCreated(t, server, owner.token, 10, metadata)
+	id := strings.TrimPrefix(path, "/tus/")
+	if res := patch(0, []byte("01234")); res.StatusCode != http.StatusNoContent || offsetOf(res) != 5 {
+		t.Fatalf("first half: %d", res.StatusCode)
+	}
+	db.setUpload(id, func(u *Upload) {
+		past := time.Now().Add(-time.Minute)
+		u.Expires = &past
+	})
+	if res := patch(5, []byte("56789")); res.StatusCode != http.StatusGone {
+		t.Errorf("expired: %d", res.StatusCode)
+	}
+	reapUploads()
+	if res := tusRequest(t, server, "HEAD", path, owner.token, nil, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("reaped: %d", res.StatusCode)
+	}
+	if _, err := os.Stat(tusPath(id)); !os.IsNotExist(err) {
+		t.Errorf("reaped file: %v", err)
+	}
+
+	// and can be dropped by their owner
+	path = tusCreated(t, server, owner.token, 10, metadata)
+	if res := tusRequest(t, server, "DELETE", path, other.token, nil, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("delete someone else's: %d", res.StatusCode)
+	}
+	if res := tusRequest(t, server, "DELETE", path, owner.token, nil, nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("delete: %d", res.StatusCode)
+	}
+	if res := tusRequest(t, server, "HEAD", path, owner.token, nil, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted: %d", res.StatusCode)
+	}
+	if _, err := os.Stat(tusPath(strings.TrimPrefix(path, "/tus/"))); !os.IsNotExist(err) {
+		t.Errorf("deleted file: %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	server, _ := newTestServer(t)
+	t.Setenv("TUS_DIR", t.TempDir())
+	t.Setenv("QUOTA_MAX_FILES", "3")
+	t.Setenv("QUOTA_MAX_BYTES", "2000")
+	t.Setenv("QUOTA_MAX_BYTES_PER_DAY", "")
+	owner := login(t, server)
+	usage := func() Usage {
+		res, got := request(t, "GET", server.URL+"/usage", owner.token, nil, nil)
+		u := Usage{}
+		if err := json.Unmarshal(got, &u); err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("usage: %d %s", res.StatusCode, got)
+		}
+		return u
+	}
+
+	upload(t, server, "/file", owner.token, bytes.Repeat([]byte("a"), 100), nil)
+	if u := usage(); u.Bytes != 100 || u.Files != 1 || u.MaxBytes != 2000 || u.MaxFiles != 3 || u.MaxBytesPerDay != 0 {
+		t.Errorf("usage: %+v", u)
+	}
+	if res, _ := postFile(t, server, "/file", owner.token, "text/plain", bytes.Repeat([]byte("b"), 1950), nil); res.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("over bytes: %d", res.StatusCode)
+	}
+
+	// tus uploads reserve their length until they are done, so
+	// ones that each fit can not go over it together
+	path := tusCreated(t, server, owner.token, 1000, "")
+	if u := usage(); u.Reserved != 1000 || u.Pending != 1 {
+		t.Errorf("reserved: %+v", u)
+	}
+	if res := tusRequest(t, server, "POST", "/tus", owner.token, nil, http.Header{"Upload-Length": {"1000"}}); res.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("over reserved: %d", res.StatusCode)
+	}
+	upload(t, server, "/file", owner.token, []byte("c"), nil)
+	if res, _ := postFile(t, server, "/file", owner.token, "text/plain", []byte("d"), nil); res.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("over files: %d", res.StatusCode)
+	}
+
+	// and are checked again as they complete
+	t.Setenv("QUOTA_MAX_BYTES", "1000")
+	res := tusRequest(t, server, "PATCH", path, owner.token, bytes.Repeat([]byte("e"), 1000), http.Header{
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {"0"},
+	})
+	if res.StatusCode != http.StatusInsufficientStorage || res.Header.Get("Upload-Muid") != "" {
+		t.Errorf("over at the end: %d", res.StatusCode)
+	}
+	tusRequest(t, server, "DELETE", path, owner.token, nil, nil)
+	if u := usage(); u.Reserved != 0 || u.Pending != 0 || u.Files != 2 {
+		t.Errorf("after: %+v", u)
+	}
+
+	t.Setenv("QUOTA_MAX_FILES", "")
+	t.Setenv("QUOTA_MAX_BYTES", "")
+	t.Setenv("QUOTA_MAX_BYTES_PER_DAY", "150")
+	if res, _ := postFile(t, server, "/file", owner.token, "text/plain", bytes.Repeat([]byte("f"), 60), nil); res.StatusCode != http.StatusPaymentRequired {
+		t.Errorf("over today: %d", res.StatusCode)
+	}
+}
+
+// presign starts a presigned upload of contents
+func presign(t *testing.T, server *httptest.Server, token string, length int) presignedUpload {
+	res, got := request(t, "POST", server.URL+"/presign/upload", token, nil, http.Header{
+		"Upload-Length":   {strconv.Itoa(length)},
+		"Upload-Metadata": {"filename " + base64.StdEncoding.EncodeToString([]byte("big.txt"))},
+	})
+	p := presignedUpload{}
+	if err := json.Unmarshal(got, &p); err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("presign: %d %s", res.StatusCode, got)
+	}
+	return p
+}
+
+// sealed is contents encrypted the way the client has to, under key
+func sealed(t *testing.T, hexKey string, contents []byte) []byte {
+	key, _ := hex.DecodeString(hexKey)
+	r, err := sio.EncryptReader(bytes.NewReader(contents), sio.Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	return out
+}
+
+func TestPresign(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+	contents := bytes.Repeat([]byte("a large meme "), 1000)
+	finalize := func(id, muid string, size int) (*http.Response, []byte) {
+		form := url.Values{"muid": {muid}, "size": {strconv.Itoa(size)}}
+		return request(t, "POST", server.URL+"/presign/upload/"+id+"/finalize", owner.token, []byte(form.Encode()), http.Header{
+			"Content-Type": {"application/x-www-form-urlencoded"},
+		})
+	}
+	runFinalize := func(id string) error {
+		err := runJob(Job{Kind: jobFinalize, Muid: id})
+		if err != nil {
+			db.giveUp(id, err)
+		}
+		return err
+	}
+
+	if res, _ := request(t, "POST", server.URL+"/presign/upload", owner.token, nil, http.Header{
+		"Upload-Length": {strconv.Itoa(1 << 40)},
+	}); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("over the max upload size: %d", res.StatusCode)
+	}
+
+	p := presign(t, server, owner.token, len(contents))
+	body := sealed(t, p.Key, contents)
+	if p.Method != "PUT" || int64(len(body)) != p.Length {
+		t.Fatalf("presigned: %+v, sealed to %d", p, len(body))
+	}
+	put := func(u string, body []byte) int {
+		res, _ := request(t, "PUT", server.URL+u, "", body, http.Header{"Content-Type": {p.Headers["Content-Type"]}})
+		return res.StatusCode
+	}
+	signed, _ := url.Parse(p.URL)
+	forged := signed.Path + "?expires=" + signed.Query().Get("expires") + "&signature=" + strings.Repeat("0", 64)
+	if status := put(forged, body); status != http.StatusForbidden {
+		t.Errorf("forged: %d", status)
+	}
+	if status := put(signURL("PUT", signed.Path, time.Now().Add(-time.Minute)), body); status != http.StatusForbidden {
+		t.Errorf("expired: %d", status)
+	}
+	if status := put(p.URL, append(body, 0)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("too long: %d", status)
+	}
+
+	// finalizing before the file is put fails in the job
+	if res, got := finalize(p.ID, muidFor(contents), len(contents)); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("finalize early: %d %s", res.StatusCode, got)
+	}
+	if err := runFinalize(p.ID); err == nil {
+		t.Fatalf("finalized a missing file")
+	}
+	if res, _ := finalize(p.ID, "", 0); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing file: %d", res.StatusCode)
+	}
+
+	if status := put(p.URL, body); status != http.StatusOK {
+		t.Fatalf("put: %d", status)
+	}
+	if res, _ := finalize(p.ID, muidFor(contents), len(contents)-1); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong size: %d", res.StatusCode)
+	}
+	// the wrong muid is found out once the file is read
+	finalize(p.ID, muidFor([]byte("something else")), len(contents))
+	if err := runFinalize(p.ID); err != errUploadMismatch {
+		t.Errorf("wrong muid: %v", err)
+	}
+	if res, _ := finalize(p.ID, "", 0); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong muid: %d", res.StatusCode)
+	}
+
+	if res, got := finalize(p.ID, muidFor(contents), len(contents)); res.StatusCode != http.StatusAccepted {
+		t.Fatalf("finalize: %d %s", res.StatusCode, got)
+	}
+	if res, _ := finalize(p.ID, "", 0); res.StatusCode != http.StatusAccepted {
+		t.Errorf("pending: %d", res.StatusCode)
+	}
+	if err := runFinalize(p.ID); err != nil {
+		t.Fatalf("finalize job: %v", err)
+	}
+	res, got := finalize(p.ID, "", 0)
+	m := Media{}
+	if err := json.Unmarshal(got, &m); err != nil || res.StatusCode != http.StatusOK || m.ID != muidFor(contents) || m.Filename != "big.txt" {
+		t.Fatalf("finalized: %d %s", res.StatusCode, got)
+	}
+	if _, err := storage.Raw.GetReader(presignPath(p.ID), [32]byte{}); err == nil {
+		t.Errorf("staged file left behind")
+	}
+
+	// downloads through a signed url
+	exp := time.Now().Add(time.Hour)
+	res, got = request(t, "GET", server.URL+"/presign/download/"+mediaToken(t, owner.key, m.ID, "", exp), owner.token, nil, nil)
+	d := presignedDownload{}
+	if err := json.Unmarshal(got, &d); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("presign download: %d %s", res.StatusCode, got)
+	}
+	if res, got := request(t, "GET", server.URL+d.URL, "", nil, nil); res.StatusCode != http.StatusOK || !bytes.Equal(got, contents) {
+		t.Errorf("signed media: %d", res.StatusCode)
+	}
+	signed, _ = url.Parse(d.URL)
+	forged = signed.Path + "?expires=" + signed.Query().Get("expires") + "&signature=" + strings.Repeat("0", 64)
+	if res, _ := request(t, "GET", server.URL+forged, "", nil, nil); res.StatusCode != http.StatusForbidden {
+		t.Errorf("forged media: %d", res.StatusCode)
+	}
+	if res, _ := request(t, "GET", server.URL+signURL("GET", signed.Path, time.Now().Add(-time.Minute)), "", nil, nil); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expired media: %d", res.StatusCode)
+	}
+	// the url is for the owner it was signed for
+	other := login(t, server)
+	path := "/signed/media/" + other.pubKey + "/" + m.ID
+	if res, _ := request(t, "GET", server.URL+signURL("GET", path, exp), "", nil, nil); res.StatusCode == http.StatusOK {
+		t.Errorf("as someone else: %d", res.StatusCode)
+	}
+}
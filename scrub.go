@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// regenerating a broken variant is a job like any other
+var variantJobs = map[string]string{
+	thumbSuffix:  jobThumb,
+	mediumSuffix: jobMedium,
+}
+
+type scrubReport struct {
+	checked         int // blobs hashed
+	corrupt         int // not hashing to their muid
+	brokenVariants  int // variants that do not decrypt
+	missing         int // blob rows without a file
+	rowsWithoutBlob int // media rows without a blob row
+	orphans         int // files without a blob row
+	cleaned         int
+}
+
+// startScrubber runs the scrub every SCRUB_INTERVAL seconds. It is off
+// without it: a scrub reads the whole store, so it is meant to be set
+// on one instance only. With SCRUB_CLEAN=true it also cleans up
+// orphans, otherwise it only reports and flags corrupt blobs
+func startScrubber() {
+	secs, err := strconv.Atoi(os.Getenv("SCRUB_INTERVAL"))
+	if err != nil || secs <= 0 {
+		return
+	}
+	interval := time.Duration(secs) * time.Second
+	clean, _ := strconv.ParseBool(os.Getenv("SCRUB_CLEAN"))
+	fmt.Println("scrubber every", interval, "clean:", clean)
+	go func() {
+		for {
+			time.Sleep(interval)
+			if _, err := scrub(clean); err != nil {
+				fmt.Println("scrub:", err)
+			}
+		}
+	}()
+}
+
+// scrub re-hashes every blob against its muid, flagging the corrupt
+// ones, and reconciles the store with the database in both
+// directions. With clean, files without a row are deleted, rows whose
+// file is gone are deleted, and broken variants are made again
+func scrub(clean bool) (scrubReport, error) {
+	r := scrubReport{}
+	// rows are loaded before listing: a file is always in place
+	// before its row commits, so a row seen here without a file
+	// really is missing it (unless deleted since, see dropMissingBlob)
+	blobs := DB.getAllBlobs()
+	keys, err := storage.Store.List("")
+	if err != nil {
+		return r, err
+	}
+	files := map[string]bool{}
+	for _, k := range keys {
+		files[k] = true
+	}
+
+	known := map[string]bool{}
+	for _, b := range blobs {
+		known[b.ID] = true
+		if !files[b.ID] {
+			r.missing++
+			fmt.Println("scrub: missing file", b.ID)
+			if clean {
+				dropped, err := DB.dropMissingBlob(b.ID, func() (bool, error) {
+					return isMissing(b.ID)
+				})
+				if err != nil {
+					fmt.Println("scrub:", b.ID, err)
+				}
+				if dropped {
+					r.cleaned++
+				}
+			}
+			continue
+		}
+		r.checked++
+		scrubBlob(b, files, clean, &r)
+	}
+
+	for _, m := range DB.getMediaWithoutBlob() {
+		r.rowsWithoutBlob++
+		fmt.Println("scrub: no blob for media", m.ID, m.OwnerPubKey)
+		if clean && DB.deleteMediaWithoutBlob(m.ID) == nil {
+			r.cleaned++
+		}
+	}
+
+	orphans := map[string][]string{}
+	for _, k := range keys {
+		muid := baseMuid(k)
+		if muid == "" || known[muid] {
+			continue
+		}
+		orphans[muid] = append(orphans[muid], k)
+	}
+	for muid, paths := range orphans {
+		r.orphans++
+		fmt.Println("scrub: orphan files", paths)
+		if !clean {
+			continue
+		}
+		removed, err := DB.removeOrphanFiles(muid, func() error {
+			for _, p := range paths {
+				if err := storage.Store.Delete(p); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("scrub:", muid, err)
+		}
+		if removed {
+			r.cleaned++
+		}
+	}
+
+	fmt.Printf("scrub: %d blobs checked, %d corrupt, %d broken variants, %d missing files, %d rows without blob, %d orphans, %d cleaned\n",
+		r.checked, r.corrupt, r.brokenVariants, r.missing, r.rowsWithoutBlob, r.orphans, r.cleaned)
+	return r, nil
+}
+
+// scrubBlob hashes the decrypted original, and reads its variants
+// through, which authenticates them. It reads past the cache, what
+// is checked is what the backend holds
+func scrubBlob(b Blob, files map[string]bool, clean bool, r *scrubReport) {
+	store := storage.Uncached(b.Encrypted, b.KeyID)
+	nonce := b.NonceBytes()
+
+	corrupt := false
+	got, err := hashOf(store, b.ID, nonce)
+	if err != nil || got != b.ID {
+		corrupt = true
+		r.corrupt++
+		fmt.Println("scrub: corrupt", b.ID, got, err)
+	}
+	DB.markScrubbed(b.ID, corrupt)
+
+	for suffix, kind := range variantJobs {
+		if !files[b.ID+suffix] {
+			continue
+		}
+		reader, err := store.GetReader(b.ID+suffix, nonce)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, reader)
+			reader.Close()
+		}
+		if err == nil {
+			continue
+		}
+		r.brokenVariants++
+		fmt.Println("scrub: broken variant", b.ID+suffix, err)
+		// variants are made encrypted, from a sound original
+		if clean && !corrupt && b.Encrypted {
+			if err := storage.Store.Delete(b.ID + suffix); err == nil {
+				DB.queueJobs(b.ID, []string{kind})
+				r.cleaned++
+			}
+		}
+	}
+
+	// resizes are made again when they are next asked for,
+	// a broken or missing one only has to go
+	for _, v := range DB.getVariants(b.ID) {
+		if !strings.HasPrefix(v.Suffix, resizePrefix) {
+			continue
+		}
+		err := fmt.Errorf("missing")
+		if files[b.ID+v.Suffix] {
+			var reader io.ReadCloser
+			reader, err = store.GetReader(b.ID+v.Suffix, nonce)
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, reader)
+				reader.Close()
+			}
+		}
+		if err == nil {
+			continue
+		}
+		r.brokenVariants++
+		fmt.Println("scrub: broken variant", b.ID+v.Suffix, err)
+		if !clean {
+			continue
+		}
+		if files[b.ID+v.Suffix] {
+			if err := storage.Store.Delete(b.ID + v.Suffix); err != nil {
+				continue
+			}
+		}
+		if DB.deleteVariant(b.ID, v.Suffix) == nil {
+			r.cleaned++
+		}
+	}
+}
+
+// isMissing lists the store again for a single blob
+func isMissing(muid string) (bool, error) {
+	keys, err := storage.Store.List(muid)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range keys {
+		if k == muid {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// baseMuid is the muid a stored file belongs to, or "" for anything
+// that is not one of ours: staging files of uploads and migrations in
+// progress, or files that were put next to the blobs by hand
+func baseMuid(key string) string {
+	muid := key
+	for suffix := range variantJobs {
+		muid = strings.TrimSuffix(muid, suffix)
+	}
+	// a muid is base64 ending in "=", resizes have their parameters after it
+	if i := strings.Index(muid, "="+resizePrefix); i >= 0 {
+		muid = muid[:i+1]
+	}
+	hash, err := base64.URLEncoding.DecodeString(muid)
+	if err != nil || len(hash) != 32 {
+		return ""
+	}
+	return muid
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// a blob that no longer hashes to its muid is flagged corrupt, and
+// one whose file is gone is reported missing, without -clean
+// nothing is deleted
+func TestScrub(t *testing.T) {
+	server, db := newTestServer(t)
+	owner := login(t, server)
+
+	sound := upload(t, server, "/file", owner.token, []byte("a sound meme\n"), nil)
+	corrupt := upload(t, server, "/file", owner.token, []byte("a meme to corrupt\n"), nil)
+	missing := upload(t, server, "/file", owner.token, []byte("a meme to lose\n"), nil)
+
+	var nonce [32]byte
+	garbage := bytes.Repeat([]byte("x"), 100)
+	if err := storage.Memory.PostReader(corrupt.ID, bytes.NewReader(garbage), -1, "", nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Memory.Delete(missing.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := scrub(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.checked != 2 || r.corrupt != 1 || r.missing != 1 || r.orphans != 0 || r.cleaned != 0 {
+		t.Errorf("report: %+v", r)
+	}
+	if b := db.getBlob(corrupt.ID); !b.Corrupt || b.Scrubbed == nil {
+		t.Errorf("corrupt blob not flagged: %+v", b)
+	}
+	if b := db.getBlob(sound.ID); b.Corrupt || b.Scrubbed == nil {
+		t.Errorf("sound blob: %+v", b)
+	}
+	if b := db.getBlob(missing.ID); b.ID == "" {
+		t.Errorf("missing blob dropped without -clean")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/nfnt/resize"
+
+	"github.com/stakwork/sphinx-meme/lsat"
+)
+
+// images get a perceptual hash (a dHash) along with their preview, so
+// that the same picture saved again, at another quality or size, can be
+// found though its bytes and muid differ. Hashes are compared by how
+// many of their 64 bits differ
+
+// the phash is cut into 8 bands of 8 bits, kept in an indexed column
+// as band<<8 | bits. Two hashes at most 7 bits apart have at least one
+// band the same, so looking up the bands of a hash finds them all
+const phashBandCount = 8
+
+// images at most this many bits apart are similar
+const similarDistance = phashBandCount - 1
+
+// dHash compares the brightness of neighbouring pixels of img
+// shrunk to 9 by 8, each of the 64 comparisons is a bit
+func dHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	gray := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.Draw(gray, gray.Bounds(), small, small.Bounds().Min, draw.Src)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray.GrayAt(x, y).Y < gray.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func phashBands(hash uint64) []int64 {
+	bands := make([]int64, phashBandCount)
+	for i := range bands {
+		bands[i] = int64(i)<<8 | int64(hash>>(8*uint(i))&0xFF)
+	}
+	return bands
+}
+
+func hamming(a, b int64) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// Similar is media found by its phash, distance bits away
+type Similar struct {
+	Media
+	Distance int `json:"distance"`
+}
+
+// similarTo is the media similar to the hash, closest first. except
+// leaves out the media being compared to
+func similarTo(phash int64, bands []int64, except string) []Similar {
+	ms := []Similar{}
+	for _, m := range DB.similarMedia(phash, bands, similarDistance) {
+		if m.ID == except {
+			continue
+		}
+		m.TotalSats = 0 // hidden vals
+		m.TotalBuys = 0
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// collapseSimilar keeps only the first of media that are similar
+func collapseSimilar(medias []Media) []Media {
+	kept := []Media{}
+	for _, m := range medias {
+		duplicate := false
+		for _, k := range kept {
+			if len(m.PhashBands) > 0 && len(k.PhashBands) > 0 && hamming(m.Phash, k.Phash) <= similarDistance {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// getSimilar lists the media that look like muid
+func getSimilar(w http.ResponseWriter, r *http.Request) {
+	muid := chi.URLParam(r, "muid")
+
+	media := DB.getMediaByMUID(muid)
+	if media.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("Media not found")
+		return
+	}
+	if len(media.PhashBands) == 0 && isPreviewable(media.Mime) && media.Status == mediaPending {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode("Media is still being processed")
+		return
+	}
+	if len(media.PhashBands) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Media is not an image")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(similarTo(media.Phash, media.PhashBands, muid))
+}
+
+// searchByImage lists the media that look like the image in the
+// "file" part. It is only compared, not stored, but is limited to
+// the size of an upload
+func searchByImage(w http.ResponseWriter, r *http.Request) {
+	maxSize := r.Context().Value(lsat.MaxUploadSizeContextKey).(int64)
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Error Retrieving the File")
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("err:", err)
+			if isTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode("File too big")
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode("Error Retrieving the File")
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		src, contentType, err := sniffUpload(part, part.Header.Get("Content-Type"), uploadKindPublic)
+		if err == nil && !isPreviewable(contentType) {
+			err = errMime{fmt.Sprintf("%s is not an image", contentType)}
+		}
+		// read in full, within maxSize, before it goes to a worker, which
+		// keeps reading after the handler returns if it runs out of time
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(src)
+		}
+		if err != nil {
+			fmt.Println(err)
+			if isMimeError(err) {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				json.NewEncoder(w).Encode(err.Error())
+				return
+			}
+			if isTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode("File too big")
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode("Error Retrieving the File")
+			return
+		}
+		var info imageInfo
+		err = runImageWork(func() error {
+			var err error
+			_, info, err = readImage(bytes.NewReader(data))
+			return err
+		})
+		if err != nil {
+			fmt.Println(err)
+			if status, ok := imageErrorStatus(err); ok {
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			json.NewEncoder(w).Encode("Could not read the image")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(similarTo(info.phash, info.phashBands, ""))
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode("Error Retrieving the File")
+}
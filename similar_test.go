@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+// scene is a picture with some shapes in it, different for each seed
+func scene(w, h, seed int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*255/w + seed*97) % 256)
+			if (x/(w/4+seed)+y/(h/3))%2 == 0 {
+				v = 255 - uint8(y*255/h)
+			}
+			img.Set(x, y, color.NRGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	original := scene(200, 150, 1)
+
+	// saved again smaller, at a low quality
+	buf := &bytes.Buffer{}
+	jpeg.Encode(buf, resize.Resize(120, 90, original, resize.Bilinear), &jpeg.Options{Quality: 20})
+	resaved, err := jpeg.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := hamming(int64(dHash(original)), int64(dHash(resaved))); d > similarDistance {
+		t.Errorf("resaved is %d apart", d)
+	}
+	if d := hamming(int64(dHash(original)), int64(dHash(scene(200, 150, 2)))); d <= similarDistance {
+		t.Errorf("another picture is %d apart", d)
+	}
+}
+
+func TestPhashBands(t *testing.T) {
+	hash := uint64(0x0123456789ABCDEF)
+	// 7 bits apart, one in each band but the last
+	other := hash ^ 0x0001010101010101
+	shared := 0
+	for i, b := range phashBands(hash) {
+		if b>>8 != int64(i) {
+			t.Errorf("band %d is %x", i, b)
+		}
+		if b == phashBands(other)[i] {
+			shared++
+		}
+	}
+	if shared != 1 {
+		t.Errorf("%d bands shared", shared)
+	}
+}
+
+func TestCollapseSimilar(t *testing.T) {
+	medias := []Media{
+		{ID: "a", Phash: 0x0F, PhashBands: phashBands(0x0F)},
+		{ID: "b", Phash: 0x1F, PhashBands: phashBands(0x1F)},
+		{ID: "c", Phash: -1, PhashBands: phashBands(^uint64(0))},
+		{ID: "d"},
+		{ID: "e"},
+	}
+	got := ""
+	for _, m := range collapseSimilar(medias) {
+		got += m.ID
+	}
+	// b looks like a, files without a phash are all kept
+	if got != "acde" {
+		t.Errorf("got %s", got)
+	}
+}
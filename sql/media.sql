@@ -22,6 +22,156 @@ CREATE TABLE media (
   height INT
 );
 
+-- set once the expiry reaper has deleted the files,
+-- the row stays behind so that downloads can answer 410
+
+ALTER TABLE media ADD COLUMN purged boolean not null default false;
+
+CREATE INDEX media_expiry ON media (expiry) WHERE expiry IS NOT NULL AND NOT purged;
+
+-- whether the files are encrypted at rest. NULL for rows from before the
+-- shared encryption layer, which the server resolves at startup (local
+-- files were always encrypted, s3 objects were not). plaintext rows are
+-- rewritten by the `encrypt-at-rest` command
+
+ALTER TABLE media ADD COLUMN encrypted boolean;
+
+-- blobs are the stored files, named by content hash. several owners can
+-- upload the same bytes: each gets a media row, and they share one blob
+-- (and its nonce). refcount counts the live media rows, the files are
+-- deleted with the last one
+
+CREATE TABLE blobs (
+  id TEXT NOT NULL PRIMARY KEY,
+  nonce TEXT,
+  size BIGINT,
+  encrypted boolean,
+  refcount BIGINT not null default 0,
+  created timestamptz
+);
+
+INSERT INTO blobs (id, nonce, size, encrypted, refcount, created)
+SELECT id, nonce, size, encrypted, 1, created FROM media WHERE NOT purged;
+
+ALTER TABLE media DROP CONSTRAINT media_pkey;
+ALTER TABLE media ADD PRIMARY KEY (id, owner_pub_key);
+ALTER TABLE media DROP COLUMN nonce;
+ALTER TABLE media DROP COLUMN encrypted;
+
+-- uploads are pending until the job queue has made their derivatives
+
+ALTER TABLE media ADD COLUMN status TEXT not null default 'ready';
+
+-- the job queue. done jobs are deleted, failed ones stay until
+-- the same content is uploaded again
+
+CREATE TABLE jobs (
+  id BIGSERIAL PRIMARY KEY,
+  kind TEXT NOT NULL,
+  muid TEXT NOT NULL,
+  state TEXT NOT NULL,
+  attempts INT not null default 0,
+  run_at timestamptz NOT NULL,
+  last_error TEXT,
+  created timestamptz
+);
+
+CREATE INDEX jobs_due ON jobs (run_at) WHERE state = 'queued';
+CREATE INDEX jobs_muid ON jobs (muid);
+CREATE UNIQUE INDEX jobs_queued ON jobs (muid, kind) WHERE state = 'queued';
+
+-- the master key a blob is encrypted under (ENCRYPTION_KEY_ID). after a
+-- rotation the server rewrites blobs still under a retired key
+
+ALTER TABLE blobs ADD COLUMN key_id TEXT not null default '1';
+
+-- set by the scrubber, corrupt blobs no longer hash to their id
+
+ALTER TABLE blobs ADD COLUMN scrubbed timestamptz;
+ALTER TABLE blobs ADD COLUMN corrupt boolean not null default false;
+
+-- per pubkey overrides of the QUOTA_ defaults, NULL keeps the default
+-- and 0 is no limit
+
+CREATE TABLE quotas (
+  owner_pub_key TEXT NOT NULL PRIMARY KEY,
+  max_bytes BIGINT,
+  max_files BIGINT,
+  max_bytes_per_day BIGINT
+);
+
+CREATE INDEX media_owner ON media (owner_pub_key);
+
+-- tus uploads in progress, the chunks are in TUS_DIR. received is
+-- the upload offset, muid is set once the upload is finished
+
+CREATE TABLE uploads (
+  id TEXT NOT NULL PRIMARY KEY,
+  owner_pub_key TEXT NOT NULL,
+  kind TEXT,
+  length BIGINT NOT NULL,
+  received BIGINT not null default 0,
+  metadata TEXT,
+  muid TEXT,
+  expires timestamptz,
+  created timestamptz
+);
+
+-- presigned uploads are put straight into the store instead of TUS_DIR
+
+ALTER TABLE uploads ADD COLUMN via TEXT NOT NULL DEFAULT 'tus';
+
+-- presigned uploads are sealed by the client under the key of nonce
+-- and key_id, and checked against claimed on the job queue
+
+ALTER TABLE uploads ADD COLUMN nonce TEXT;
+ALTER TABLE uploads ADD COLUMN key_id TEXT;
+ALTER TABLE uploads ADD COLUMN claimed TEXT;
+
+-- variants made since are recorded with their own type and size,
+-- those without a row are JPEG
+
+CREATE TABLE variants (
+  muid TEXT NOT NULL REFERENCES blobs (id) ON DELETE CASCADE,
+  suffix TEXT NOT NULL,
+  mime TEXT NOT NULL,
+  size BIGINT NOT NULL,
+  created timestamptz,
+  PRIMARY KEY (muid, suffix)
+);
+
+-- blobs copied by migrate-storage, until the cutover switches
+-- their rows over to the target
+
+CREATE TABLE blob_migrations (
+  muid TEXT NOT NULL REFERENCES blobs (id) ON DELETE CASCADE,
+  target TEXT NOT NULL,
+  key_id TEXT NOT NULL,
+  migrated timestamptz,
+  PRIMARY KEY (muid, target)
+);
+
+-- whether EXIF, XMP and IPTC were stripped from the stored original
+
+ALTER TABLE media ADD COLUMN metadata TEXT not null default 'kept';
+
+-- placeholders for images that are still downloading
+
+ALTER TABLE media ADD COLUMN blurhash TEXT not null default '';
+ALTER TABLE media ADD COLUMN palette TEXT[] not null default '{}';
+
+-- perceptual hash of images, and its bands to look similar ones up by
+ALTER TABLE media ADD COLUMN phash BIGINT not null default 0;
+ALTER TABLE media ADD COLUMN phash_bands INT[] not null default '{}';
+CREATE INDEX media_phash_bands ON media USING GIN (phash_bands);
+
+-- memes rendered from a template
+ALTER TABLE media ADD COLUMN from_template TEXT not null default '';
+
+-- media anyone can fetch: similar images are only looked up among the
+-- public ones without a price. rows from before are left out
+ALTER TABLE media ADD COLUMN public boolean not null default false;
+
 -- for searching 
 
 ALTER TABLE media ADD COLUMN tsv tsvector;
@@ -1,56 +1,111 @@
 package storage
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 const BUCKET_NAME = "sphinx-memes"
 
 type aws3store struct {
-	client *s3.Client
-	prefix string
+	client     *s3.Client
+	bucketName string
+	prefix     string
 }
 
 var bucket aws3store
 
 func (store aws3store) Init() {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
+	s, err := newAws3Store(s3ConfigFromEnv(""))
 	if err != nil {
 		log.Fatalf("failed to load s3 SDK configuration, %v", err)
 	}
+	bucket = s
+}
+
+func newAws3Store(c s3Config) (aws3store, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(c.Region)}
+	// S3_KEY and S3_SECRET win over the default AWS credential chain
+	if c.Key != "" && c.Secret != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(c.Key, c.Secret, ""),
+		))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return aws3store{}, err
+	}
 
-	bucket.client = s3.NewFromConfig(cfg)
-	bucket.prefix = ""
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		}
+		o.UsePathStyle = c.PathStyle
+	})
+	return aws3store{client: client, bucketName: c.Bucket, prefix: c.Prefix}, nil
 }
 
-func (store aws3store) PostReader(path string, file *bytes.Buffer, length int64, contentType string, nonce [32]byte) error {
-	//reader := bytes.NewReader(file)
+// PostReader streams through the s3 upload manager, which sends
+// unknown-length bodies as a multipart upload one part at a time
+func (store aws3store) PostReader(path string, file io.Reader, length int64, contentType string, nonce [32]byte) error {
 	// fmt.Println("POST READER NOW " + path)
-	bucket := "sphinx-memes"
-	_, err := store.client.PutObject(context.TODO(), &s3.PutObjectInput{
+	bucket := store.bucketName
+	uploader := manager.NewUploader(store.client)
+	key := store.prefix + path
+	input := &s3.PutObjectInput{
 		Bucket: &bucket,
-		Key:    &path,
+		Key:    &key,
 		Body:   file,
-	})
+	}
+	if contentType != "" {
+		input.ContentType = &contentType
+	}
+	_, err := uploader.Upload(context.TODO(), input)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Move copies server side, the bytes never pass through here
+func (store aws3store) Move(from, to string) error {
+	bucket := store.bucketName
+	fromKey := store.prefix + from
+	toKey := store.prefix + to
+	source := bucket + "/" + url.PathEscape(fromKey)
+	_, err := store.client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     &bucket,
+		Key:        &toKey,
+		CopySource: &source,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = store.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &fromKey,
+	})
+	return err
+}
+
 func (store aws3store) GetReader(path string, nonce [32]byte) (rc io.ReadCloser, err error) {
-	bucket := "sphinx-memes"
+	bucket := store.bucketName
+	key := store.prefix + path
 	result, err := store.client.GetObject(context.TODO(), &s3.GetObjectInput{
 		Bucket: &bucket,
-		Key:    &path,
+		Key:    &key,
 	})
 	if err != nil {
 		return nil, err
@@ -58,14 +113,53 @@ func (store aws3store) GetReader(path string, nonce [32]byte) (rc io.ReadCloser,
 	return result.Body, nil
 }
 
-// UNIMPLEMENTED
+func (store aws3store) GetRangeReader(path string, nonce [32]byte, offset, length int64) (rc io.ReadCloser, err error) {
+	bucket := store.bucketName
+	key := store.prefix + path
+	byteRange := rangeHeader(offset, length)
+	result, err := store.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  &byteRange,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+// List returns every path under the given one, following the
+// pagination. The configured key prefix is stripped off again
 func (store aws3store) List(path string) ([]string, error) {
-	return []string{}, nil
+	bucket := store.bucketName
+	prefix := store.prefix + path
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	keys := []string{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(*obj.Key, store.prefix))
+		}
+	}
+	return keys, nil
 }
 
-// UNIMPLEMENTED
+// Delete succeeds for keys that do not exist, like s3 itself
 func (store aws3store) Delete(path string) error {
-	return nil
+	bucket := store.bucketName
+	key := store.prefix + path
+	_, err := store.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	return err
 }
 
 func (store aws3store) GenNonce() ([32]byte, error) {
@@ -76,3 +170,36 @@ func (store aws3store) GenNonce() ([32]byte, error) {
 	}
 	return nonce, nil
 }
+
+// PresignPut signs the length and content type in, so the
+// client can not put anything bigger than it asked for
+func (store aws3store) PresignPut(path string, length int64, contentType string, expires time.Duration) (string, error) {
+	bucket := store.bucketName
+	key := store.prefix + path
+	input := &s3.PutObjectInput{
+		Bucket:        &bucket,
+		Key:           &key,
+		ContentLength: aws.Int64(length),
+	}
+	if contentType != "" {
+		input.ContentType = &contentType
+	}
+	req, err := s3.NewPresignClient(store.client).PresignPutObject(context.TODO(), input, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (store aws3store) PresignGet(path string, expires time.Duration) (string, error) {
+	bucket := store.bucketName
+	key := store.prefix + path
+	req, err := s3.NewPresignClient(store.client).PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cachedStore keeps recently read blobs on local disk in front of a
+// remote backend, evicting the least recently used once it holds more
+// than maxBytes. It sits underneath encryptedStore, so what is cached is
+// the ciphertext, exactly as the backend has it. Concurrent misses for a
+// path wait on a single fetch. Writes go to the backend and drop the
+// cached copy, blobs being content addressed this is all it takes
+type cachedStore struct {
+	backend  store
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recent first
+	entries map[string]*list.Element
+	size    int64
+	fetches map[string]*cacheFetch
+	tooBig  map[string]bool
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	path string
+	size int64
+}
+
+// a fetch in flight, the first reader to miss a path downloads it
+// and the others wait for it to be done
+type cacheFetch struct {
+	done  chan struct{}
+	err   error
+	stale bool // written or deleted meanwhile, not to be cached
+}
+
+// CacheStats counts reads served from disk and from the backend
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Files     int64 `json:"files"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+// Cache is the cache in front of the backend, nil without CACHE_DIR
+var Cache *cachedStore
+
+// tooBig is forgotten past this many paths
+const maxTooBig = 10000
+
+// fetching files are named with this prefix, and
+// cleared out of the dir when the cache starts
+const cacheTempPrefix = ".fetch-"
+
+// newCachedStore picks up what is already in dir,
+// the least recently written evicted first
+func newCachedStore(backend store, dir string, maxBytes int64) (*cachedStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &cachedStore{
+		backend:  backend,
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		fetches:  map[string]*cacheFetch{},
+		tooBig:   map[string]bool{},
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		path, err := url.PathUnescape(f.Name())
+		if err != nil || strings.HasPrefix(f.Name(), cacheTempPrefix) {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.entries[path] = c.lru.PushBack(&cacheEntry{path: path, size: f.Size()})
+		c.size += f.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+// cacheFromEnv wraps backend when CACHE_DIR is set. CACHE_MAX_BYTES
+// bounds it, 1GB by default
+func cacheFromEnv(backend store) (store, error) {
+	dir := os.Getenv("CACHE_DIR")
+	if dir == "" {
+		return backend, nil
+	}
+	maxBytes := int64(1 << 30)
+	if n, err := strconv.ParseInt(os.Getenv("CACHE_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		maxBytes = n
+	}
+	c, err := newCachedStore(backend, dir, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("cache: %s up to %d bytes\n", dir, maxBytes)
+	Cache = c
+	return c, nil
+}
+
+// Init does nothing, the backend is initialized on its own
+func (c *cachedStore) Init() {}
+
+func (c *cachedStore) file(path string) string {
+	return filepath.Join(c.dir, url.PathEscape(path))
+}
+
+func (c *cachedStore) GetReader(path string, nonce [32]byte) (io.ReadCloser, error) {
+	return c.GetRangeReader(path, nonce, 0, -1)
+}
+
+// GetRangeReader fetches the whole blob on a miss. A range is passed
+// through to the backend meanwhile, so a player seeking into a video
+// gets its first bytes without waiting for all of them, and the whole
+// blob is fetched in the background for the requests that follow. A
+// range miss so reads the range from the backend twice, once for the
+// reader and once as part of the whole blob
+func (c *cachedStore) GetRangeReader(path string, nonce [32]byte, offset, length int64) (io.ReadCloser, error) {
+	if f, ok := c.open(path, true); ok {
+		return rangeOf(f, offset, length)
+	}
+	if offset > 0 || length >= 0 {
+		go c.fetch(path, nonce)
+		return c.backend.GetRangeReader(path, nonce, offset, length)
+	}
+	if err := c.fetch(path, nonce); err != nil {
+		return nil, err
+	}
+	// served from disk if it was cached, which it is not when it
+	// is too big or was written while it was being fetched
+	if f, ok := c.open(path, false); ok {
+		return rangeOf(f, offset, length)
+	}
+	return c.backend.GetRangeReader(path, nonce, offset, length)
+}
+
+// open is the cached file, marked as just used. It is opened under the
+// lock, so that it can not be evicted in between, and an open file
+// keeps working if it is evicted afterwards
+func (c *cachedStore) open(path string, count bool) (*os.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(c.file(path))
+	if err != nil {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	if count {
+		c.stats.Hits++
+	}
+	return f, true
+}
+
+func rangeOf(f *os.File, offset, length int64) (io.ReadCloser, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return readCloser{io.LimitReader(f, length), f}, nil
+}
+
+// fetch downloads path into the cache, or waits for
+// the download another reader has already started
+func (c *cachedStore) fetch(path string, nonce [32]byte) error {
+	c.mu.Lock()
+	// cached by a fetch that finished since the reader missed
+	if _, ok := c.entries[path]; ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.stats.Misses++
+	if c.tooBig[path] {
+		c.mu.Unlock()
+		return nil
+	}
+	if f, ok := c.fetches[path]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &cacheFetch{done: make(chan struct{})}
+	c.fetches[path] = f
+	c.mu.Unlock()
+
+	size, tmp, err := c.download(path, nonce)
+
+	c.mu.Lock()
+	delete(c.fetches, path)
+	switch {
+	case err == errTooBig:
+		if len(c.tooBig) >= maxTooBig {
+			c.tooBig = map[string]bool{}
+		}
+		c.tooBig[path] = true
+		err = nil
+	case err == nil && !f.stale:
+		// there is only one fetch of a path at a time, and it starts
+		// after the entry is gone, but renaming over a live entry
+		// would leave its file to be deleted by its eviction
+		if _, ok := c.entries[path]; ok {
+			break
+		}
+		if os.Rename(tmp, c.file(path)) == nil {
+			c.entries[path] = c.lru.PushFront(&cacheEntry{path: path, size: size})
+			c.size += size
+			c.evict()
+		}
+	}
+	c.mu.Unlock()
+	if tmp != "" {
+		os.Remove(tmp)
+	}
+	f.err = err
+	close(f.done)
+	return err
+}
+
+var errTooBig = errors.New("too big to cache")
+
+// download stops at maxBytes, a blob that big
+// would only push everything else out
+func (c *cachedStore) download(path string, nonce [32]byte) (int64, string, error) {
+	rc, err := c.backend.GetReader(path, nonce)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rc.Close()
+	tmp, err := ioutil.TempFile(c.dir, cacheTempPrefix)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tmp.Close()
+	n, err := io.Copy(tmp, io.LimitReader(rc, c.maxBytes+1))
+	if err == nil && n > c.maxBytes {
+		err = errTooBig
+	}
+	return n, tmp.Name(), err
+}
+
+// evict drops the least recently used files until the cache fits,
+// with c.mu held
+func (c *cachedStore) evict() {
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+		c.stats.Evictions++
+	}
+}
+
+func (c *cachedStore) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	os.Remove(c.file(e.path))
+	c.lru.Remove(el)
+	delete(c.entries, e.path)
+	c.size -= e.size
+}
+
+// Invalidate drops the cached copy of path, and keeps
+// a fetch that is in flight from caching what it gets
+func (c *cachedStore) Invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.remove(el)
+	}
+	if f, ok := c.fetches[path]; ok {
+		f.stale = true
+	}
+	delete(c.tooBig, path)
+}
+
+func (c *cachedStore) PostReader(path string, src io.Reader, length int64, contentType string, nonce [32]byte) error {
+	c.Invalidate(path)
+	err := c.backend.PostReader(path, src, length, contentType, nonce)
+	c.Invalidate(path)
+	return err
+}
+
+func (c *cachedStore) Move(from, to string) error {
+	c.Invalidate(from)
+	c.Invalidate(to)
+	err := c.backend.Move(from, to)
+	c.Invalidate(to)
+	return err
+}
+
+func (c *cachedStore) Delete(path string) error {
+	c.Invalidate(path)
+	return c.backend.Delete(path)
+}
+
+func (c *cachedStore) List(path string) ([]string, error) {
+	return c.backend.List(path)
+}
+
+func (c *cachedStore) GenNonce() ([32]byte, error) {
+	return c.backend.GenNonce()
+}
+
+// Stats is a snapshot of the counters and the size of the cache
+func (c *cachedStore) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Files = int64(len(c.entries))
+	s.Bytes = c.size
+	s.MaxBytes = c.maxBytes
+	return s
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStore counts reads of its backend, and can hold them up
+type countingStore struct {
+	store
+	reads  int32
+	ranges int32
+	gate   chan struct{}
+}
+
+func (s *countingStore) GetReader(path string, nonce [32]byte) (io.ReadCloser, error) {
+	atomic.AddInt32(&s.reads, 1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	return s.store.GetReader(path, nonce)
+}
+
+func (s *countingStore) GetRangeReader(path string, nonce [32]byte, offset, length int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&s.ranges, 1)
+	return s.store.GetRangeReader(path, nonce, offset, length)
+}
+
+func newTestCache(t *testing.T, maxBytes int64) (*cachedStore, *countingStore) {
+	backend := &countingStore{store: &localStore{prefix: t.TempDir()}}
+	c, err := newCachedStore(backend, t.TempDir(), maxBytes)
+	check(t, err)
+	return c, backend
+}
+
+func TestCache(t *testing.T) {
+	c, backend := newTestCache(t, 100)
+	var nonce [32]byte
+
+	contents := []byte("0123456789")
+	check(t, c.PostReader("a", bytes.NewReader(contents), -1, "", nonce))
+	expectBlob(t, c, "a", nonce, contents)
+	expectBlob(t, c, "a", nonce, contents)
+	rc, err := c.GetRangeReader("a", nonce, 2, 3)
+	check(t, err)
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(got) != "234" {
+		t.Errorf("range: %q", got)
+	}
+	if backend.reads != 1 {
+		t.Errorf("backend read %d times", backend.reads)
+	}
+	if s := c.Stats(); s.Hits != 2 || s.Misses != 1 || s.Files != 1 || s.Bytes != 10 {
+		t.Errorf("stats: %+v", s)
+	}
+
+	// a write drops the cached copy
+	changed := []byte("changed")
+	check(t, c.PostReader("a", bytes.NewReader(changed), -1, "", nonce))
+	expectBlob(t, c, "a", nonce, changed)
+
+	// least recently used goes first
+	big := bytes.Repeat([]byte("x"), 60)
+	check(t, c.PostReader("b", bytes.NewReader(big), -1, "", nonce))
+	check(t, c.PostReader("c", bytes.NewReader(big), -1, "", nonce))
+	expectBlob(t, c, "b", nonce, big)
+	expectBlob(t, c, "c", nonce, big)
+	if s := c.Stats(); s.Bytes > 100 || s.Evictions == 0 {
+		t.Errorf("not evicted: %+v", s)
+	}
+	if _, ok := c.entries["b"]; ok {
+		t.Errorf("b still cached")
+	}
+
+	// too big for the cache is read from the backend
+	huge := bytes.Repeat([]byte("y"), 101)
+	check(t, c.PostReader("d", bytes.NewReader(huge), -1, "", nonce))
+	expectBlob(t, c, "d", nonce, huge)
+	if _, ok := c.entries["d"]; ok {
+		t.Errorf("cached past max bytes")
+	}
+
+	// what is on disk is picked up again
+	again, err := newCachedStore(backend, c.dir, 100)
+	check(t, err)
+	if again.Stats().Files != c.Stats().Files {
+		t.Errorf("reopened with %d files, want %d", again.Stats().Files, c.Stats().Files)
+	}
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	c, backend := newTestCache(t, 1<<20)
+	var nonce [32]byte
+	contents := []byte("viral meme")
+	check(t, backend.store.PostReader("meme", bytes.NewReader(contents), -1, "", nonce))
+
+	backend.gate = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expectBlob(t, c, "meme", nonce, contents)
+		}()
+	}
+	// let the one fetch through once everyone has missed
+	for c.Stats().Misses < 10 {
+		runtime.Gosched()
+	}
+	close(backend.gate)
+	wg.Wait()
+	if backend.reads != 1 {
+		t.Errorf("backend read %d times", backend.reads)
+	}
+}
+
+// a reader that missed just before another reader's fetch finished
+// finds the blob cached, rather than caching it a second time
+func TestCacheFetchAfterFetch(t *testing.T) {
+	c, backend := newTestCache(t, 15)
+	var nonce [32]byte
+	contents := []byte("viral meme")
+	check(t, backend.store.PostReader("meme", bytes.NewReader(contents), -1, "", nonce))
+
+	check(t, c.fetch("meme", nonce))
+	check(t, c.fetch("meme", nonce))
+	if backend.reads != 1 {
+		t.Errorf("backend read %d times", backend.reads)
+	}
+	if s := c.Stats(); s.Files != 1 || s.Bytes != 10 || s.Evictions != 0 {
+		t.Errorf("stats: %+v", s)
+	}
+	expectBlob(t, c, "meme", nonce, contents)
+}
+
+// a range that misses is read from the backend without waiting
+// for the whole blob, which is cached in the background
+func TestCacheRangeMiss(t *testing.T) {
+	c, backend := newTestCache(t, 1<<20)
+	var nonce [32]byte
+	contents := []byte("a long video")
+	check(t, backend.store.PostReader("video", bytes.NewReader(contents), -1, "", nonce))
+
+	backend.gate = make(chan struct{})
+	rc, err := c.GetRangeReader("video", nonce, 2, 4)
+	check(t, err)
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(got) != "long" {
+		t.Errorf("range: %q", got)
+	}
+	close(backend.gate)
+	for c.Stats().Files == 0 {
+		runtime.Gosched()
+	}
+	expectBlob(t, c, "video", nonce, contents)
+	if backend.reads != 1 || backend.ranges != 1 {
+		t.Errorf("backend read %d times, %d ranges", backend.reads, backend.ranges)
+	}
+}
+
+// the cache holds ciphertext, and a stale copy of a blob
+// rekeyed elsewhere is fetched again rather than failing
+func TestCacheEncrypted(t *testing.T) {
+	initEncryptedLocal()
+	c, backend := newTestCache(t, 1<<20)
+	enc := &encryptedStore{backend: c, keys: Encrypted.keys}
+	nonce, _ := enc.GenNonce()
+	contents := []byte("secret meme\n")
+	check(t, enc.PostReader("blob", bytes.NewReader(contents), -1, "", nonce))
+	expectBlob(t, enc, "blob", nonce, contents)
+
+	cached, err := ioutil.ReadFile(c.file("blob"))
+	check(t, err)
+	if bytes.Contains(cached, contents) {
+		t.Errorf("cached in plaintext")
+	}
+
+	var other [32]byte
+	other[0] = 1
+	rekeyed := &encryptedStore{backend: backend.store, keys: []masterKey{{id: "2", key: other}}}
+	check(t, rekeyed.PostReader("blob", bytes.NewReader(contents), -1, "", nonce))
+	enc.keys = append([]masterKey{}, rekeyed.keys...)
+	expectBlob(t, enc, "blob", nonce, contents)
+}
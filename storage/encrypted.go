@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/minio/sio"
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptedStore wraps any backend with sio (DARE) encryption. Every blob
+// gets its own key, derived from a master key and the blob's nonce via
+// HKDF, and is encrypted and decrypted as it streams through. Blobs are
+// written under the current master key, and read with whichever of the
+// keys opens them, so retired keys keep working until Rekey is done
+type encryptedStore struct {
+	backend store
+	keys    []masterKey // the current key first
+	keyID   string      // tried first on reads, see WithKey
+}
+
+type masterKey struct {
+	id  string
+	key [32]byte
+}
+
+// Encrypted ...
+var Encrypted encryptedStore
+
+// sio writes DARE 2.0 packages of 64KB plaintext each,
+// sealed with a 16 byte header and a 16 byte tag
+const (
+	packagePayloadSize = 1 << 16
+	packageSize        = 16 + packagePayloadSize + 16
+)
+
+// the id of ENCRYPTION_KEY when ENCRYPTION_KEY_ID is not set,
+// which is also what blobs from before key ids are marked with
+const defaultKeyID = "1"
+
+// Init reads the master keys, the backend is initialized on its own.
+// ENCRYPTION_KEY is preferred, LOCAL_ENCRYPTION_KEY is what local
+// deployments have always set. Keys being rotated out go in
+// RETIRED_ENCRYPTION_KEYS as "id:hexkey,id:hexkey". A missing or
+// malformed key stops the server rather than encrypting with zeros
+func (store encryptedStore) Init() {
+	key := os.Getenv("ENCRYPTION_KEY")
+	if key == "" {
+		key = os.Getenv("LOCAL_ENCRYPTION_KEY")
+	}
+	id := os.Getenv("ENCRYPTION_KEY_ID")
+	if id == "" {
+		id = defaultKeyID
+	}
+	keys, err := parseKeys(id, key, os.Getenv("RETIRED_ENCRYPTION_KEYS"))
+	if err != nil {
+		log.Fatalf("encryption keys: %v", err)
+	}
+	Encrypted.keys = keys
+}
+
+func parseKeys(currentID, current, retired string) ([]masterKey, error) {
+	keys := []masterKey{}
+	add := func(id, hexKey string) error {
+		if id == "" {
+			return errors.New("empty key id")
+		}
+		for _, k := range keys {
+			if k.id == id {
+				return fmt.Errorf("key id %s is used twice", id)
+			}
+		}
+		b, err := hex.DecodeString(hexKey)
+		if err != nil || len(b) != 32 {
+			return fmt.Errorf("key %s must be 32 bytes of hex", id)
+		}
+		k := masterKey{id: id}
+		copy(k.key[:], b)
+		keys = append(keys, k)
+		return nil
+	}
+	if current == "" {
+		return nil, errors.New("ENCRYPTION_KEY is not set")
+	}
+	if err := add(currentID, current); err != nil {
+		return nil, err
+	}
+	for _, pair := range strings.Split(retired, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("retired key %q is not id:hexkey", pair)
+		}
+		if err := add(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// EncryptedSize is how long n bytes of plaintext are once sealed
+func EncryptedSize(n int64) (int64, error) {
+	size, err := sio.EncryptedSize(uint64(n))
+	return int64(size), err
+}
+
+// IsUnauthentic is whether err is a blob that did not
+// decrypt, under the wrong key or tampered with
+func IsUnauthentic(err error) bool {
+	_, ok := err.(sio.Error)
+	return ok
+}
+
+// KeyID is the id of the key new blobs are written with
+func (store encryptedStore) KeyID() string {
+	return store.keys[0].id
+}
+
+// BlobKey is the key of a single blob, written with the master key
+// keyID. It opens that blob and nothing else, for clients that
+// download the ciphertext directly and decrypt it themselves
+func (store encryptedStore) BlobKey(keyID string, nonce [32]byte) ([32]byte, error) {
+	for _, k := range store.keys {
+		if k.id == keyID {
+			return deriveKey(k.key, nonce)
+		}
+	}
+	return [32]byte{}, fmt.Errorf("unknown key id %s", keyID)
+}
+
+// WithKey is the store for reading a blob recorded as written with the
+// master key keyID. That key is tried first, so a blob under a retired
+// key costs one read, and the others only if it does not open the blob
+func (store encryptedStore) WithKey(keyID string) *encryptedStore {
+	store.keyID = keyID
+	return &store
+}
+
+func (store encryptedStore) GetReader(path string, nonce [32]byte) (rc io.ReadCloser, err error) {
+	return store.GetRangeReader(path, nonce, 0, -1)
+}
+
+// GetRangeReader tries the master keys in turn, the one from WithKey
+// and then the current one first. A key that does not authenticate
+// the first package moves on to the next
+func (store encryptedStore) GetRangeReader(path string, nonce [32]byte, offset, length int64) (rc io.ReadCloser, err error) {
+	_, rc, err = store.open(path, nonce, offset, length)
+	return rc, err
+}
+
+func (store encryptedStore) open(path string, nonce [32]byte, offset, length int64) (string, io.ReadCloser, error) {
+	id, rc, err := store.openWithKeys(path, nonce, offset, length)
+	if _, ok := err.(sio.Error); ok {
+		// a cached copy can be from before another
+		// server rekeyed the blob with a key since retired
+		if c, ok := store.backend.(*cachedStore); ok {
+			c.Invalidate(path)
+			return store.openWithKeys(path, nonce, offset, length)
+		}
+	}
+	return id, rc, err
+}
+
+func (store encryptedStore) openWithKeys(path string, nonce [32]byte, offset, length int64) (string, io.ReadCloser, error) {
+	err := errors.New("no encryption keys")
+	for _, k := range store.readOrder() {
+		var rc io.ReadCloser
+		rc, err = store.rangeReader(k.key, path, nonce, offset, length)
+		if err == nil {
+			return k.id, rc, nil
+		}
+		if _, ok := err.(sio.Error); !ok {
+			return "", nil, err
+		}
+	}
+	return "", nil, err
+}
+
+// readOrder is the keys with the one from WithKey moved to the front
+func (store encryptedStore) readOrder() []masterKey {
+	if store.keyID == "" || store.keyID == store.keys[0].id {
+		return store.keys
+	}
+	keys := make([]masterKey, 0, len(store.keys))
+	for _, k := range store.keys {
+		if k.id == store.keyID {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range store.keys {
+		if k.id != store.keyID {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// rangeReader decrypts only the packages that hold the requested range:
+// it asks the backend for the ciphertext from the package containing
+// offset, tells sio which sequence number to expect there, and skips the
+// leading bytes of that package. The first package is read right away,
+// so a wrong key fails here rather than halfway through a response
+func (store encryptedStore) rangeReader(master [32]byte, path string, nonce [32]byte, offset, length int64) (rc io.ReadCloser, err error) {
+	key, err := deriveKey(master, nonce)
+	if err != nil {
+		return nil, err
+	}
+	seq := offset / packagePayloadSize
+	encLength := int64(-1)
+	if length >= 0 {
+		last := (offset + length - 1) / packagePayloadSize
+		if length == 0 {
+			last = seq
+		}
+		encLength = (last - seq + 1) * packageSize
+	}
+	src, err := store.backend.GetRangeReader(path, nonce, seq*packageSize, encLength)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := sio.DecryptReader(src, sio.Config{
+		Key:            key[:],
+		SequenceNumber: uint32(seq),
+	})
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	buffered := bufio.NewReaderSize(decrypted, packagePayloadSize)
+	if _, err := buffered.Peek(1); err != nil && err != io.EOF {
+		src.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, buffered, offset%packagePayloadSize); err != nil {
+		src.Close()
+		return nil, err
+	}
+	var reader io.Reader = buffered
+	if length >= 0 {
+		reader = io.LimitReader(buffered, length)
+	}
+	return readCloser{reader, src}, nil
+}
+
+func (store encryptedStore) PostReader(path string, src io.Reader, length int64, contentType string, nonce [32]byte) error {
+	key, err := deriveKey(store.keys[0].key, nonce)
+	if err != nil {
+		return err
+	}
+	encrypted, err := sio.EncryptReader(src, sio.Config{Key: key[:]})
+	if err != nil {
+		return err
+	}
+	encLength := int64(-1)
+	if length >= 0 {
+		size, err := sio.EncryptedSize(uint64(length))
+		if err == nil {
+			encLength = int64(size)
+		}
+	}
+	return store.backend.PostReader(path, encrypted, encLength, "application/octet-stream", nonce)
+}
+
+func (store encryptedStore) Move(from, to string) error {
+	return store.backend.Move(from, to)
+}
+
+func (store encryptedStore) Delete(path string) error {
+	return store.backend.Delete(path)
+}
+
+func (store encryptedStore) List(path string) ([]string, error) {
+	return store.backend.List(path)
+}
+
+func (store encryptedStore) GenNonce() ([32]byte, error) {
+	return store.backend.GenNonce()
+}
+
+// IsEncrypted checks whether a blob in the backend is already sealed
+// with one of the keys, by authenticating the first package
+func (store encryptedStore) IsEncrypted(path string, nonce [32]byte) (bool, error) {
+	rc, err := store.GetRangeReader(path, nonce, 0, 1)
+	if err != nil {
+		if _, ok := err.(sio.Error); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	rc.Close()
+	return true, nil
+}
+
+// EncryptInPlace rewrites a plaintext blob in the backend as an
+// encrypted one. Blobs that already decrypt are left alone, so an
+// interrupted migration can simply be run again
+func (store encryptedStore) EncryptInPlace(path string, nonce [32]byte, contentType string) error {
+	done, err := store.IsEncrypted(path, nonce)
+	if err != nil {
+		return err
+	}
+	if done {
+		return nil
+	}
+	plain, err := store.backend.GetReader(path, nonce)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	return store.replace(path, plain, contentType, nonce, "_encrypting")
+}
+
+// Rekey rewrites a blob under the current key if one of the retired
+// keys opens it. Blobs already under the current key are left alone
+func (store encryptedStore) Rekey(path string, nonce [32]byte, contentType string) error {
+	id, rc, err := store.open(path, nonce, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if id == store.KeyID() {
+		return nil
+	}
+	return store.replace(path, rc, contentType, nonce, "_rekeying")
+}
+
+// replace writes src encrypted to a staging key next to path and
+// moves it over path, so a failed write leaves the original alone
+func (store encryptedStore) replace(path string, src io.Reader, contentType string, nonce [32]byte, suffix string) error {
+	staging := path + suffix
+	if err := store.PostReader(staging, src, -1, contentType, nonce); err != nil {
+		store.backend.Delete(staging)
+		return err
+	}
+	return store.backend.Move(staging, path)
+}
+
+// derive the per-file encryption key from a master key and the nonce
+func deriveKey(master [32]byte, nonce [32]byte) ([32]byte, error) {
+	var key [32]byte
+	kdf := hkdf.New(sha256.New, master[:], nonce[:], nil)
+	_, err := io.ReadFull(kdf, key[:])
+	return key, err
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/joho/godotenv"
+)
+
+// a key for runs without a .env, Init refuses to go without one
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// Encrypted over the local backend, the way Init wires it up
+func initEncryptedLocal() {
+	godotenv.Load("../.env")
+	if os.Getenv("ENCRYPTION_KEY") == "" && os.Getenv("LOCAL_ENCRYPTION_KEY") == "" {
+		os.Setenv("ENCRYPTION_KEY", testKey)
+	}
+	Local.Init()
+	Encrypted.backend = &Local
+	Encrypted.Init()
+	Store = &Encrypted
+}
+
+func TestEncryption(t *testing.T) {
+	initEncryptedLocal()
+
+	nonce, _ := Store.GenNonce()
+	contents, err := ioutil.ReadFile("files/test.txt")
+	check(t, err)
+
+	f, err := os.Open("files/test.txt")
+	check(t, err)
+	defer f.Close()
+	check(t, Store.PostReader("encrypted.txt", f, -1, "text/plain", nonce))
+	defer os.Remove(Local.prefix + "/encrypted.txt")
+
+	// sealed in the backend
+	sealed, err := ioutil.ReadFile(Local.prefix + "/encrypted.txt")
+	check(t, err)
+	if bytes.Contains(sealed, contents) {
+		t.Errorf("stored in plaintext")
+	}
+
+	rc, err := Store.GetReader("encrypted.txt", nonce)
+	check(t, err)
+	decrypted, err := ioutil.ReadAll(rc)
+	rc.Close()
+	check(t, err)
+	if !bytes.Equal(decrypted, contents) {
+		t.Errorf("not equal")
+	}
+}
+
+func TestEncryptedRange(t *testing.T) {
+	initEncryptedLocal()
+
+	nonce, _ := Store.GenNonce()
+
+	// spans a few 64KB packages and ends on a partial one
+	contents := make([]byte, 3*packagePayloadSize+1234)
+	rand.Read(contents)
+
+	err := Store.PostReader("range.bin", bytes.NewReader(contents), int64(len(contents)), "", nonce)
+	check(t, err)
+	defer os.Remove(Local.prefix + "/range.bin")
+
+	ranges := []struct {
+		offset int64
+		length int64
+	}{
+		{0, 10},
+		{0, -1},
+		{100, 1000},
+		{packagePayloadSize - 5, 10}, // across a package boundary
+		{packagePayloadSize, packagePayloadSize},
+		{2*packagePayloadSize + 7, -1}, // into the final package
+		{int64(len(contents)) - 1, 1},
+	}
+	for _, rg := range ranges {
+		rc, err := Store.GetRangeReader("range.bin", nonce, rg.offset, rg.length)
+		check(t, err)
+		got, err := ioutil.ReadAll(rc)
+		check(t, err)
+		rc.Close()
+
+		end := int64(len(contents))
+		if rg.length >= 0 {
+			end = rg.offset + rg.length
+		}
+		if !bytes.Equal(got, contents[rg.offset:end]) {
+			t.Errorf("range %d+%d not equal", rg.offset, rg.length)
+		}
+	}
+
+	// the backend only ever sees ciphertext
+	raw, err := Local.GetReader("range.bin", nonce)
+	check(t, err)
+	rawContents, _ := ioutil.ReadAll(raw)
+	raw.Close()
+	if bytes.Contains(rawContents, contents[:64]) {
+		t.Errorf("plaintext found in the backend")
+	}
+
+	// a package opened with the wrong key must not decrypt
+	rc, err := Store.GetRangeReader("range.bin", [32]byte{}, packagePayloadSize, 10)
+	if err == nil {
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+	}
+	if err == nil {
+		t.Errorf("expected decryption with the wrong nonce to fail")
+	}
+}
+
+func TestEncryptInPlace(t *testing.T) {
+	initEncryptedLocal()
+
+	nonce, _ := Store.GenNonce()
+	contents := make([]byte, packagePayloadSize+10)
+	rand.Read(contents)
+
+	// a blob from before encryption at rest
+	err := Local.PostReader("legacy.bin", bytes.NewReader(contents), -1, "", nonce)
+	check(t, err)
+	defer os.Remove(Local.prefix + "/legacy.bin")
+
+	done, err := Encrypted.IsEncrypted("legacy.bin", nonce)
+	check(t, err)
+	if done {
+		t.Errorf("plaintext reported as encrypted")
+	}
+
+	// running twice must not encrypt twice
+	check(t, Encrypted.EncryptInPlace("legacy.bin", nonce, ""))
+	check(t, Encrypted.EncryptInPlace("legacy.bin", nonce, ""))
+
+	rc, err := Store.GetReader("legacy.bin", nonce)
+	check(t, err)
+	got, err := ioutil.ReadAll(rc)
+	check(t, err)
+	rc.Close()
+	if !bytes.Equal(got, contents) {
+		t.Errorf("not equal after encrypting in place")
+	}
+}
+
+func TestReadSeeker(t *testing.T) {
+	initEncryptedLocal()
+
+	nonce, _ := Store.GenNonce()
+
+	contents := make([]byte, 2*packagePayloadSize+99)
+	rand.Read(contents)
+
+	err := Store.PostReader("seek.bin", bytes.NewReader(contents), int64(len(contents)), "", nonce)
+	check(t, err)
+	defer os.Remove(Local.prefix + "/seek.bin")
+
+	counted := &countingStore{store: Store}
+	rs := NewReadSeeker(counted, "seek.bin", nonce, int64(len(contents)))
+	defer rs.Close()
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	check(t, err)
+	if size != int64(len(contents)) {
+		t.Errorf("wrong size %d", size)
+	}
+
+	offset := int64(packagePayloadSize + 42)
+	rs.Seek(offset, io.SeekStart)
+	got := make([]byte, 500)
+	_, err = io.ReadFull(rs, got)
+	check(t, err)
+	if !bytes.Equal(got, contents[offset:offset+500]) {
+		t.Errorf("seeked read not equal")
+	}
+	// opened once, where it was seeked to
+	if counted.ranges != 1 {
+		t.Errorf("opened %d times", counted.ranges)
+	}
+
+	rs.Seek(0, io.SeekStart)
+	all, err := ioutil.ReadAll(rs)
+	check(t, err)
+	if !bytes.Equal(all, contents) {
+		t.Errorf("full read not equal")
+	}
+
+	missing := NewReadSeeker(Store, "missing.bin", nonce, 10)
+	if _, err := missing.Read(got); err == nil {
+		t.Errorf("expected missing blob to fail")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	other := "ff" + testKey[2:]
+	keys, err := parseKeys("2", other, "1:"+testKey)
+	check(t, err)
+	if len(keys) != 2 || keys[0].id != "2" || keys[1].id != "1" || keys[1].key[1] != 1 {
+		t.Errorf("wrong keys %v", keys)
+	}
+
+	for _, bad := range [][3]string{
+		{"1", "", ""},                      // missing
+		{"1", "abc", ""},                   // not 32 bytes
+		{"1", testKey, "1:" + other},       // id used twice
+		{"1", testKey, "2" + other},        // no id
+		{"1", testKey, "2:" + testKey[2:]}, // short retired key
+	} {
+		if _, err := parseKeys(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	initEncryptedLocal()
+	old := encryptedStore{backend: &Local}
+	oldKey := masterKey{id: "old"}
+	rand.Read(oldKey.key[:])
+	old.keys = []masterKey{oldKey}
+	newKey := masterKey{id: "new"}
+	rand.Read(newKey.key[:])
+	rotated := encryptedStore{backend: &Local, keys: []masterKey{newKey, oldKey}}
+
+	nonce, _ := old.GenNonce()
+	contents := make([]byte, packagePayloadSize+10)
+	rand.Read(contents)
+	check(t, old.PostReader("rekey.bin", bytes.NewReader(contents), -1, "", nonce))
+	defer os.Remove(Local.prefix + "/rekey.bin")
+
+	// the retired key still reads, ranges included
+	expectBlob(t, &rotated, "rekey.bin", nonce, contents)
+	rc, err := rotated.GetRangeReader("rekey.bin", nonce, packagePayloadSize, 10)
+	check(t, err)
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, contents[packagePayloadSize:]) {
+		t.Errorf("range under the retired key not equal")
+	}
+
+	// with the key recorded for it, the blob is opened once
+	counted := &countingStore{store: &Local}
+	withKey := encryptedStore{backend: counted, keys: rotated.keys}
+	expectBlob(t, withKey.WithKey("old"), "rekey.bin", nonce, contents)
+	if counted.ranges != 1 {
+		t.Errorf("opened %d times with its key", counted.ranges)
+	}
+	// and a wrong record falls back to the other keys
+	expectBlob(t, withKey.WithKey("new"), "rekey.bin", nonce, contents)
+
+	check(t, rotated.WithKey("old").Rekey("rekey.bin", nonce, ""))
+	check(t, rotated.Rekey("rekey.bin", nonce, ""))
+
+	current := encryptedStore{backend: &Local, keys: []masterKey{newKey}}
+	expectBlob(t, &current, "rekey.bin", nonce, contents)
+	if _, err := old.GetReader("rekey.bin", nonce); err == nil {
+		t.Errorf("still readable with the retired key")
+	}
+}
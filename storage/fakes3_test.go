@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeS3 is a minimal in-memory S3-compatible server, path-style only,
+// covering the calls our backends make: put, ranged get, delete, list
+// (v1 and v2), server side copy and multipart uploads. It does not check
+// signatures. Set S3_TEST_ENDPOINT to run the suite against a real
+// server like MinIO instead
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte         // bucket/key
+	uploads map[string]map[int][]byte // uploadId -> parts
+	nextID  int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+func etag(b []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(b))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucketName, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucketName, key = path[:i], path[i+1:]
+	}
+	q := r.URL.Query()
+	name := bucketName + "/" + key
+
+	switch {
+	case r.Method == "GET" && key == "":
+		f.list(w, bucketName, q)
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		obj, ok := f.objects[name]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(obj))
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(obj))
+
+	case r.Method == "POST" && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucketName, key, id)
+
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		nums := []int{}
+		for n := range parts {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		obj := []byte{}
+		for _, n := range nums {
+			obj = append(obj, parts[n]...)
+		}
+		f.objects[name] = obj
+		delete(f.uploads, q.Get("uploadId"))
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, bucketName, key, etag(obj))
+
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		obj, ok := f.objects[strings.TrimPrefix(source, "/")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[name] = append([]byte{}, obj...)
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>`, etag(obj), time.Now().UTC().Format(time.RFC3339))
+
+	case r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[name] = body
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "DELETE":
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+type fakeListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []fakeListObject
+	// v2 pages with an opaque token, which here is the last key
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+type fakeListObject struct {
+	Key          string
+	Size         int
+	ETag         string
+	LastModified string
+	StorageClass string
+}
+
+// pages are kept small so that callers have to paginate
+const fakeListPageSize = 2
+
+func (f *fakeS3) list(w http.ResponseWriter, bucketName string, q url.Values) {
+	prefix := q.Get("prefix")
+	after := q.Get("marker")
+	if q.Get("list-type") == "2" {
+		after = q.Get("continuation-token")
+	}
+	keys := []string{}
+	for name := range f.objects {
+		key := strings.TrimPrefix(name, bucketName+"/")
+		if key == name || !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := fakeListResult{Name: bucketName, Prefix: prefix, MaxKeys: fakeListPageSize}
+	if len(keys) > fakeListPageSize {
+		keys = keys[:fakeListPageSize]
+		result.IsTruncated = true
+	}
+	for _, key := range keys {
+		obj := f.objects[bucketName+"/"+key]
+		result.Contents = append(result.Contents, fakeListObject{
+			Key:          key,
+			Size:         len(obj),
+			ETag:         etag(obj),
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	if result.IsTruncated && q.Get("list-type") == "2" {
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+
+	out, _ := xml.Marshal(result)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(out)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
@@ -1,22 +1,19 @@
 package storage
 
 import (
-	"bytes"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
-
-	"github.com/minio/sio"
-	"golang.org/x/crypto/hkdf"
+	"path/filepath"
+	"strings"
 )
 
+// localStore keeps blobs as files in a directory. It stores
+// exactly what it is given, encryption happens in encryptedStore
 type localStore struct {
-	prefix    string
-	masterKey [32]byte
+	prefix string
 }
 
 // Local ...
@@ -27,37 +24,40 @@ func (store localStore) Init() {
 	if dir == "" {
 		dir = "files"
 	}
-	key := os.Getenv("LOCAL_ENCRYPTION_KEY")
-	eKey, err := hex.DecodeString(key)
-	var keyBytes [32]byte
-	if err == nil {
-		copy(keyBytes[:], eKey)
-		Local.masterKey = keyBytes
-	}
 	Local.prefix = dir
 }
 
 func (store localStore) GetReader(path string, nonce [32]byte) (rc io.ReadCloser, err error) {
 	// fmt.Println(store.prefix + "/" + path)
+	return os.Open(store.prefix + "/" + path)
+}
+
+func (store localStore) GetRangeReader(path string, nonce [32]byte, offset, length int64) (rc io.ReadCloser, err error) {
 	f, err := os.Open(store.prefix + "/" + path)
 	if err != nil {
 		return nil, err
 	}
-	buf := new(bytes.Buffer)
-	store.decryptReader(buf, f, nonce)
-	return ioutil.NopCloser(buf), nil
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return readCloser{io.LimitReader(f, length), f}, nil
 }
 
+// Delete succeeds for files that do not exist, like the s3 backends
 func (store localStore) Delete(path string) error {
 	var err = os.Remove(store.prefix + "/" + path)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	fmt.Println("==> done deleting file")
 	return nil
 }
 
-func (store localStore) PostReader(path string, buf *bytes.Buffer, length int64, contentType string, nonce [32]byte) error {
+func (store localStore) PostReader(path string, src io.Reader, length int64, contentType string, nonce [32]byte) error {
 	file, err := os.Create(store.prefix + "/" + path)
 	if err != nil {
 		fmt.Println(err)
@@ -65,61 +65,40 @@ func (store localStore) PostReader(path string, buf *bytes.Buffer, length int64,
 	}
 	defer file.Close()
 
-	if err := store.encryptReader(file, buf, nonce); err != nil {
+	if _, err := io.Copy(file, src); err != nil {
 		fmt.Println(err)
+		os.Remove(store.prefix + "/" + path)
+		return err
 	}
 	return file.Sync()
 }
 
-// UNIMPLEMENTED
-func (store localStore) List(path string) ([]string, error) {
-	return []string{}, nil
-}
-
-func (store localStore) encryptReader(dest io.Writer, src io.Reader, nonce [32]byte) error {
-
-	// derive an encryption key from the master key and the nonce
-	var key [32]byte
-	kdf := hkdf.New(sha256.New, store.masterKey[:], nonce[:], nil)
-	if _, err := io.ReadFull(kdf, key[:]); err != nil {
-		fmt.Printf("Failed to derive encryption key: %v", err) // add error handling
-		return err
-	}
-
-	encrypted, err := sio.EncryptReader(src, sio.Config{Key: key[:]})
-	if err != nil {
-		fmt.Printf("Failed to encrypted reader: %v", err) // add error handling
-		return err
-	}
-
-	// the encrypted io.Reader can be used like every other reader - e.g. for copying
-	if _, err := io.Copy(dest, encrypted); err != nil {
-		fmt.Printf("Failed to copy data: %v", err) // add error handling
-		return err
-	}
-
-	return nil
+func (store localStore) Move(from, to string) error {
+	return os.Rename(store.prefix+"/"+from, store.prefix+"/"+to)
 }
 
-func (store localStore) decryptReader(dest io.Writer, src io.Reader, nonce [32]byte) error {
-
-	// derive the encryption key from the master key and the nonce
-	var key [32]byte
-	kdf := hkdf.New(sha256.New, store.masterKey[:], nonce[:], nil)
-	if _, err := io.ReadFull(kdf, key[:]); err != nil {
-		fmt.Printf("Failed to derive encryption key: %v", err) // add error handling
-		return err
-	}
-
-	if _, err := sio.Decrypt(dest, src, sio.Config{Key: key[:]}); err != nil {
-		if _, ok := err.(sio.Error); ok {
-			fmt.Printf("Malformed encrypted data: %v", err) // add error handling - here we know that the data is malformed/not authentic.
+// List returns every file under the directory whose name
+// starts with path, relative to the directory
+func (store localStore) List(path string) ([]string, error) {
+	names := []string{}
+	err := filepath.WalkDir(store.prefix, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
-		fmt.Printf("Failed to decrypt data: %v", err) // add error handling
-		return err
-	}
-	return nil
+		if d.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(store.prefix, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, path) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
 }
 
 func (store localStore) GenNonce() ([32]byte, error) {
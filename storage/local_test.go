@@ -2,8 +2,7 @@ package storage
 
 import (
 	"bytes"
-	"io/ioutil"
-	"os"
+	"sort"
 	"testing"
 
 	"github.com/joho/godotenv"
@@ -40,39 +39,22 @@ func TestLocalFile(t *testing.T) {
 	}
 }
 
-func TestLocalEncryption(t *testing.T) {
-	godotenv.Load("../.env")
-	Store := &Local
-	Store.Init()
-
-	nonce, _ := Store.GenNonce()
-
-	os.Remove("files/encrypted.md")
-	os.Remove("files/decrypted.md")
-
-	f, err := os.Open("files/test.txt")
-	check(t, err)
-	defer f.Close()
-
-	encrypted, err := os.Create("files/encrypted.txt")
-	err = Store.encryptReader(encrypted, f, nonce)
-	check(t, err)
-	defer encrypted.Close()
-
-	f2, err := os.Open("files/encrypted.txt")
-	check(t, err)
-	defer f2.Close()
+func TestLocalList(t *testing.T) {
+	store := localStore{prefix: t.TempDir()}
+	var nonce [32]byte
+	for _, name := range []string{"abc", "abc_thumb", "abd", "xyz"} {
+		check(t, store.PostReader(name, bytes.NewReader([]byte(name)), -1, "", nonce))
+	}
 
-	decrypted, err := os.Create("files/decrypted.txt")
-	err = Store.decryptReader(decrypted, f2, nonce)
+	all, err := store.List("")
 	check(t, err)
-	defer decrypted.Close()
-
-	contents, err := ioutil.ReadFile("files/test.txt")
-	decryptedContents, err := ioutil.ReadFile("files/decrypted.txt")
+	if len(all) != 4 {
+		t.Errorf("wrong listing %v", all)
+	}
+	some, err := store.List("abc")
 	check(t, err)
-
-	if string(contents) != string(decryptedContents) {
-		t.Errorf("not equal")
+	sort.Strings(some)
+	if len(some) != 2 || some[0] != "abc" || some[1] != "abc_thumb" {
+		t.Errorf("wrong listing %v", some)
 	}
 }
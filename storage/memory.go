@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps blobs in a map, for tests and trying the server
+// out without a disk or bucket. Like localStore it stores exactly what
+// it is given, encryption happens in encryptedStore
+type memoryStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// Memory ...
+var Memory = memoryStore{files: map[string][]byte{}}
+
+// Init empties the store
+func (store *memoryStore) Init() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.files = map[string][]byte{}
+}
+
+func (store *memoryStore) get(path string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	b, ok := store.files[path]
+	if !ok {
+		return nil, fmt.Errorf("%s: not found", path)
+	}
+	return b, nil
+}
+
+func (store *memoryStore) GetReader(path string, nonce [32]byte) (io.ReadCloser, error) {
+	return store.GetRangeReader(path, nonce, 0, -1)
+}
+
+// GetRangeReader reads a snapshot, a blob written meanwhile
+// is a new slice and leaves it alone
+func (store *memoryStore) GetRangeReader(path string, nonce [32]byte, offset, length int64) (io.ReadCloser, error) {
+	b, err := store.get(path)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	b = b[offset:]
+	if length >= 0 && length < int64(len(b)) {
+		b = b[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (store *memoryStore) PostReader(path string, src io.Reader, length int64, contentType string, nonce [32]byte) error {
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.files[path] = b
+	return nil
+}
+
+func (store *memoryStore) Move(from, to string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	b, ok := store.files[from]
+	if !ok {
+		return fmt.Errorf("%s: not found", from)
+	}
+	store.files[to] = b
+	delete(store.files, from)
+	return nil
+}
+
+// Delete succeeds for blobs that do not exist, like the other backends
+func (store *memoryStore) Delete(path string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.files, path)
+	return nil
+}
+
+func (store *memoryStore) List(path string) ([]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	keys := []string{}
+	for k := range store.files {
+		if strings.HasPrefix(k, path) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (store *memoryStore) GenNonce() ([32]byte, error) {
+	var nonce [32]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		fmt.Printf("Failed to read random data: %v", err) // add error handling
+		return nonce, err
+	}
+	return nonce, nil
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the memory store behaves like the buckets do
+func TestMemory(t *testing.T) {
+	testS3Backend(t, &memoryStore{files: map[string][]byte{}})
+}
+
+func TestMemoryInit(t *testing.T) {
+	t.Setenv("STORAGE_MODE", "memory")
+	t.Setenv("ENCRYPTION_KEY", testKey)
+	t.Setenv("CACHE_DIR", "")
+	raw := Raw
+	Init()
+	defer func() {
+		Raw = raw
+		initEncryptedLocal()
+	}()
+
+	nonce, _ := Store.GenNonce()
+	contents := []byte("nothing on disk\n")
+	check(t, Store.PostReader("mem.txt", bytes.NewReader(contents), -1, "", nonce))
+	expectBlob(t, Store, "mem.txt", nonce, contents)
+
+	stored, err := Memory.get("mem.txt")
+	check(t, err)
+	if bytes.Contains(stored, contents) {
+		t.Errorf("stored in plaintext")
+	}
+}
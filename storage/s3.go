@@ -5,7 +5,8 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
-	"os"
+	"net/url"
+	"strings"
 
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
@@ -22,21 +23,31 @@ type s3store struct {
 var space s3store
 
 func (store s3store) Init() {
-	s3Key := os.Getenv("S3_KEY")
-	s3Secret := os.Getenv("S3_SECRET")
-	if s3Key == "" || s3Secret == "" {
-		connection := s3.New(aws.Auth{}, aws.USEast)
-		space.bucket = connection.Bucket("sphinx-memes")
-	} else {
-		AWSAuth := aws.Auth{
-			AccessKey: s3Key,
-			SecretKey: s3Secret,
+	space = newS3Store(s3ConfigFromEnv(""))
+}
+
+func newS3Store(c s3Config) s3store {
+	// https://github.com/goamz/goamz/blob/master/aws/regions.go
+	region, ok := aws.Regions[c.Region]
+	if !ok {
+		region = aws.USEast
+	}
+	if c.Endpoint != "" {
+		region = aws.Region{
+			Name:       c.Region,
+			S3Endpoint: c.Endpoint,
+		}
+		// goamz uses the bucket endpoint for virtual-host style,
+		// and falls back to the path without it
+		if !c.PathStyle {
+			u, err := url.Parse(c.Endpoint)
+			if err == nil {
+				region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+			}
 		}
-		// https://github.com/goamz/goamz/blob/master/aws/regions.go
-		connection := s3.New(AWSAuth, aws.USEast)
-		space.bucket = connection.Bucket("sphinx-memes")
 	}
-	space.prefix = ""
+	connection := s3.New(aws.Auth{AccessKey: c.Key, SecretKey: c.Secret}, region)
+	return s3store{bucket: connection.Bucket(c.Bucket), prefix: c.Prefix}
 }
 
 func (store s3store) Delete(path string) error {
@@ -52,23 +63,45 @@ func (store s3store) GetReader(path string, nonce [32]byte) (rc io.ReadCloser, e
 	return reader, nil
 }
 
-func (store s3store) List(path string) ([]string, error) {
-	list, err := store.bucket.List(store.prefix+path, "", "", 0)
-
+func (store s3store) GetRangeReader(path string, nonce [32]byte, offset, length int64) (rc io.ReadCloser, err error) {
+	resp, err := store.bucket.GetResponseWithHeaders(store.prefix+path, map[string][]string{
+		"Range": {rangeHeader(offset, length)},
+	})
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
+	return resp.Body, nil
+}
+
+// List returns every path under the given one, following the
+// pagination. The configured key prefix is stripped off again
+func (store s3store) List(path string) ([]string, error) {
 	keys := []string{}
-	for _, pic := range list.Contents {
-		keys = append(keys, pic.Key)
+	marker := ""
+	for {
+		list, err := store.bucket.List(store.prefix+path, "", marker, 0)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		for _, pic := range list.Contents {
+			keys = append(keys, strings.TrimPrefix(pic.Key, store.prefix))
+			marker = pic.Key
+		}
+		if !list.IsTruncated || len(list.Contents) == 0 {
+			return keys, nil
+		}
 	}
-	return keys, nil
 }
 
-func (store s3store) PostReader(path string, file *bytes.Buffer, length int64, contentType string, nonce [32]byte) error {
-	//reader := bytes.NewReader(file)
+// smallest part size s3 accepts for all but the last part
+const multiPartSize = 5 << 20
+
+func (store s3store) PostReader(path string, file io.Reader, length int64, contentType string, nonce [32]byte) error {
 	// fmt.Println("POST READER NOW " + path)
+	if length < 0 {
+		return store.postMulti(path, file, contentType)
+	}
 	err := store.bucket.PutReader(store.prefix+path, file, length, contentType, s3.Private, s3.Options{})
 	if err != nil {
 		fmt.Println("error posting file: " + err.Error())
@@ -77,6 +110,48 @@ func (store s3store) PostReader(path string, file *bytes.Buffer, length int64, c
 	return nil
 }
 
+// postMulti uploads a body of unknown length as a multipart
+// upload, holding at most one part in memory at a time
+func (store s3store) postMulti(path string, file io.Reader, contentType string) error {
+	multi, err := store.bucket.InitMulti(store.prefix+path, contentType, s3.Private)
+	if err != nil {
+		fmt.Println("error posting file: " + err.Error())
+		return err
+	}
+	chunk := make([]byte, multiPartSize)
+	parts := []s3.Part{}
+	for n := 1; ; n++ {
+		read, err := io.ReadFull(file, chunk)
+		if err == io.EOF && n > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			multi.Abort()
+			return err
+		}
+		part, perr := multi.PutPart(n, bytes.NewReader(chunk[:read]))
+		if perr != nil {
+			fmt.Println("error posting file: " + perr.Error())
+			multi.Abort()
+			return perr
+		}
+		parts = append(parts, part)
+		if err != nil { // short read, that was the last part
+			break
+		}
+	}
+	return multi.Complete(parts)
+}
+
+func (store s3store) Move(from, to string) error {
+	source := store.bucket.Name + "/" + url.PathEscape(store.prefix+from)
+	_, err := store.bucket.PutCopy(store.prefix+to, s3.Private, s3.CopyOptions{}, source)
+	if err != nil {
+		return err
+	}
+	return store.bucket.Del(store.prefix + from)
+}
+
 func (store s3store) GenNonce() ([32]byte, error) {
 	var nonce [32]byte
 	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
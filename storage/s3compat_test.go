@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/minio/sio"
+)
+
+// testS3Config points both s3 backends at the in-memory fake, or at a
+// real S3-compatible server when S3_TEST_ENDPOINT is set, e.g. for MinIO:
+//
+//	S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_BUCKET=memes-test \
+//	S3_TEST_KEY=minioadmin S3_TEST_SECRET=minioadmin go test ./storage
+func testS3Config(t *testing.T) s3Config {
+	c := s3Config{
+		Endpoint:  os.Getenv("S3_TEST_ENDPOINT"),
+		PathStyle: true,
+		Region:    "us-east-1",
+		Bucket:    os.Getenv("S3_TEST_BUCKET"),
+		Key:       os.Getenv("S3_TEST_KEY"),
+		Secret:    os.Getenv("S3_TEST_SECRET"),
+	}
+	if c.Endpoint == "" {
+		server := httptest.NewServer(newFakeS3())
+		t.Cleanup(server.Close)
+		c.Endpoint = server.URL
+		c.Bucket = "memes-test"
+		c.Key = "test"
+		c.Secret = "test"
+	}
+	return c
+}
+
+func s3Backends(t *testing.T, prefix string) map[string]store {
+	c := testS3Config(t)
+	c.Prefix = prefix
+	aws3, err := newAws3Store(c)
+	check(t, err)
+	goamz := newS3Store(c)
+	return map[string]store{"aws3store": &aws3, "s3store": &goamz}
+}
+
+func TestS3Compatible(t *testing.T) {
+	for name, backend := range s3Backends(t, "suite-"+randomName(t)+"/") {
+		t.Run(name, func(t *testing.T) {
+			testS3Backend(t, backend)
+		})
+	}
+}
+
+func testS3Backend(t *testing.T, backend store) {
+	var nonce [32]byte
+
+	small := []byte("hello s3\n")
+	check(t, backend.PostReader("small.txt", bytes.NewReader(small), int64(len(small)), "text/plain", nonce))
+	defer backend.Delete("small.txt")
+	expectBlob(t, backend, "small.txt", nonce, small)
+
+	// unknown length and bigger than one part goes multipart
+	big := make([]byte, multiPartSize+12345)
+	rand.Read(big)
+	check(t, backend.PostReader("staging_big", bytes.NewReader(big), -1, "", nonce))
+	check(t, backend.Move("staging_big", "big.bin"))
+	defer backend.Delete("big.bin")
+	expectBlob(t, backend, "big.bin", nonce, big)
+
+	if _, err := backend.GetReader("staging_big", nonce); err == nil {
+		t.Errorf("staging blob still there after move")
+	}
+
+	rc, err := backend.GetRangeReader("big.bin", nonce, multiPartSize-10, 20)
+	check(t, err)
+	got, err := ioutil.ReadAll(rc)
+	check(t, err)
+	rc.Close()
+	if !bytes.Equal(got, big[multiPartSize-10:multiPartSize+10]) {
+		t.Errorf("range not equal")
+	}
+
+	for _, p := range []string{"list/a", "list/b", "list/c"} {
+		check(t, backend.PostReader(p, bytes.NewReader(small), int64(len(small)), "", nonce))
+		defer backend.Delete(p)
+	}
+	keys, err := backend.List("list/")
+	check(t, err)
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "list/a" || keys[2] != "list/c" {
+		t.Errorf("wrong listing %v", keys)
+	}
+
+	check(t, backend.Delete("small.txt"))
+	if _, err := backend.GetReader("small.txt", nonce); err == nil {
+		t.Errorf("deleted blob still readable")
+	}
+	// deleting something that is not there is fine
+	check(t, backend.Delete("small.txt"))
+}
+
+func TestS3CompatibleEncrypted(t *testing.T) {
+	for name, backend := range s3Backends(t, "enc-"+randomName(t)+"/") {
+		t.Run(name, func(t *testing.T) {
+			key := masterKey{id: "1"}
+			rand.Read(key.key[:])
+			enc := encryptedStore{backend: backend, keys: []masterKey{key}}
+			nonce, _ := enc.GenNonce()
+
+			contents := make([]byte, 3*packagePayloadSize+77)
+			rand.Read(contents)
+			check(t, enc.PostReader("enc.bin", bytes.NewReader(contents), -1, "", nonce))
+			defer enc.Delete("enc.bin")
+
+			expectBlob(t, &enc, "enc.bin", nonce, contents)
+
+			rc, err := enc.GetRangeReader("enc.bin", nonce, 2*packagePayloadSize-3, 100)
+			check(t, err)
+			got, err := ioutil.ReadAll(rc)
+			check(t, err)
+			rc.Close()
+			if !bytes.Equal(got, contents[2*packagePayloadSize-3:2*packagePayloadSize+97]) {
+				t.Errorf("encrypted range not equal")
+			}
+
+			raw, err := backend.GetReader("enc.bin", nonce)
+			check(t, err)
+			stored, _ := ioutil.ReadAll(raw)
+			raw.Close()
+			if bytes.Contains(stored, contents[:64]) {
+				t.Errorf("plaintext found in the bucket")
+			}
+		})
+	}
+}
+
+func expectBlob(t *testing.T, s store, path string, nonce [32]byte, want []byte) {
+	t.Helper()
+	rc, err := s.GetReader(path, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	check(t, err)
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s not equal", path)
+	}
+}
+
+// keeps runs against a shared real bucket apart
+func randomName(t *testing.T) string {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	check(t, err)
+	return fmt.Sprintf("%x", b)
+}
+
+// a presigned url works without credentials, and what is put
+// through it bypasses the encryption layer: the client decrypts
+// a blob it downloads directly with that blob's key
+func TestPresign(t *testing.T) {
+	initEncryptedLocal()
+	c := testS3Config(t)
+	c.Prefix = "presign-" + randomName(t) + "/"
+	aws3, err := newAws3Store(c)
+	check(t, err)
+	var p Presigner = aws3
+
+	contents := []byte("straight to the bucket\n")
+	u, err := p.PresignPut("staged.txt", int64(len(contents)), "text/plain", time.Minute)
+	check(t, err)
+	req, _ := http.NewRequest("PUT", u, bytes.NewReader(contents))
+	req.Header.Set("Content-Type", "text/plain")
+	res, err := http.DefaultClient.Do(req)
+	check(t, err)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("presigned put: %d", res.StatusCode)
+	}
+	var zero [32]byte
+	expectBlob(t, &aws3, "staged.txt", zero, contents)
+
+	enc := &encryptedStore{backend: &aws3, keys: Encrypted.keys}
+	nonce, _ := enc.GenNonce()
+	check(t, enc.PostReader("blob.txt", bytes.NewReader(contents), -1, "", nonce))
+	u, err = p.PresignGet("blob.txt", time.Minute)
+	check(t, err)
+	res, err = http.Get(u)
+	check(t, err)
+	defer res.Body.Close()
+	key, err := enc.BlobKey(enc.KeyID(), nonce)
+	check(t, err)
+	decrypted, err := sio.DecryptReader(res.Body, sio.Config{Key: key[:]})
+	check(t, err)
+	plain, err := ioutil.ReadAll(decrypted)
+	check(t, err)
+	if !bytes.Equal(plain, contents) {
+		t.Errorf("presigned get: %q", plain)
+	}
+	if _, err := enc.BlobKey("nope", nonce); err == nil {
+		t.Errorf("key for an unknown key id")
+	}
+}
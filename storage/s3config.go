@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+)
+
+// s3Config is shared by both s3 backends. Left empty, everything
+// points at the hosted sphinx-memes bucket on AWS. Self-hosters can
+// point S3_ENDPOINT at any S3-compatible server (MinIO, Garage, ...)
+type s3Config struct {
+	Endpoint  string // e.g. http://localhost:9000, empty for AWS
+	PathStyle bool   // bucket in the path instead of the host name
+	Region    string
+	Bucket    string
+	Prefix    string // prepended to every key, e.g. "memes/"
+	Key       string
+	Secret    string
+}
+
+// s3ConfigFromEnv reads the S3_ variables, each with envPrefix
+// in front (e.g. TARGET_S3_BUCKET), see Open
+func s3ConfigFromEnv(envPrefix string) s3Config {
+	cfg := s3Config{
+		Endpoint: os.Getenv(envPrefix + "S3_ENDPOINT"),
+		Region:   os.Getenv(envPrefix + "S3_REGION"),
+		Bucket:   os.Getenv(envPrefix + "S3_BUCKET"),
+		Prefix:   os.Getenv(envPrefix + "S3_PREFIX"),
+		Key:      os.Getenv(envPrefix + "S3_KEY"),
+		Secret:   os.Getenv(envPrefix + "S3_SECRET"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Bucket == "" {
+		cfg.Bucket = BUCKET_NAME
+	}
+	// most self-hosted servers only do path-style addressing,
+	// so that is the default as soon as an endpoint is set
+	cfg.PathStyle = cfg.Endpoint != ""
+	if pathStyle, err := strconv.ParseBool(os.Getenv(envPrefix + "S3_PATH_STYLE")); err == nil {
+		cfg.PathStyle = pathStyle
+	}
+	return cfg
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rangeHeader formats an HTTP Range value for the s3 backends
+func rangeHeader(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+type readSeeker struct {
+	store  store
+	path   string
+	nonce  [32]byte
+	size   int64
+	offset int64
+	rc     io.ReadCloser
+	rcPos  int64
+}
+
+// NewReadSeeker makes a stored blob of known plaintext size seekable (for
+// http.ServeContent). Seeking only moves the offset; the next Read after a
+// seek reopens the blob with a ranged read from there. Nothing is opened
+// until the first Read, so a Range request costs one backend read, and a
+// missing blob is reported by that Read
+func NewReadSeeker(s store, path string, nonce [32]byte, size int64) io.ReadSeekCloser {
+	return &readSeeker{store: s, path: path, nonce: nonce, size: size}
+}
+
+func (s *readSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if s.rc != nil && s.rcPos != s.offset {
+		s.rc.Close()
+		s.rc = nil
+	}
+	if s.rc == nil {
+		rc, err := s.store.GetRangeReader(s.path, s.nonce, s.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		s.rc = rc
+		s.rcPos = s.offset
+	}
+	n, err := s.rc.Read(p)
+	s.offset += int64(n)
+	s.rcPos += int64(n)
+	return n, err
+}
+
+func (s *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *readSeeker) Close() error {
+	if s.rc == nil {
+		return nil
+	}
+	return s.rc.Close()
+}
@@ -1,10 +1,12 @@
 package storage
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 // Init starts
@@ -14,22 +16,136 @@ func Init() {
 		mode = "local"
 	}
 	if mode == "s3" || mode == "S3" {
-		Store = &bucket
+		Raw = &bucket
+		LegacyEncrypted = false
+	} else if mode == "s3store" {
+		Raw = &space
+		LegacyEncrypted = false
+	} else if mode == "memory" {
+		Raw = &Memory
+		LegacyEncrypted = false
 	} else {
-		Store = &Local // pointer
+		Raw = &Local // pointer
+		LegacyEncrypted = true
 	}
 	fmt.Printf("storage mode: %s\n", mode)
-	Store.Init()
+	Raw.Init()
+
+	// everything is written through the encryption layer,
+	// and read through the cache when there is one
+	backend, err := cacheFromEnv(Raw)
+	if err != nil {
+		log.Fatalf("cache: %v", err)
+	}
+	Encrypted.backend = backend
+	Encrypted.Init()
+	Store = &Encrypted
+}
+
+// Open makes another encrypted store next to the one Init set up, e.g.
+// to migrate blobs into, with the same master keys. Its settings are the
+// usual variables with envPrefix in front, TARGET_LOCAL_DIR or
+// TARGET_S3_BUCKET for "TARGET_". mode is local, s3, s3store (goamz)
+// or memory, a new empty one
+func Open(mode, envPrefix string) (store, error) {
+	var backend store
+	switch strings.ToLower(mode) {
+	case "local":
+		dir := os.Getenv(envPrefix + "LOCAL_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("%sLOCAL_DIR is not set", envPrefix)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		backend = &localStore{prefix: dir}
+	case "s3":
+		s, err := newAws3Store(s3ConfigFromEnv(envPrefix))
+		if err != nil {
+			return nil, err
+		}
+		backend = &s
+	case "s3store":
+		s := newS3Store(s3ConfigFromEnv(envPrefix))
+		backend = &s
+	case "memory":
+		backend = &memoryStore{files: map[string][]byte{}}
+	default:
+		return nil, fmt.Errorf("unknown storage mode %s", mode)
+	}
+	return &encryptedStore{backend: backend, keys: Encrypted.keys}, nil
 }
 
 // Store ...
 var Store store
 
+// Raw is the backend underneath Store, for reading blobs
+// that were written before they were encrypted at rest
+var Raw store
+
+// LegacyEncrypted tells whether blobs written before the shared
+// encryption layer were already encrypted by this backend.
+// localStore always encrypted, the s3 stores never did
+var LegacyEncrypted bool
+
+// Backend picks the store to read a media's blobs from, keyID
+// is the master key its blob row records
+func Backend(encrypted bool, keyID string) store {
+	if !encrypted {
+		return Raw
+	}
+	if e, ok := Store.(*encryptedStore); ok {
+		return e.WithKey(keyID)
+	}
+	return Store
+}
+
+// Uncached is Backend without the cache, for going through every
+// blob once, which would only flush it, or for checking what the
+// backend itself holds
+func Uncached(encrypted bool, keyID string) store {
+	if !encrypted {
+		return Raw
+	}
+	if Cache == nil {
+		return Backend(true, keyID)
+	}
+	return &encryptedStore{backend: Raw, keys: Encrypted.keys, keyID: keyID}
+}
+
+// every backend streams: PostReader consumes the reader as it
+// uploads and GetReader hands back a reader straight off the backend,
+// so no blob is ever held in memory as a whole. A length of -1
+// on PostReader or GetRangeReader means "unknown" or "to the end"
 type store interface {
 	Init()
 	GetReader(string, [32]byte) (io.ReadCloser, error)
-	PostReader(string, *bytes.Buffer, int64, string, [32]byte) error
+	GetRangeReader(string, [32]byte, int64, int64) (io.ReadCloser, error)
+	PostReader(string, io.Reader, int64, string, [32]byte) error
+	Move(string, string) error
 	Delete(string) error
 	GenNonce() ([32]byte, error)
 	List(string) ([]string, error)
 }
+
+// Presigner is a backend that clients can talk to directly, with short
+// lived urls that carry their own authorization. Whatever goes through
+// them bypasses the encryption layer, see Presign
+type Presigner interface {
+	PresignPut(path string, length int64, contentType string, expires time.Duration) (string, error)
+	PresignGet(path string, expires time.Duration) (string, error)
+}
+
+// Presign is Raw as a Presigner, if it is one. Only aws3store is,
+// the other backends are reached through the server
+func Presign() (Presigner, bool) {
+	p, ok := Raw.(Presigner)
+	return p, ok
+}
+
+// readCloser pairs a wrapping reader (e.g. a decrypter)
+// with the underlying source that needs closing
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	initEncryptedLocal()
+
+	server := httptest.NewServer(newFakeS3())
+	defer server.Close()
+	t.Setenv("TARGET_LOCAL_DIR", t.TempDir())
+	t.Setenv("TARGET_S3_ENDPOINT", server.URL)
+	t.Setenv("TARGET_S3_BUCKET", "memes-target")
+	t.Setenv("TARGET_S3_KEY", "test")
+	t.Setenv("TARGET_S3_SECRET", "test")
+
+	contents := []byte("moving house\n")
+	for _, mode := range []string{"local", "s3", "s3store"} {
+		target, err := Open(mode, "TARGET_")
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		nonce, _ := target.GenNonce()
+		check(t, target.PostReader("moved.txt", bytes.NewReader(contents), -1, "", nonce))
+		expectBlob(t, target, "moved.txt", nonce, contents)
+
+		// encrypted with the master key of Store
+		if target.(*encryptedStore).KeyID() != Encrypted.KeyID() {
+			t.Errorf("%s: different master key", mode)
+		}
+		raw, err := target.(*encryptedStore).backend.GetReader("moved.txt", nonce)
+		check(t, err)
+		stored, _ := ioutil.ReadAll(raw)
+		raw.Close()
+		if bytes.Contains(stored, contents) {
+			t.Errorf("%s: stored in plaintext", mode)
+		}
+	}
+
+	if _, err := Open("floppy", "TARGET_"); err == nil {
+		t.Errorf("unknown mode opened")
+	}
+}
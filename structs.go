@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"time"
@@ -9,27 +10,126 @@ import (
 	"github.com/lib/pq"
 )
 
-// Media struct
+// Media struct, one per owner. Several owners can upload the
+// same bytes, their rows share the muid and the Blob behind it
 type Media struct {
-	ID          string         `json:"muid"`
-	OwnerPubKey string         `json:"owner_pub_key"`
-	Name        string         `json:"name"`
-	Description string         `json:"description"`
-	Price       int64          `json:"price"`
-	Tags        pq.StringArray `json:"tags"`
-	Filename    string         `json:"filename"`
-	TTL         int64          `json:"ttl"`
-	Size        int64          `json:"size"`
-	Mime        string         `json:"mime"`
-	Nonce       string         `json:"-"`
-	Created     *time.Time     `json:"created"`
-	Updated     *time.Time     `json:"updated"`
-	Expiry      *time.Time     `json:"expiry"`
-	TotalSats   int64          `json:"total_sats,omitempty"`
-	TotalBuys   int64          `json:"total_buys,omitempty"`
-	Width       int            `json:"width"`
-	Height      int            `json:"height"`
-	Template    bool           `json:"template"`
+	ID           string         `json:"muid"`
+	OwnerPubKey  string         `json:"owner_pub_key"`
+	Name         string         `json:"name"`
+	Description  string         `json:"description"`
+	Price        int64          `json:"price"`
+	Tags         pq.StringArray `json:"tags"`
+	Filename     string         `json:"filename"`
+	TTL          int64          `json:"ttl"`
+	Size         int64          `json:"size"`
+	Mime         string         `json:"mime"`
+	Created      *time.Time     `json:"created"`
+	Updated      *time.Time     `json:"updated"`
+	Expiry       *time.Time     `json:"expiry"`
+	TotalSats    int64          `json:"total_sats,omitempty"`
+	TotalBuys    int64          `json:"total_buys,omitempty"`
+	Width        int            `json:"width"`
+	Height       int            `json:"height"`
+	Template     bool           `json:"template"`
+	Purged       bool           `json:"-"`
+	Status       string         `json:"status"`
+	Metadata     string         `json:"metadata"` // kept or stripped, see metadata.go
+	Blurhash     string         `json:"blurhash"`
+	Palette      pq.StringArray `json:"palette"` // dominant colors as #rrggbb, see preview.go
+	Phash        int64          `json:"-"`
+	PhashBands   pq.Int64Array  `json:"-"`                       // see similar.go
+	FromTemplate string         `json:"from_template,omitempty"` // muid of the template it was rendered from
+	Public       bool           `json:"public"`                  // uploaded to /public, or rendered
+}
+
+// Blob is the stored file behind media rows, named by its content hash.
+// Refcount is the number of live media rows using it, the files are
+// deleted along with the last one
+type Blob struct {
+	ID        string     `json:"muid"`
+	Nonce     string     `json:"-"`
+	Size      int64      `json:"size"`
+	Encrypted bool       `json:"-"`
+	KeyID     string     `json:"-"` // master key the files are encrypted under
+	Refcount  int64      `json:"refcount"`
+	Created   *time.Time `json:"created"`
+	Scrubbed  *time.Time `json:"scrubbed"` // last integrity check
+	Corrupt   bool       `json:"corrupt"`  // did not hash to its muid then
+}
+
+// NonceBytes decodes the nonce the blob's files are encrypted with
+func (b Blob) NonceBytes() [32]byte {
+	var nonce [32]byte
+	nonceBytes, err := hex.DecodeString(b.Nonce)
+	if err == nil {
+		copy(nonce[:], nonceBytes)
+	}
+	return nonce
+}
+
+// Variant is a derivative stored next to a blob's original, under
+// the blob's muid with Suffix appended
+type Variant struct {
+	Muid    string     `json:"muid"`
+	Suffix  string     `json:"suffix"`
+	Mime    string     `json:"mime"`
+	Size    int64      `json:"size"`
+	Created *time.Time `json:"created"`
+}
+
+// Job is a queued derivative for a muid, see jobs.go
+type Job struct {
+	ID        int64      `json:"id"`
+	Kind      string     `json:"kind"`
+	Muid      string     `json:"muid"`
+	State     string     `json:"state"`
+	Attempts  int        `json:"attempts"`
+	RunAt     *time.Time `json:"run_at"`
+	LastError string     `json:"last_error"`
+	Created   *time.Time `json:"created"`
+}
+
+// Usage is what an owner stores against their quota, 0 is no limit
+type Usage struct {
+	Bytes          int64 `json:"bytes"`
+	Files          int64 `json:"files"`
+	BytesToday     int64 `json:"bytes_today"` // uploaded in the last 24 hours
+	Reserved       int64 `json:"reserved"`    // declared by tus and presigned uploads still coming in
+	Pending        int64 `json:"pending"`     // how many of those there are
+	MaxBytes       int64 `json:"max_bytes"`
+	MaxFiles       int64 `json:"max_files"`
+	MaxBytesPerDay int64 `json:"max_bytes_per_day"`
+}
+
+// Quota overrides the default limits for one owner,
+// nil fields keep the default
+type Quota struct {
+	OwnerPubKey    string
+	MaxBytes       *int64
+	MaxFiles       *int64
+	MaxBytesPerDay *int64
+}
+
+// TableName is not left to gorm, which takes quota for a plural
+func (Quota) TableName() string {
+	return "quotas"
+}
+
+// Upload is a tus or presigned upload in progress, see tus.go
+type Upload struct {
+	ID          string
+	OwnerPubKey string
+	Kind        string
+	Via         string // tus or presign
+	Length      int64
+	Received    int64 // the Upload-Offset
+	Metadata    string
+	Muid        string // once finished
+	Nonce       string // hex, the key presigned uploads are sealed with
+	KeyID       string // is derived from it and this master key
+	Claimed     string // the muid a presigned upload is finalized with
+	Expires     *time.Time
+	Created     *time.Time
 }
 
 type LSAT struct {
@@ -2,65 +2,149 @@ package main
 
 import (
 	"bytes"
-	"encoding/hex"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/nfnt/resize"
 	"github.com/oliamb/cutter"
+	_ "golang.org/x/image/webp"
 
 	"github.com/stakwork/sphinx-meme/storage"
 )
 
-// MigrateThumbnails images
-func MigrateThumbnails() {
+// MigrateThumbnails makes the variants of public images that are not
+// there yet: the thumbnails, and the given resizes to have them ready
+// before anyone asks. Thumbnails from before their type was recorded
+// are made again, with the type of the original and upright. Blobs are
+// skipped until they are encrypted at rest, as variants always are
+func MigrateThumbnails(specs []resizeSpec) {
 
 	oy := DB.getAllMedia()
 	fmt.Printf("=> %+v\n", len(oy))
 
 	thelength := len(oy)
 
+	done := map[string]bool{}
+	failed := 0
 	for i, m := range oy {
-		// only special imgs have height and width
-		if m.Mime == "image/jpg" && m.Width == 0 && m.Height == 0 {
-			fmt.Printf("=> %v:%v\n", thelength, i)
+		// owners of the same content share its variants
+		if done[m.ID] || !strings.HasPrefix(m.Mime, "image/") || m.Template {
+			continue
+		}
+		done[m.ID] = true
+		blob := DB.getBlob(m.ID)
+		if !blob.Encrypted {
+			continue
+		}
+		fmt.Printf("=> %v:%v\n", thelength, i)
+
+		if err := tryMigrate(blob, specs); err != nil {
+			fmt.Println("failed", m.ID, err)
+			failed++
+		}
+	}
+	fmt.Printf("=> done, %d failed\n", failed)
+}
 
-			tryMigrate(m.ID, m.Nonce)
+func tryMigrate(blob Blob, specs []resizeSpec) error {
+	for _, suffix := range variantSuffixes {
+		if DB.getVariant(blob.ID, suffix).Muid != "" {
+			continue
+		}
+		if err := fromStore(blob, jobKinds[variantJobs[suffix]]); err != nil {
+			return err
 		}
 	}
+	return warmResizes(blob, specs)
 }
 
-func tryMigrate(muid string, nonceString string) error {
-	// fmt.Printf("=> TRY MIGRATE %+v\n", "hi")
-	nonceBytes, err := hex.DecodeString(nonceString)
-	var nonce [32]byte
+// derived variants are stored next to the original under these suffixes
+const (
+	thumbSuffix  = "_thumb"
+	mediumSuffix = "_medium"
+)
+
+var variantSuffixes = []string{thumbSuffix, mediumSuffix}
+
+// fromStore reads a stored blob back and hands it to a derivative generator
+func fromStore(blob Blob, generate func(string, [32]byte, io.ReadCloser) error) error {
+	nonce := blob.NonceBytes()
+	reader, err := storage.Backend(blob.Encrypted, blob.KeyID).GetReader(blob.ID, nonce)
 	if err != nil {
+		should(err)
 		return err
 	}
-	copy(nonce[:], nonceBytes)
+	err = generate(blob.ID, nonce, reader)
+	should(err)
+	return err
+}
+
+// variants of images with transparency are PNG, so they keep it,
+// the rest are JPEG. Variants made before this was recorded are JPEG
+const legacyVariantMime = "image/jpg"
 
-	reader, err := storage.Store.GetReader(muid, nonce)
+// decodeImage reads a JPEG, PNG, GIF (its most representative frame)
+// or WebP, turned upright by its EXIF orientation, and whether it has
+// any transparency
+func decodeImage(reader io.Reader) (image.Image, bool, error) {
+	data, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
+	// the header is checked before anything is decoded
+	if err := checkImage(data); err != nil {
+		return nil, false, err
+	}
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, false, err
+		}
+		frame := representativeFrame(g)
+		if frame == nil {
+			return nil, false, errAnimation{"No frames"}
+		}
+		return frame, !frame.Opaque(), nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	opaque, ok := img.(interface{ Opaque() bool })
+	return applyOrientation(img, exifOrientation(data)), !ok || !opaque.Opaque(), nil
+}
 
-	// do medium sized pic
-	err = uploadMediumSizePic(muid, nonce, reader)
+// postVariant stores img as the variant of muid with the given
+// suffix, and records the type and size it was stored with
+func postVariant(muid, suffix string, nonce [32]byte, img image.Image, transparent bool) error {
+	buf := new(bytes.Buffer)
+	mime := "image/jpeg"
+	var err error
+	if transparent {
+		mime = "image/png"
+		err = png.Encode(buf, img)
+	} else {
+		err = jpeg.Encode(buf, img, nil)
+	}
 	if err != nil {
+		should(err)
 		return err
 	}
-
-	// do thumbnail pic
-	// err = uploadThumb(muid, nonce, reader)
-
-	return err
+	size := int64(buf.Len())
+	err = storage.Store.PostReader(muid+suffix, buf, size, mime, nonce)
+	if err != nil {
+		return err
+	}
+	return DB.setVariant(Variant{Muid: muid, Suffix: suffix, Mime: mime, Size: size})
 }
 
 // Axj5psD9cSYQWWwhDrgHj4EY5MotgrD79cYznantwzA=
@@ -69,14 +153,14 @@ func tryMigrate(muid string, nonceString string) error {
 func uploadThumb(muid string, nonce [32]byte, reader io.ReadCloser) error {
 	defer reader.Close()
 
-	img, err := jpeg.Decode(reader)
+	img, transparent, err := decodeImage(reader)
 	if err != nil {
 		return err
 	}
 
 	// fmt.Printf("=> uploadThumb %+v\n", muid)
 
-	min := calcMin(img.Bounds().Max.X, img.Bounds().Max.Y)
+	min := calcMin(img.Bounds().Dx(), img.Bounds().Dy())
 	croppedImg, err := cutter.Crop(img, cutter.Config{
 		Width: min, Height: min,
 		Anchor: image.Point{1, 1},
@@ -87,31 +171,22 @@ func uploadThumb(muid string, nonce [32]byte, reader io.ReadCloser) error {
 	draw.Draw(circleImg, circleImg.Bounds(), &image.Uniform{color.Transparent}, image.ZP, draw.Src) //white
 	r := int(min / 2)
 	p := image.Point{X: r, Y: r}
-	draw.DrawMask(circleImg, circleImg.Bounds(), croppedImg, image.ZP, &circle{p, r}, image.ZP, draw.Over)
+	draw.DrawMask(circleImg, circleImg.Bounds(), croppedImg, croppedImg.Bounds().Min, &circle{p, r}, image.ZP, draw.Over)
 
 	thumb := resize.Thumbnail(60, 60, circleImg, resize.Lanczos3)
 
-	buf := new(bytes.Buffer)
-	err = jpeg.Encode(buf, thumb, nil)
-	if err != nil {
-		should(err)
-		return err
-	}
-
-	storage.Store.PostReader(muid+"_thumb", buf, int64(buf.Len()), "image/jpg", nonce)
-
-	return nil
+	return postVariant(muid, thumbSuffix, nonce, thumb, transparent)
 }
 
 func uploadMediumSizePic(muid string, nonce [32]byte, reader io.ReadCloser) error {
 	defer reader.Close()
 
-	img, err := jpeg.Decode(reader)
+	img, transparent, err := decodeImage(reader)
 	if err != nil {
 		return err
 	}
 
-	min := calcMin(img.Bounds().Max.X, img.Bounds().Max.Y)
+	min := calcMin(img.Bounds().Dx(), img.Bounds().Dy())
 
 	croppedImg, err := cutter.Crop(img, cutter.Config{
 		Width: min, Height: min,
@@ -121,16 +196,7 @@ func uploadMediumSizePic(muid string, nonce [32]byte, reader io.ReadCloser) erro
 
 	mediumPic := resize.Thumbnail(400, 400, croppedImg, resize.Lanczos3)
 
-	buf := new(bytes.Buffer)
-	err = jpeg.Encode(buf, mediumPic, nil)
-	if err != nil {
-		should(err)
-		return err
-	}
-
-	storage.Store.PostReader(muid+"_medium", buf, int64(buf.Len()), "image/jpg", nonce)
-
-	return nil
+	return postVariant(muid, mediumSuffix, nonce, mediumPic, transparent)
 }
 
 func calcMin(a, b int) int {
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stakwork/sphinx-meme/auth"
+	"github.com/stakwork/sphinx-meme/lsat"
+	"github.com/stakwork/sphinx-meme/rand"
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// tus 1.0 resumable uploads (https://tus.io/protocols/resumable-upload)
+// with the creation, expiration and termination extensions. Chunks are
+// appended to a file in TUS_DIR, and once the last one is in, the file
+// goes through the same path as a multipart upload. The dir is local, so
+// with several servers a client has to stick to one for an upload
+const tusVersion = "1.0.0"
+
+// what an upload turns into, picked with its "kind" metadata.
+// They match the multipart routes /file, /public and /template
+const (
+	uploadKindFile     = "file"
+	uploadKindPublic   = "public"
+	uploadKindTemplate = "template"
+)
+
+// how the bytes of an upload come in: tus chunks, or
+// a single PUT to a presigned url, see presign.go
+const (
+	uploadViaTus     = "tus"
+	uploadViaPresign = "presign"
+)
+
+// a PATCH (or presigned PUT, or finalize) at a time per upload
+var tusLocks sync.Map
+
+func tusDir() string {
+	dir := os.Getenv("TUS_DIR")
+	if dir == "" {
+		dir = "tus"
+	}
+	return dir
+}
+
+// unfinished uploads are dropped TUS_EXPIRY seconds after
+// their last chunk, a day by default
+func tusExpiry() time.Duration {
+	if secs, err := strconv.Atoi(os.Getenv("TUS_EXPIRY")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+func tusPath(id string) string {
+	return filepath.Join(tusDir(), id)
+}
+
+func tusLock(id string) *sync.Mutex {
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+func tusError(w http.ResponseWriter, status int, message string) {
+	fmt.Println(message)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(message)
+}
+
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		tusError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes Upload-Metadata, comma separated
+// keys each followed by a space and its value in base64
+func parseTusMetadata(header string) (url.Values, error) {
+	form := url.Values{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad metadata value for %s", parts[0])
+			}
+			value = string(decoded)
+		}
+		form.Set(parts[0], value)
+	}
+	return form, nil
+}
+
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusCreate starts an upload. Its size and metadata are checked right
+// away, so that a client does not find out after sending everything
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	u, ok := newUpload(w, r, uploadViaTus)
+	if !ok {
+		return
+	}
+
+	err := os.MkdirAll(tusDir(), 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.Create(tusPath(u.ID))
+		if err == nil {
+			f.Close()
+		}
+	}
+	if err == nil {
+		err = DB.createUpload(u)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Remove(tusPath(u.ID))
+		tusError(w, http.StatusInternalServerError, "Could not create upload")
+		return
+	}
+
+	w.Header().Set("Location", "/tus/"+u.ID)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// newUpload is a new upload from the Upload-Length and Upload-Metadata
+// headers, checked against the max upload size and the media fields
+func newUpload(w http.ResponseWriter, r *http.Request, via string) (Upload, bool) {
+	ctx := r.Context()
+	pubKey := ctx.Value(auth.ContextKey).(string)
+	maxSize := ctx.Value(lsat.MaxUploadSizeContextKey).(int64)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(w, http.StatusBadRequest, "Upload-Length is required")
+		return Upload{}, false
+	}
+	if length > maxSize {
+		tusError(w, http.StatusRequestEntityTooLarge, "File too big")
+		return Upload{}, false
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	form, err := parseTusMetadata(metadata)
+	if err != nil {
+		tusError(w, http.StatusBadRequest, err.Error())
+		return Upload{}, false
+	}
+	kind := form.Get("kind")
+	if kind == "" {
+		kind = uploadKindFile
+	}
+	if kind != uploadKindFile && kind != uploadKindPublic && kind != uploadKindTemplate {
+		tusError(w, http.StatusBadRequest, "Unknown upload kind")
+		return Upload{}, false
+	}
+	if _, err := mediaFromForm(pubKey, form, "", ""); err != nil {
+		tusError(w, http.StatusBadRequest, err.Error())
+		return Upload{}, false
+	}
+	// the content is sniffed once it is all in, a type
+	// that is not allowed anyway is turned away right now
+	if filetype := form.Get("filetype"); filetype != "" {
+		if err := checkAllowed(kind, filetype); err != nil {
+			tusError(w, http.StatusUnsupportedMediaType, err.Error())
+			return Upload{}, false
+		}
+	}
+
+	id, err := rand.GenerateRandomHexString(32)
+	if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not create upload")
+		return Upload{}, false
+	}
+	now := time.Now()
+	expires := now.Add(tusExpiry())
+	return Upload{
+		ID:          id,
+		OwnerPubKey: pubKey,
+		Kind:        kind,
+		Via:         via,
+		Length:      length,
+		Metadata:    metadata,
+		Expires:     &expires,
+		Created:     &now,
+	}, true
+}
+
+// loadUpload is the caller's upload from the url, answering 404 for
+// someone else's or an unknown one, and 410 once it has expired
+func loadUpload(w http.ResponseWriter, r *http.Request, via string) (Upload, bool) {
+	pubKey := r.Context().Value(auth.ContextKey).(string)
+	u := DB.getUpload(chi.URLParam(r, "id"), pubKey)
+	if u.ID == "" || u.Via != via {
+		tusError(w, http.StatusNotFound, "Upload not found")
+		return u, false
+	}
+	if u.Expires != nil && !u.Expires.After(time.Now()) {
+		tusError(w, http.StatusGone, "Upload expired")
+		return u, false
+	}
+	return u, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, u Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Expires != nil {
+		w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	}
+	// not part of tus: the muid of a finished upload
+	if u.Muid != "" {
+		w.Header().Set("Upload-Muid", u.Muid)
+	}
+}
+
+func tusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	u, ok := loadUpload(w, r, uploadViaTus)
+	if !ok {
+		return
+	}
+	setUploadHeaders(w, u)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatch appends a chunk at Upload-Offset. Whatever arrives is kept
+// even if the connection drops halfway, that is what the client
+// resumes from. The last chunk finishes the upload
+func tusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		tusError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		tusError(w, http.StatusBadRequest, "Upload-Offset is required")
+		return
+	}
+
+	lock := tusLock(chi.URLParam(r, "id"))
+	if !lock.TryLock() {
+		tusError(w, http.StatusConflict, "Upload is busy")
+		return
+	}
+	defer lock.Unlock()
+
+	// loaded under the lock, so the offset is current
+	u, ok := loadUpload(w, r, uploadViaTus)
+	if !ok {
+		return
+	}
+	if offset != u.Received {
+		setUploadHeaders(w, u)
+		tusError(w, http.StatusConflict, "Upload-Offset does not match")
+		return
+	}
+
+	if u.Received < u.Length {
+		n, err := appendChunk(u, r.Body)
+		if n > 0 {
+			u.Received += n
+			expires := time.Now().Add(tusExpiry())
+			u.Expires = &expires
+			if err := DB.updateUploadReceived(u.ID, u.Received, expires); err != nil {
+				tusError(w, http.StatusInternalServerError, "Could not save chunk")
+				return
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+			setUploadHeaders(w, u)
+			tusError(w, http.StatusBadRequest, "Upload interrupted")
+			return
+		}
+	}
+
+	// a finish that failed is tried again by
+	// sending an empty chunk at the end
+	if u.Received == u.Length && u.Muid == "" {
+		media, err := finishUpload(u)
+		if err != nil {
+			setUploadHeaders(w, u)
+			if err == errExpiryInPast {
+				tusError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if isMimeError(err) {
+				tusError(w, http.StatusUnsupportedMediaType, err.Error())
+				return
+			}
+			if e, ok := err.(errQuota); ok {
+				tusError(w, e.status, e.message)
+				return
+			}
+			tusError(w, http.StatusInternalServerError, "Error Storing the File")
+			return
+		}
+		u.Muid = media.ID
+	}
+
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendChunk writes the body after what is already received. A write
+// that was cut short before it was recorded is cut off first
+func appendChunk(u Upload, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(tusPath(u.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := f.Truncate(u.Received); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(u.Received, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(body, u.Length-u.Received))
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return n, copyErr
+}
+
+// finishUpload stores the complete file the way uploadFile does
+func finishUpload(u Upload) (Media, error) {
+	f, err := os.Open(tusPath(u.ID))
+	if err != nil {
+		return Media{}, err
+	}
+	defer f.Close()
+	created, err := completeUpload(u, f, "")
+	if err != nil {
+		return Media{}, err
+	}
+	os.Remove(tusPath(u.ID))
+	return created, nil
+}
+
+var errUploadMismatch = errors.New("upload file does not match its length or hash")
+
+// completeUpload stores the whole of an upload from src, encrypted,
+// and creates its media row. When the client told the muid up front,
+// the file has to hash to it
+func completeUpload(u Upload, src io.Reader, muid string) (Media, error) {
+	form, err := parseTusMetadata(u.Metadata)
+	if err != nil {
+		return Media{}, err
+	}
+	contentType := form.Get("filetype")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	media, err := mediaFromForm(u.OwnerPubKey, form, form.Get("filename"), contentType)
+	if err != nil {
+		return Media{}, err
+	}
+	if err := checkUploadQuota(u); err != nil {
+		return Media{}, err
+	}
+
+	// the length and muid are those of the file as it was sent,
+	// not of what is stored when its metadata is stripped
+	hasher, _ := blake2b.New256(nil)
+	received := &countingWriter{hash: hasher}
+	src, contentType, err = sniffUpload(io.TeeReader(src, received), contentType, u.Kind)
+	if err != nil {
+		return Media{}, err
+	}
+	media.Mime = contentType
+	media.Metadata = metadataKept
+	sent := src
+	if wantsStripped(u.Kind, form) {
+		stripped, ok := stripMetadata(src, contentType)
+		defer stripped.Close()
+		if ok {
+			src, media.Metadata = stripped, metadataStripped
+		}
+	}
+	nonce, _ := storage.Store.GenNonce()
+	stored, err := storeUpload(src, contentType, nonce, u.Kind == uploadKindTemplate)
+	if err != nil {
+		return Media{}, err
+	}
+	// stripping stops at the end of the image, what
+	// follows it still counts towards the length
+	io.Copy(ioutil.Discard, sent)
+	receivedMuid := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+	if received.n != u.Length || (muid != "" && receivedMuid != muid) {
+		storage.Store.Delete(stored.staging)
+		return Media{}, errUploadMismatch
+	}
+	public := u.Kind == uploadKindPublic
+	stored.applyTo(&media)
+	media.Public = public
+
+	created, _, err := saveUpload(stored, nonce, media, derivativeJobs(media.Mime, public, public))
+	if err != nil {
+		return Media{}, err
+	}
+	if err := DB.finishUpload(u.ID, created.ID); err != nil {
+		return Media{}, err
+	}
+	return created, nil
+}
+
+func tusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	lock := tusLock(chi.URLParam(r, "id"))
+	if !lock.TryLock() {
+		tusError(w, http.StatusConflict, "Upload is busy")
+		return
+	}
+	defer lock.Unlock()
+
+	u, ok := loadUpload(w, r, uploadViaTus)
+	if !ok {
+		return
+	}
+	removeUpload(u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeUpload(u Upload) {
+	if u.Via == uploadViaPresign {
+		if err := storage.Raw.Delete(presignPath(u.ID)); err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else if err := os.Remove(tusPath(u.ID)); err != nil && !os.IsNotExist(err) {
+		fmt.Println(err)
+		return
+	}
+	if DB.deleteUpload(u.ID) == nil {
+		tusLocks.Delete(u.ID)
+	}
+}
+
+// reapUploads drops expired uploads, finished or not. One
+// that is taking a chunk right now is not expired after all
+func reapUploads() {
+	dropped := 0
+	for _, u := range DB.getExpiredUploads() {
+		lock := tusLock(u.ID)
+		if !lock.TryLock() {
+			continue
+		}
+		removeUpload(u)
+		lock.Unlock()
+		dropped++
+	}
+	if dropped > 0 {
+		fmt.Printf("reaper: dropped %d expired uploads\n", dropped)
+	}
+}
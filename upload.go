@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stakwork/sphinx-meme/rand"
+	"github.com/stakwork/sphinx-meme/storage"
+)
+
+// blobs are named by their content hash, which is only known once
+// the last byte has gone by, so uploads stream in under a staging key
+// and are moved into place afterwards
+const stagingPrefix = "staging_"
+
+type storedUpload struct {
+	staging string
+	muid    string
+	size    int64
+	width   int
+	height  int
+}
+
+// applyTo sets what was measured of the upload on its media row
+func (stored storedUpload) applyTo(m *Media) {
+	m.Width, m.Height = stored.width, stored.height
+}
+
+// storeUpload streams src into the active store in one pass: the bytes are
+// hashed, counted (and optionally measured) on their way to the store's
+// PostReader, which encrypts and uploads them as they arrive. Nothing is
+// decoded on the way, images get their preview from a job once they are
+// stored, see derivativeJobs. The blob is left under its staging key for
+// saveUpload
+func storeUpload(src io.Reader, contentType string, nonce [32]byte, measureDimensions bool) (storedUpload, error) {
+	stored := storedUpload{}
+
+	random, err := rand.GenerateRandomHexString(32)
+	if err != nil {
+		return stored, err
+	}
+	staging := stagingPrefix + random
+
+	hasher, _ := blake2b.New256(nil) // hash it
+	counter := &countingWriter{hash: hasher}
+	reader := io.TeeReader(src, counter)
+
+	// the header is read off a pipe by a second goroutine,
+	// so the dimensions cost no extra buffering either
+	var measured chan [2]int
+	var pw *io.PipeWriter
+	if measureDimensions {
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		measured = make(chan [2]int, 1)
+		go func() {
+			w, h := getImageDimension(pr)
+			io.Copy(ioutil.Discard, pr)
+			measured <- [2]int{w, h}
+		}()
+		reader = io.TeeReader(reader, pw)
+	}
+
+	err = storage.Store.PostReader(staging, reader, -1, contentType, nonce)
+	if pw != nil {
+		pw.CloseWithError(err)
+		size := <-measured
+		stored.width, stored.height = size[0], size[1]
+	}
+	if err != nil {
+		storage.Store.Delete(staging)
+		return stored, err
+	}
+
+	hash := hasher.Sum(nil)
+	stored.staging = staging
+	stored.muid = base64.URLEncoding.EncodeToString(hash[:])
+	stored.size = counter.n
+	return stored, nil
+}
+
+var errExpiryInPast = errors.New("Expiry is in the past")
+
+// mediaFromForm fills in a new media row from an upload's form fields
+func mediaFromForm(pubKey string, form url.Values, filename, contentType string) (Media, error) {
+	p := uploadParams{}
+	decodeForm(form, &p)
+	return mediaFromParams(pubKey, p, filename, contentType)
+}
+
+// mediaFromParams is mediaFromForm for fields that are already decoded
+func mediaFromParams(pubKey string, p uploadParams, filename, contentType string) (Media, error) {
+	if p.TTL == 0 { // default to one year
+		p.TTL = 60 * 60 * 24 * 365
+	}
+
+	if filename == "" {
+		filename = "file"
+	}
+
+	// expiry is a unix timestamp after which the file is deleted for good
+	var expiry *time.Time
+	if p.Expiry > 0 {
+		e := time.Unix(p.Expiry, 0)
+		if !e.After(time.Now()) {
+			return Media{}, errExpiryInPast
+		}
+		expiry = &e
+	}
+
+	now := time.Now()
+	return Media{
+		OwnerPubKey: pubKey,
+		Name:        p.Name,
+		Description: p.Description,
+		Tags:        p.Tags,
+		Filename:    filename,
+		Mime:        contentType,
+		TTL:         p.TTL,
+		Price:       p.Price,
+		Created:     &now,
+		Updated:     &now,
+		Expiry:      expiry,
+		TotalBuys:   0,
+		TotalSats:   0,
+	}, nil
+}
+
+// derivatives are made by the job queue, which reads the
+// stored blob back rather than keeping a copy of the upload.
+// Images of any kind get their preview made
+func derivativeJobs(contentType string, thumb, medium bool) []string {
+	jobs := []string{}
+	if isPreviewable(contentType) {
+		jobs = append(jobs, jobPreview)
+	}
+	if thumb {
+		jobs = append(jobs, jobThumb)
+	}
+	if medium {
+		jobs = append(jobs, jobMedium)
+	}
+	return jobs
+}
+
+// saveUpload creates the owner's media row for a staged upload. If the
+// content is new, the staged blob is moved to its muid. If someone already
+// uploaded the same bytes, the staged copy is dropped and the row shares
+// the existing blob, whose nonce is returned for reading it. The row is
+// pending until the queued jobs have made its derivatives
+func saveUpload(stored storedUpload, nonce [32]byte, m Media, jobs []string) (Media, Blob, error) {
+	now := time.Now()
+	b := Blob{
+		ID:        stored.muid,
+		Nonce:     hex.EncodeToString(nonce[:]),
+		Size:      stored.size,
+		Encrypted: true,
+		KeyID:     storage.Encrypted.KeyID(),
+		Created:   &now,
+	}
+	m.ID = stored.muid
+	m.Size = stored.size
+	m.Status = mediaReady
+	if len(jobs) > 0 {
+		m.Status = mediaPending
+	}
+	created, blob, isNew, err := DB.createMedia(m, b, jobs, func() error {
+		return storage.Store.Move(stored.staging, stored.muid)
+	}, func() error {
+		return storage.Store.Delete(stored.muid)
+	})
+	if err != nil || !isNew {
+		storage.Store.Delete(stored.staging)
+	}
+	return created, blob, err
+}
+
+// deleteBlobs removes an original and its derived variants
+// from the store. Variants that were never made are not an error.
+// Only call it once the last media row is gone, see releaseMedia
+func deleteBlobs(muid string) error {
+	if err := storage.Store.Delete(muid); err != nil {
+		return err
+	}
+	for _, suffix := range blobVariants(muid) {
+		if err := storage.Store.Delete(muid + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// muidOf hashes a blob's plaintext the same way uploads are named
+func muidOf(r io.Reader) (string, error) {
+	hasher, _ := blake2b.New256(nil)
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// isTooLarge reports whether err came from the request body
+// going over the http.MaxBytesReader limit
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+type countingWriter struct {
+	hash hash.Hash
+	n    int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.hash.Write(p)
+}
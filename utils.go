@@ -7,6 +7,9 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+// cap on the size of a single non-file form field in an upload
+const maxFormValueSize = 1 << 20
+
 type uploadParams struct {
 	Price       int64
 	TTL         int64